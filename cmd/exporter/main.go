@@ -81,6 +81,9 @@ func main() {
 		configFile = config.DefaultConfigFile
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// RUN_ONCE mode: load config, check every tunnel once, print metrics to
 	// stdout, and exit. No HTTP server, watchers, or leader election.
 	if os.Getenv("RUN_ONCE") == "true" {
@@ -88,7 +91,7 @@ func main() {
 
 		slog.Info("running in run-once mode")
 
-		allUp, err := tunnel.RunOnce(configFile, checker.DefaultChecker{}, tunnel.NewPrometheusMetrics(), os.Stdout)
+		allUp, err := tunnel.RunOnce(ctx, configFile, checker.DefaultChecker{}, tunnel.NewPrometheusMetrics(), os.Stdout)
 		if err != nil {
 			slog.Error("run-once failed", "error", err)
 			os.Exit(1)
@@ -111,9 +114,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
-
 	// When leader election is disabled this instance is the implicit leader for the
 	// lifetime of the process. Set the gauge before serving /metrics to avoid a
 	// brief window where scrapes see leader=0.
@@ -161,7 +161,7 @@ func main() {
 	if ipCheckURL == "" {
 		ipCheckURL = metrics.DefaultIPCheckURL
 	}
-	ipResolveCtx, ipResolveCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ipResolveCtx, ipResolveCancel := context.WithTimeout(ctx, 10*time.Second)
 	realIP, ipErr := checker.ResolveRealIP(ipResolveCtx, ipCheckURL)
 	ipResolveCancel()
 	if ipErr != nil {
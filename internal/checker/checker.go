@@ -1,29 +1,50 @@
 // Package checker provides the default health-checker implementation that
 // performs real SOCKS5 HTTP health-checks against tunnel instances.
 //
-// Three check methods are supported (configurable per tunnel via check_method):
+// Nine check methods are supported (configurable per tunnel via check_method):
 //   - "http" (default): GET the check_url and expect status 200, 301, 302,
-//     or 307.
+//     or 307 (or the configured expected_status), optionally asserting
+//     response headers and body regexes.
 //   - "ip": GET an IP-echo service through the proxy and compare the returned
 //     IP with the host's real public IP. Startup normally resolves the real IP
 //     once; if that fails, each ip check retries it. The check passes if the
 //     proxy IP differs from the real IP.
 //   - "download": download from a URL through the proxy and verify that at
-//     least download_min_size bytes are received.
+//     least download_min_size bytes are received, measuring the transfer
+//     speed over the body (up to download_max_size) against the optional
+//     min_throughput.
+//   - "upload": POST upload_size bytes of generated data to upload_url
+//     through the proxy and measure the upload speed.
+//   - "dns": resolve dns_name against dns_server through the proxy over TCP,
+//     UDP or DoH and optionally assert the answer against dns_expected.
+//   - "http3": GET the check_url over HTTP/3, with QUIC carried through the
+//     proxy by SOCKS5 UDP ASSOCIATE.
+//   - "concurrency": GET the check_url with many parallel requests and
+//     require enough of them to succeed.
+//   - "websocket": open websocket_url through the proxy and exchange an echo
+//     message (or a ping) with the server.
+//   - "exec": run exec_command with ALL_PROXY/HTTPS_PROXY pointing at the
+//     tunnel's SOCKS port; exit code 0 passes.
+//
+// Further methods can be added with Register.
 package checker
 
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"regexp"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/batonogov/xray-health-exporter/internal/config"
 	"github.com/batonogov/xray-health-exporter/internal/metrics"
 	"github.com/batonogov/xray-health-exporter/internal/socks"
 	"github.com/batonogov/xray-health-exporter/internal/tunnel"
@@ -33,46 +54,56 @@ import (
 // HTTP health-checks. The real public IP is normally resolved once at startup
 // via ResolveRealIP and stored for ip-method checks.
 type DefaultChecker struct {
-	realIP string
+	env Env
 }
 
 // NewDefaultChecker creates a DefaultChecker with the pre-resolved real public
 // IP. Pass an empty string to retry resolution on each ip-method check.
 func NewDefaultChecker(realIP string) DefaultChecker {
-	return DefaultChecker{realIP: realIP}
+	return DefaultChecker{env: Env{RealIP: realIP}}
 }
 
-// Check dispatches the health-check to the method configured on the tunnel
-// instance (http, ip, or download). The default is http for backward
-// compatibility.
-func (dc DefaultChecker) Check(ti *tunnel.TunnelInstance) tunnel.CheckResult {
+// Check dispatches the health-check to the registered method configured on
+// the tunnel instance (see Register). The default is http for backward
+// compatibility. Canceling ctx aborts the check.
+func (dc DefaultChecker) Check(ctx context.Context, ti *tunnel.TunnelInstance) tunnel.CheckResult {
 	method := ti.CheckMethod
 	if method == "" {
 		method = metrics.DefaultCheckMethod
 	}
-	switch method {
-	case "ip":
-		return dc.checkByIP(ti)
-	case "download":
-		return checkByDownload(ti)
-	default:
-		return PerformCheck(ti)
+	m, ok := lookupMethod(method)
+	if !ok {
+		return tunnel.CheckResult{Up: false, Err: fmt.Errorf("unknown check method %q", method)}
+	}
+	if m.Stages {
+		return withStages(ctx, ti, dc.env, m.Check)
 	}
+	return m.Check(ctx, ti, dc.env)
 }
 
-// newSOCKSClient builds an HTTP client that routes through the tunnel's
-// SOCKS5 proxy. It verifies the SOCKS port is reachable first.
-func newSOCKSClient(ti *tunnel.TunnelInstance, timeout time.Duration) (*http.Client, error) {
+// newSOCKSDialer returns a dialer through the tunnel's SOCKS5 proxy. It
+// verifies the SOCKS port is reachable first.
+func newSOCKSDialer(ctx context.Context, ti *tunnel.TunnelInstance, timeout time.Duration) (*socks.SOCKS5Dialer, error) {
 	socksProxy := fmt.Sprintf("127.0.0.1:%d", ti.SocksPort)
 
 	// Check that the SOCKS5 proxy port is reachable.
-	conn, err := net.DialTimeout("tcp", socksProxy, min(metrics.SocksDialTimeout, timeout))
+	d := net.Dialer{Timeout: min(metrics.SocksDialTimeout, timeout)}
+	conn, err := d.DialContext(ctx, "tcp", socksProxy)
 	if err != nil {
-		return nil, err
+		return nil, &socks.Error{Stage: socks.StageDial, Err: err}
 	}
 	conn.Close()
 
-	dialer := socks.NewSOCKS5Dialer(socksProxy, timeout)
+	return ti.SOCKSDialer(timeout), nil
+}
+
+// newSOCKSClient builds an HTTP client that routes through the tunnel's
+// SOCKS5 proxy. It verifies the SOCKS port is reachable first.
+func newSOCKSClient(ctx context.Context, ti *tunnel.TunnelInstance, timeout time.Duration) (*http.Client, error) {
+	dialer, err := newSOCKSDialer(ctx, ti, timeout)
+	if err != nil {
+		return nil, err
+	}
 
 	return &http.Client{
 		Timeout: timeout,
@@ -86,10 +117,10 @@ func newSOCKSClient(ti *tunnel.TunnelInstance, timeout time.Duration) (*http.Cli
 	}, nil
 }
 
-// ttfbRequest builds a GET request instrumented with httptrace so that the
+// ttfbRequest builds a request instrumented with httptrace so that the
 // time-to-first-byte (TTFB) can be measured. The returned *atomic.Int64 holds
 // the TTFB in nanoseconds once GotFirstResponseByte fires.
-func ttfbRequest(ctx context.Context, start time.Time, url string) (*http.Request, *atomic.Int64, error) {
+func ttfbRequest(ctx context.Context, start time.Time, method, url string, body io.Reader) (*http.Request, *atomic.Int64, error) {
 	var ttfbNanos atomic.Int64
 	trace := &httptrace.ClientTrace{
 		GotFirstResponseByte: func() {
@@ -98,7 +129,7 @@ func ttfbRequest(ctx context.Context, start time.Time, url string) (*http.Reques
 	}
 	req, err := http.NewRequestWithContext(
 		httptrace.WithClientTrace(ctx, trace),
-		http.MethodGet, url, nil,
+		method, url, body,
 	)
 	return req, &ttfbNanos, err
 }
@@ -119,21 +150,42 @@ func resolveLatency(ttfbNanos *atomic.Int64, start time.Time) time.Duration {
 // the caller's responsibility.
 //
 // The CheckResult contract:
-//   - Up==true  => tunnel is reachable with an acceptable HTTP status.
+//   - Up==true  => tunnel is reachable with an acceptable HTTP status and the
+//     response satisfies any configured header/body expectations.
 //     Err may be non-nil when the body could not be fully read (partial success).
 //   - Up==false => tunnel is down; Err describes the reason.
-func PerformCheck(ti *tunnel.TunnelInstance) tunnel.CheckResult {
+//
+// Canceling ctx aborts the request.
+func PerformCheck(ctx context.Context, ti *tunnel.TunnelInstance) tunnel.CheckResult {
+	return withStages(ctx, ti, Env{}, checkByHTTP)
+}
+
+// checkByHTTP implements PerformCheck; stage timings are recorded through ctx.
+func checkByHTTP(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.HTTPSettings)
 	start := time.Now()
 
-	client, err := newSOCKSClient(ti, ti.CheckTimeout)
+	client, err := newSOCKSClient(ctx, ti, ti.CheckTimeout)
 	if err != nil {
 		return tunnel.CheckResult{Up: false, Err: err}
 	}
 
-	req, ttfbNanos, err := ttfbRequest(context.Background(), start, ti.CheckURL)
+	method, reqBody := http.MethodGet, io.Reader(nil)
+	if rq := s.Request; rq != nil {
+		method = rq.Method
+		if rq.Body != "" {
+			reqBody = strings.NewReader(rq.Body)
+		}
+		client.CheckRedirect = redirectPolicy(rq)
+	}
+
+	req, ttfbNanos, err := ttfbRequest(ctx, start, method, ti.CheckURL, reqBody)
 	if err != nil {
 		return tunnel.CheckResult{Up: false, Err: err}
 	}
+	if s.Request != nil {
+		setRequestHeaders(req, s.Request.Headers)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -141,35 +193,139 @@ func PerformCheck(ti *tunnel.TunnelInstance) tunnel.CheckResult {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusFound && resp.StatusCode != http.StatusTemporaryRedirect {
+	if !statusAccepted(resp.StatusCode, s.ExpectedStatus) {
 		return tunnel.CheckResult{
 			Up:         false,
 			HTTPStatus: resp.StatusCode,
-			Err:        fmt.Errorf("bad status code: %d", resp.StatusCode),
+			Err:        badStatusError("bad status code: %d", resp.StatusCode),
 		}
 	}
 
-	// Read a small portion of the body to verify the connection is fully working.
+	// Read a small portion of the body to verify the connection is fully working,
+	// or enough of it to evaluate the body regexes when they are configured.
 	// This is excluded from the latency (TTFB) measurement.
-	_, bodyErr := io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+	limit := int64(1024)
+	matchBody := s.ExpectBodyRegex != nil || s.RejectBodyRegex != nil
+	if matchBody {
+		limit = metrics.MaxBodyMatchSize
+	}
+	body, bodyErr := io.ReadAll(io.LimitReader(resp.Body, limit))
+	latency := resolveLatency(ttfbNanos, start)
+
+	if bodyErr != nil {
+		bodyErr = bodyError(bodyErr)
+	}
+
+	if err := checkHeaders(resp.Header, s.ExpectHeader); err != nil {
+		return tunnel.CheckResult{Up: false, Latency: latency, HTTPStatus: resp.StatusCode, Err: err}
+	}
+	if matchBody {
+		// A truncated body cannot be validated, so a read error is fatal here.
+		if bodyErr != nil {
+			return tunnel.CheckResult{Up: false, Latency: latency, HTTPStatus: resp.StatusCode, Err: bodyErr}
+		}
+		if err := checkBody(body, s.ExpectBodyRegex, s.RejectBodyRegex); err != nil {
+			return tunnel.CheckResult{Up: false, Latency: latency, HTTPStatus: resp.StatusCode, Err: err}
+		}
+	}
 
 	return tunnel.CheckResult{
 		Up:         true,
-		Latency:    resolveLatency(ttfbNanos, start),
+		Latency:    latency,
 		HTTPStatus: resp.StatusCode,
 		Err:        bodyErr,
 	}
 }
 
+// redirectPolicy returns an http.Client CheckRedirect function for rq. When
+// redirects are not followed the redirect response itself is returned and
+// judged against the expected status codes.
+func redirectPolicy(rq *config.HTTPRequest) func(*http.Request, []*http.Request) error {
+	return func(_ *http.Request, via []*http.Request) error {
+		if !rq.FollowRedirects {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= rq.MaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", rq.MaxRedirects)
+		}
+		return nil
+	}
+}
+
+// setRequestHeaders applies the configured headers to req. A "Host" header
+// overrides the request host, since net/http ignores it in req.Header.
+func setRequestHeaders(req *http.Request, headers map[string]string) {
+	for name, value := range headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// defaultAcceptedStatus lists the status codes the http method accepts when
+// expected_status is not configured.
+var defaultAcceptedStatus = []config.StatusRange{
+	{Min: http.StatusOK, Max: http.StatusOK},
+	{Min: http.StatusMovedPermanently, Max: http.StatusFound},
+	{Min: http.StatusTemporaryRedirect, Max: http.StatusTemporaryRedirect},
+}
+
+// statusAccepted reports whether code falls within any of the expected
+// ranges, falling back to defaultAcceptedStatus when none are configured.
+func statusAccepted(code int, expected []config.StatusRange) bool {
+	if len(expected) == 0 {
+		expected = defaultAcceptedStatus
+	}
+	for _, r := range expected {
+		if r.Contains(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHeaders verifies that every expected header is present and that its
+// value matches the configured pattern.
+func checkHeaders(header http.Header, expected map[string]*regexp.Regexp) error {
+	for name, re := range expected {
+		values, ok := header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return validationError("content_mismatch", fmt.Errorf("content mismatch: header %s is missing", name))
+		}
+		if !slices.ContainsFunc(values, re.MatchString) {
+			return validationError("content_mismatch",
+				fmt.Errorf("content mismatch: header %s value %q does not match %q", name, strings.Join(values, ", "), re))
+		}
+	}
+	return nil
+}
+
+// checkBody applies expect_body_regex and reject_body_regex to body. Captive
+// portals and block pages typically return 200, so this is what catches them.
+func checkBody(body []byte, expect, reject *regexp.Regexp) error {
+	if expect != nil && !expect.Match(body) {
+		return validationError("content_mismatch", fmt.Errorf("content mismatch: body does not match expect_body_regex %q", expect))
+	}
+	if reject != nil && reject.Match(body) {
+		return validationError("content_mismatch", fmt.Errorf("content mismatch: body matches reject_body_regex %q", reject))
+	}
+	return nil
+}
+
 // checkByIP verifies that traffic is actually routed through the proxy by
 // comparing the IP returned via the proxy against the host's real public IP.
-// The check succeeds if the proxy IP differs from the real IP. If the real IP
-// was not resolved at startup, resolution is retried for each call.
-func (dc DefaultChecker) checkByIP(ti *tunnel.TunnelInstance) tunnel.CheckResult {
-	realIP := dc.realIP
+// The check succeeds if the proxy IP differs from the real IP and the exit
+// satisfies expected_ip_cidr and expected_country. The service may answer
+// with a bare IP or JSON; the parsed exit is returned in the result. If the
+// real IP was not resolved at startup, resolution is retried for each call.
+func checkByIP(ctx context.Context, ti *tunnel.TunnelInstance, env Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.IPSettings)
+	realIP := env.RealIP
 	if realIP == "" {
 		var err error
-		realIP, err = ResolveRealIP(context.Background(), ti.IPCheckURL)
+		realIP, err = ResolveRealIP(ctx, s.URL)
 		if err != nil {
 			return tunnel.CheckResult{Up: false, Err: fmt.Errorf("failed to resolve real IP: %w", err)}
 		}
@@ -177,12 +333,12 @@ func (dc DefaultChecker) checkByIP(ti *tunnel.TunnelInstance) tunnel.CheckResult
 
 	start := time.Now()
 
-	client, err := newSOCKSClient(ti, ti.CheckTimeout)
+	client, err := newSOCKSClient(ctx, ti, ti.CheckTimeout)
 	if err != nil {
 		return tunnel.CheckResult{Up: false, Err: err}
 	}
 
-	req, ttfbNanos, err := ttfbRequest(context.Background(), start, ti.IPCheckURL)
+	req, ttfbNanos, err := ttfbRequest(ctx, start, http.MethodGet, s.URL, nil)
 	if err != nil {
 		return tunnel.CheckResult{Up: false, Err: err}
 	}
@@ -197,44 +353,61 @@ func (dc DefaultChecker) checkByIP(ti *tunnel.TunnelInstance) tunnel.CheckResult
 		return tunnel.CheckResult{
 			Up:         false,
 			HTTPStatus: resp.StatusCode,
-			Err:        fmt.Errorf("ip check returned bad status: %d", resp.StatusCode),
+			Err:        badStatusError("ip check returned bad status: %d", resp.StatusCode),
 		}
 	}
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIPEchoBody))
 	if err != nil {
-		return tunnel.CheckResult{Up: false, Err: err}
+		return tunnel.CheckResult{Up: false, Err: bodyError(err)}
 	}
 
-	proxyIP := strings.TrimSpace(string(body))
+	exit, err := parseIPEcho(body)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, HTTPStatus: resp.StatusCode, Err: validationError("", err)}
+	}
 
-	if proxyIP == realIP {
+	if exit.IP == realIP {
 		return tunnel.CheckResult{
 			Up:         false,
 			HTTPStatus: resp.StatusCode,
-			Err:        fmt.Errorf("proxy IP (%s) matches real IP — traffic is not routed through the proxy", proxyIP),
+			Exit:       &exit,
+			Err:        validationError("", fmt.Errorf("proxy IP (%s) matches real IP — traffic is not routed through the proxy", exit.IP)),
 		}
 	}
 
+	if err := checkExit(s, exit); err != nil {
+		return tunnel.CheckResult{Up: false, HTTPStatus: resp.StatusCode, Exit: &exit, Err: err}
+	}
+
 	return tunnel.CheckResult{
 		Up:         true,
 		Latency:    resolveLatency(ttfbNanos, start),
 		HTTPStatus: resp.StatusCode,
+		Exit:       &exit,
 	}
 }
 
 // checkByDownload verifies the tunnel by downloading from a URL through the
-// proxy and checking that at least DownloadMinSize bytes are received. It uses
-// a separate DownloadTimeout (typically longer than CheckTimeout).
-func checkByDownload(ti *tunnel.TunnelInstance) tunnel.CheckResult {
+// proxy and checking that at least download_min_size bytes are received. It
+// uses a separate download_timeout (typically longer than check_timeout).
+//
+// The body is read to EOF or download_max_size, and the transfer speed is
+// measured over all of it, from the first response byte to the end of the
+// read. When download_timeout expires after download_min_size bytes, the
+// read ends there and the speed covers what arrived. Below min_throughput
+// the check fails, or with min_throughput_action "degraded" passes with
+// Degraded set.
+func checkByDownload(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.DownloadSettings)
 	start := time.Now()
 
-	client, err := newSOCKSClient(ti, ti.DownloadTimeout)
+	client, err := newSOCKSClient(ctx, ti, s.Timeout)
 	if err != nil {
 		return tunnel.CheckResult{Up: false, Err: err}
 	}
 
-	req, ttfbNanos, err := ttfbRequest(context.Background(), start, ti.DownloadURL)
+	req, ttfbNanos, err := ttfbRequest(ctx, start, http.MethodGet, s.URL, nil)
 	if err != nil {
 		return tunnel.CheckResult{Up: false, Err: err}
 	}
@@ -249,29 +422,73 @@ func checkByDownload(ti *tunnel.TunnelInstance) tunnel.CheckResult {
 		return tunnel.CheckResult{
 			Up:         false,
 			HTTPStatus: resp.StatusCode,
-			Err:        fmt.Errorf("download returned bad status: %d", resp.StatusCode),
+			Err:        badStatusError("download returned bad status: %d", resp.StatusCode),
 		}
 	}
 
-	// Read until we have DownloadMinSize bytes or EOF.
-	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, ti.DownloadMinSize))
-	if err != nil {
-		return tunnel.CheckResult{Up: false, Err: err}
+	// Read until EOF or MaxSize bytes; a timeout past MinSize only ends the
+	// measurement window.
+	bodyStart := time.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, max(s.MaxSize, s.MinSize)))
+	if err != nil && !(n >= s.MinSize && isTimeout(err)) {
+		return tunnel.CheckResult{Up: false, HTTPStatus: resp.StatusCode, BytesDownloaded: n, Err: bodyError(err)}
 	}
+	throughput := transferRate(n, ttfbNanos, start, bodyStart, time.Now())
 
-	if n < ti.DownloadMinSize {
+	if n < s.MinSize {
 		return tunnel.CheckResult{
-			Up:         false,
-			HTTPStatus: resp.StatusCode,
-			Err:        fmt.Errorf("downloaded %d bytes, need at least %d", n, ti.DownloadMinSize),
+			Up:              false,
+			HTTPStatus:      resp.StatusCode,
+			BytesDownloaded: n,
+			Err:             validationError("", fmt.Errorf("downloaded %d bytes, need at least %d", n, s.MinSize)),
 		}
 	}
 
-	return tunnel.CheckResult{
-		Up:         true,
-		Latency:    resolveLatency(ttfbNanos, start),
-		HTTPStatus: resp.StatusCode,
+	result := tunnel.CheckResult{
+		Up:                 true,
+		Latency:            resolveLatency(ttfbNanos, start),
+		HTTPStatus:         resp.StatusCode,
+		BytesDownloaded:    n,
+		DownloadThroughput: throughput,
+	}
+	applyMinThroughput(s.ThroughputSettings, &result, throughput)
+	return result
+}
+
+// isTimeout reports whether err is a network or client timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// applyMinThroughput fails or degrades a passing result whose measured
+// throughput is below s.MinThroughput, according to s.Action.
+func applyMinThroughput(s config.ThroughputSettings, result *tunnel.CheckResult, throughput float64) {
+	if s.MinThroughput <= 0 || throughput >= s.MinThroughput {
+		return
+	}
+	if s.Action == "degraded" {
+		result.Degraded = true
+		return
+	}
+	result.Up = false
+	result.Err = validationError("low_throughput",
+		fmt.Errorf("throughput %.0f B/s below min_throughput %.0f B/s", throughput, s.MinThroughput))
+}
+
+// transferRate returns n bytes divided by the time from the first response
+// byte (or bodyStart when the trace did not fire) to end, in bytes per
+// second. It returns 0 when the duration is too short to measure.
+func transferRate(n int64, ttfbNanos *atomic.Int64, start, bodyStart, end time.Time) float64 {
+	from := bodyStart
+	if nanos := ttfbNanos.Load(); nanos > 0 {
+		from = start.Add(time.Duration(nanos))
+	}
+	d := end.Sub(from)
+	if n <= 0 || d <= 0 {
+		return 0
 	}
+	return float64(n) / d.Seconds()
 }
 
 // ResolveRealIP determines the host's real public IP by making a direct
@@ -294,10 +511,14 @@ func ResolveRealIP(ctx context.Context, ipCheckURL string) (string, error) {
 		return "", fmt.Errorf("ip check returned status %d", resp.StatusCode)
 	}
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIPEchoBody))
 	if err != nil {
 		return "", err
 	}
 
-	return strings.TrimSpace(string(body)), nil
+	info, err := parseIPEcho(body)
+	if err != nil {
+		return "", err
+	}
+	return info.IP, nil
 }
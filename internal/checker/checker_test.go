@@ -1,17 +1,22 @@
 package checker
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
 	"github.com/batonogov/xray-health-exporter/internal/tunnel"
 )
 
@@ -43,7 +48,7 @@ func TestCheckTunnel(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	if !result.Up {
 		t.Errorf("expected tunnel to be up, got error: %v", result.Err)
 	}
@@ -52,6 +57,40 @@ func TestCheckTunnel(t *testing.T) {
 	}
 }
 
+func TestPerformCheck_Stages(t *testing.T) {
+	socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		c.Read(make([]byte, 4096))
+		time.Sleep(50 * time.Millisecond)
+		c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nOK"))
+	})
+	defer socksListener.Close()
+
+	ti := &tunnel.TunnelInstance{
+		Name:          "stages-test",
+		SocksPort:     socksPort,
+		CheckURL:      "http://stages.example.com",
+		CheckTimeout:  5 * time.Second,
+		CheckInterval: 30 * time.Second,
+	}
+
+	result := PerformCheck(context.Background(), ti)
+	if !result.Up {
+		t.Fatalf("expected tunnel up, got error: %v", result.Err)
+	}
+	for _, stage := range []string{metrics.StageSOCKSDial, metrics.StageConnect, metrics.StageFirstByte} {
+		if _, ok := result.Stages[stage]; !ok {
+			t.Errorf("missing stage %q in %v", stage, result.Stages)
+		}
+	}
+	if _, ok := result.Stages[metrics.StageTLS]; ok {
+		t.Errorf("unexpected tls stage for a plain HTTP check: %v", result.Stages)
+	}
+	if d := result.Stages[metrics.StageFirstByte]; d < 50*time.Millisecond {
+		t.Errorf("first_byte = %v, want >= 50ms", d)
+	}
+}
+
 func TestCheckTunnel_Timeout(t *testing.T) {
 	ts := httptest.NewServer(httptestHandlerSlow(3 * time.Second))
 	defer ts.Close()
@@ -76,12 +115,53 @@ func TestCheckTunnel_Timeout(t *testing.T) {
 	}
 
 	time.Sleep(100 * time.Millisecond)
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel to be down due to timeout")
 	}
 }
 
+func TestCheck_Canceled(t *testing.T) {
+	// The proxy accepts every request and then never answers.
+	socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		io.Copy(io.Discard, c)
+	})
+	defer socksListener.Close()
+
+	tests := []struct {
+		method string
+		ti     tunnel.TunnelInstance
+	}{
+		{"http", tunnel.TunnelInstance{CheckURL: "http://hang.example.com"}},
+		{"download", tunnel.TunnelInstance{MethodConfig: config.DownloadSettings{URL: "http://hang.example.com", Timeout: time.Minute, MinSize: 1}}},
+		{"upload", tunnel.TunnelInstance{MethodConfig: config.UploadSettings{URL: "http://hang.example.com", Timeout: time.Minute, Size: 1}}},
+		{"concurrency", tunnel.TunnelInstance{CheckURL: "http://hang.example.com", MethodConfig: config.ConcurrencySettings{Requests: 3, MinSuccess: 1}}},
+		{"exec", tunnel.TunnelInstance{MethodConfig: config.ExecSettings{Command: []string{"sleep", "60"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			ti := tt.ti
+			ti.Name = "cancel-test"
+			ti.SocksPort = socksPort
+			ti.CheckMethod = tt.method
+			ti.CheckTimeout = time.Minute
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			start := time.Now()
+			r := NewDefaultChecker("").Check(ctx, &ti)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("check returned %v after cancel, want promptly", elapsed)
+			}
+			if r.Up || r.Err == nil {
+				t.Errorf("expected a canceled check to fail, got Up=%v err=%v", r.Up, r.Err)
+			}
+		})
+	}
+}
+
 func TestCheckTunnel_BadStatusCodes(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -127,11 +207,14 @@ func TestCheckTunnel_BadStatusCodes(t *testing.T) {
 			}
 
 			time.Sleep(100 * time.Millisecond)
-			result := PerformCheck(ti)
+			result := PerformCheck(context.Background(), ti)
 
 			if tc.shouldFail && result.Up {
 				t.Errorf("expected failure for status %d", tc.statusCode)
 			}
+			if tc.shouldFail {
+				assertCheckError(t, result.Err, metrics.ErrorStageValidation, "bad_status")
+			}
 			if !tc.shouldFail && !result.Up {
 				t.Errorf("expected success for status %d, got error: %v", tc.statusCode, result.Err)
 			}
@@ -159,10 +242,11 @@ func TestCheckTunnel_DNSError(t *testing.T) {
 	}
 
 	time.Sleep(100 * time.Millisecond)
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel to be down due to DNS error")
 	}
+	assertCheckError(t, result.Err, metrics.ErrorStageSOCKSConnect, "host_unreachable")
 }
 
 func TestCheckTunnel_TLSError(t *testing.T) {
@@ -189,10 +273,11 @@ func TestCheckTunnel_TLSError(t *testing.T) {
 	}
 
 	time.Sleep(100 * time.Millisecond)
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel to be down due to TLS error")
 	}
+	assertCheckError(t, result.Err, metrics.ErrorStageTLS, "tls")
 }
 
 func TestCheckTunnel_SOCKSNotReachable(t *testing.T) {
@@ -209,10 +294,23 @@ func TestCheckTunnel_SOCKSNotReachable(t *testing.T) {
 		CheckInterval: 30 * time.Second,
 	}
 
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel to be down")
 	}
+	assertCheckError(t, result.Err, metrics.ErrorStageSOCKSDial, "connection_refused")
+}
+
+// assertCheckError fails t unless err is reported with the given stage and
+// reason in xray_tunnel_error_total.
+func assertCheckError(t *testing.T, err error, stage, reason string) {
+	t.Helper()
+	if got := metrics.ErrorStage(err); got != stage {
+		t.Errorf("ErrorStage(%v) = %q, want %q", err, got, stage)
+	}
+	if got := metrics.ClassifyError(err); got != reason {
+		t.Errorf("ClassifyError(%v) = %q, want %q", err, got, reason)
+	}
 }
 
 func TestCheckTunnel_BodyReadError(t *testing.T) {
@@ -239,11 +337,14 @@ func TestCheckTunnel_BodyReadError(t *testing.T) {
 	}
 
 	time.Sleep(100 * time.Millisecond)
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	// Body read error but tunnel is still up (partial success)
 	if !result.Up {
 		t.Errorf("expected tunnel to be up (partial success), got error: %v", result.Err)
 	}
+	if stage := metrics.ErrorStage(result.Err); stage != metrics.ErrorStageBody {
+		t.Errorf("ErrorStage(%v) = %q, want %q", result.Err, stage, metrics.ErrorStageBody)
+	}
 }
 
 func TestCheckTunnel_BodyReadSuccess(t *testing.T) {
@@ -271,7 +372,7 @@ func TestCheckTunnel_BodyReadSuccess(t *testing.T) {
 	}
 
 	time.Sleep(100 * time.Millisecond)
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	if !result.Up {
 		t.Errorf("expected tunnel to be up, got error: %v", result.Err)
 	}
@@ -677,7 +778,7 @@ func TestConcurrentCheckTunnel(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			PerformCheck(ti)
+			PerformCheck(context.Background(), ti)
 		}()
 	}
 	wg.Wait()
@@ -708,7 +809,7 @@ func TestPerformCheck_TTFBLatency(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	result := PerformCheck(ti)
+	result := PerformCheck(context.Background(), ti)
 	if !result.Up {
 		t.Fatalf("expected tunnel to be up, got error: %v", result.Err)
 	}
@@ -788,7 +889,7 @@ func BenchmarkCheckTunnel(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		PerformCheck(ti)
+		PerformCheck(context.Background(), ti)
 	}
 }
 
@@ -885,7 +986,7 @@ func TestCheckByIP_Success(t *testing.T) {
 		},
 		SocksPort:     socksPort,
 		CheckMethod:   "ip",
-		IPCheckURL:    "http://ip.example.com",
+		MethodConfig:  config.IPSettings{URL: "http://ip.example.com"},
 		CheckTimeout:  5 * time.Second,
 		CheckInterval: 30 * time.Second,
 	}
@@ -893,7 +994,7 @@ func TestCheckByIP_Success(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	checker := NewDefaultChecker("192.168.1.1")
-	result := checker.Check(ti)
+	result := checker.Check(context.Background(), ti)
 	if !result.Up {
 		t.Errorf("expected tunnel up (different IP), got error: %v", result.Err)
 	}
@@ -922,7 +1023,7 @@ func TestCheckByIP_SameIP(t *testing.T) {
 		},
 		SocksPort:     socksPort,
 		CheckMethod:   "ip",
-		IPCheckURL:    "http://ip.example.com",
+		MethodConfig:  config.IPSettings{URL: "http://ip.example.com"},
 		CheckTimeout:  5 * time.Second,
 		CheckInterval: 30 * time.Second,
 	}
@@ -930,7 +1031,7 @@ func TestCheckByIP_SameIP(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	checker := NewDefaultChecker("192.168.1.1")
-	result := checker.Check(ti)
+	result := checker.Check(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel down (proxy IP matches real IP)")
 	}
@@ -955,7 +1056,7 @@ func TestCheckByIP_BadStatus(t *testing.T) {
 		},
 		SocksPort:     socksPort,
 		CheckMethod:   "ip",
-		IPCheckURL:    "http://ip.example.com",
+		MethodConfig:  config.IPSettings{URL: "http://ip.example.com"},
 		CheckTimeout:  5 * time.Second,
 		CheckInterval: 30 * time.Second,
 	}
@@ -963,7 +1064,7 @@ func TestCheckByIP_BadStatus(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	checker := NewDefaultChecker("192.168.1.1")
-	result := checker.Check(ti)
+	result := checker.Check(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel down due to bad status")
 	}
@@ -989,19 +1090,21 @@ func TestCheckByDownload_Success(t *testing.T) {
 			Security: "tls",
 			SNI:      "test.example.com",
 		},
-		SocksPort:       socksPort,
-		CheckMethod:     "download",
-		DownloadURL:     "http://download.example.com",
-		DownloadTimeout: 10 * time.Second,
-		DownloadMinSize: 51200,
-		CheckTimeout:    5 * time.Second,
-		CheckInterval:   30 * time.Second,
+		SocksPort:   socksPort,
+		CheckMethod: "download",
+		MethodConfig: config.DownloadSettings{
+			URL:     "http://download.example.com",
+			Timeout: 10 * time.Second,
+			MinSize: 51200,
+		},
+		CheckTimeout:  5 * time.Second,
+		CheckInterval: 30 * time.Second,
 	}
 
 	time.Sleep(100 * time.Millisecond)
 
 	checker := NewDefaultChecker("")
-	result := checker.Check(ti)
+	result := checker.Check(context.Background(), ti)
 	if !result.Up {
 		t.Errorf("expected tunnel up (enough bytes), got error: %v", result.Err)
 	}
@@ -1024,19 +1127,21 @@ func TestCheckByDownload_TooFewBytes(t *testing.T) {
 			Security: "tls",
 			SNI:      "test.example.com",
 		},
-		SocksPort:       socksPort,
-		CheckMethod:     "download",
-		DownloadURL:     "http://download.example.com",
-		DownloadTimeout: 10 * time.Second,
-		DownloadMinSize: 51200,
-		CheckTimeout:    5 * time.Second,
-		CheckInterval:   30 * time.Second,
+		SocksPort:   socksPort,
+		CheckMethod: "download",
+		MethodConfig: config.DownloadSettings{
+			URL:     "http://download.example.com",
+			Timeout: 10 * time.Second,
+			MinSize: 51200,
+		},
+		CheckTimeout:  5 * time.Second,
+		CheckInterval: 30 * time.Second,
 	}
 
 	time.Sleep(100 * time.Millisecond)
 
 	checker := NewDefaultChecker("")
-	result := checker.Check(ti)
+	result := checker.Check(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel down (too few bytes)")
 	}
@@ -1059,24 +1164,147 @@ func TestCheckByDownload_BadStatus(t *testing.T) {
 			Security: "tls",
 			SNI:      "test.example.com",
 		},
-		SocksPort:       socksPort,
-		CheckMethod:     "download",
-		DownloadURL:     "http://download.example.com",
-		DownloadTimeout: 10 * time.Second,
-		DownloadMinSize: 51200,
-		CheckTimeout:    5 * time.Second,
-		CheckInterval:   30 * time.Second,
+		SocksPort:   socksPort,
+		CheckMethod: "download",
+		MethodConfig: config.DownloadSettings{
+			URL:     "http://download.example.com",
+			Timeout: 10 * time.Second,
+			MinSize: 51200,
+		},
+		CheckTimeout:  5 * time.Second,
+		CheckInterval: 30 * time.Second,
 	}
 
 	time.Sleep(100 * time.Millisecond)
 
 	checker := NewDefaultChecker("")
-	result := checker.Check(ti)
+	result := checker.Check(context.Background(), ti)
 	if result.Up {
 		t.Error("expected tunnel down due to bad status")
 	}
 }
 
+func TestCheckByDownload_Throughput(t *testing.T) {
+	// The body arrives in two halves 200ms apart, so the measured speed is
+	// at most ~300 KB/s.
+	data := strings.Repeat("A", 60000)
+	tests := []struct {
+		name         string
+		min          float64
+		action       string
+		wantUp       bool
+		wantDegraded bool
+	}{
+		{"no threshold", 0, "", true, false},
+		{"above threshold", 1000, "down", true, false},
+		{"below threshold fails", 1e9, "down", false, false},
+		{"below threshold degrades", 1e9, "degraded", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				buf := make([]byte, 4096)
+				c.Read(buf)
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(data), data[:len(data)/2])
+				time.Sleep(200 * time.Millisecond)
+				c.Write([]byte(data[len(data)/2:]))
+			})
+			defer socksListener.Close()
+
+			ti := &tunnel.TunnelInstance{
+				Name:        "download-test-throughput",
+				SocksPort:   socksPort,
+				CheckMethod: "download",
+				MethodConfig: config.DownloadSettings{
+					URL:                "http://download.example.com",
+					Timeout:            10 * time.Second,
+					MinSize:            51200,
+					ThroughputSettings: config.ThroughputSettings{MinThroughput: tt.min, Action: tt.action},
+				},
+				CheckTimeout:  5 * time.Second,
+				CheckInterval: 30 * time.Second,
+			}
+
+			result := NewDefaultChecker("").Check(context.Background(), ti)
+			if result.Up != tt.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", result.Up, tt.wantUp, result.Err)
+			}
+			if result.Degraded != tt.wantDegraded {
+				t.Errorf("Degraded = %v, want %v", result.Degraded, tt.wantDegraded)
+			}
+			if result.BytesDownloaded != 51200 {
+				t.Errorf("BytesDownloaded = %d, want 51200", result.BytesDownloaded)
+			}
+			if result.DownloadThroughput <= 0 || result.DownloadThroughput > 400000 {
+				t.Errorf("DownloadThroughput = %.0f B/s, want between 0 and 400000", result.DownloadThroughput)
+			}
+			if !tt.wantUp {
+				if reason := metrics.ClassifyError(result.Err); reason != "low_throughput" {
+					t.Errorf("ClassifyError(%v) = %q, want low_throughput", result.Err, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckByDownload_ReadWindow(t *testing.T) {
+	// The server declares 100000 bytes but sends only 60000 before
+	// hanging, unless the whole body is sent.
+	tests := []struct {
+		name      string
+		sent      int
+		maxSize   int64
+		timeout   time.Duration
+		wantUp    bool
+		wantBytes int64
+	}{
+		{"whole body past min size", 100000, 1 << 20, 10 * time.Second, true, 100000},
+		{"capped at max size", 100000, 70000, 10 * time.Second, true, 70000},
+		{"timeout after min size", 60000, 1 << 20, 500 * time.Millisecond, true, 60000},
+		{"timeout before min size", 40000, 1 << 20, 500 * time.Millisecond, false, 40000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				buf := make([]byte, 4096)
+				c.Read(buf)
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: 100000\r\n\r\n%s", strings.Repeat("A", tt.sent))
+				time.Sleep(time.Second)
+			})
+			defer socksListener.Close()
+
+			ti := &tunnel.TunnelInstance{
+				Name:        "download-test-window",
+				SocksPort:   socksPort,
+				CheckMethod: "download",
+				MethodConfig: config.DownloadSettings{
+					URL:     "http://download.example.com",
+					Timeout: tt.timeout,
+					MinSize: 51200,
+					MaxSize: tt.maxSize,
+				},
+				CheckTimeout:  5 * time.Second,
+				CheckInterval: 30 * time.Second,
+			}
+
+			result := NewDefaultChecker("").Check(context.Background(), ti)
+			if result.Up != tt.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", result.Up, tt.wantUp, result.Err)
+			}
+			if result.BytesDownloaded != tt.wantBytes {
+				t.Errorf("BytesDownloaded = %d, want %d", result.BytesDownloaded, tt.wantBytes)
+			}
+			if tt.wantUp && result.DownloadThroughput <= 0 {
+				t.Errorf("DownloadThroughput = %.0f B/s, want > 0", result.DownloadThroughput)
+			}
+		})
+	}
+}
+
 // --- Tests for ResolveRealIP ---
 
 func TestResolveRealIP(t *testing.T) {
@@ -1146,8 +1374,241 @@ func TestCheck_DefaultMethodIsHTTP(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	checker := NewDefaultChecker("")
-	result := checker.Check(ti)
+	result := checker.Check(context.Background(), ti)
 	if !result.Up {
 		t.Errorf("expected tunnel up via default http method, got error: %v", result.Err)
 	}
 }
+
+// --- Tests for http response expectations ---
+
+func TestPerformCheck_Expectations(t *testing.T) {
+	const page = "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nX-Node: edge-1\r\nContent-Length: 26\r\n\r\n<title>Welcome home</title>"
+
+	testCases := []struct {
+		name        string
+		response    string
+		configure   func(s *config.HTTPSettings)
+		wantUp      bool
+		wantErrText string
+	}{
+		{
+			name:     "expected status range accepts 204",
+			response: "HTTP/1.1 204 No Content\r\n\r\n",
+			configure: func(s *config.HTTPSettings) {
+				s.ExpectedStatus = []config.StatusRange{{Min: 200, Max: 299}}
+			},
+			wantUp: true,
+		},
+		{
+			name:     "expected status rejects default-accepted 302",
+			response: "HTTP/1.1 302 Found\r\nContent-Length: 0\r\n\r\n",
+			configure: func(s *config.HTTPSettings) {
+				s.ExpectedStatus = []config.StatusRange{{Min: 200, Max: 200}}
+			},
+			wantErrText: "bad status",
+		},
+		{
+			name:     "body regex matches",
+			response: page,
+			configure: func(s *config.HTTPSettings) {
+				s.ExpectBodyRegex = regexp.MustCompile(`Welcome`)
+			},
+			wantUp: true,
+		},
+		{
+			name:     "body regex does not match captive portal",
+			response: page,
+			configure: func(s *config.HTTPSettings) {
+				s.ExpectBodyRegex = regexp.MustCompile(`Google`)
+			},
+			wantErrText: "content mismatch",
+		},
+		{
+			name:     "reject regex matches block page",
+			response: page,
+			configure: func(s *config.HTTPSettings) {
+				s.RejectBodyRegex = regexp.MustCompile(`(?i)welcome`)
+			},
+			wantErrText: "content mismatch",
+		},
+		{
+			name:     "expected header matches",
+			response: page,
+			configure: func(s *config.HTTPSettings) {
+				s.ExpectHeader = map[string]*regexp.Regexp{"x-node": regexp.MustCompile(`^edge-`)}
+			},
+			wantUp: true,
+		},
+		{
+			name:     "expected header missing",
+			response: page,
+			configure: func(s *config.HTTPSettings) {
+				s.ExpectHeader = map[string]*regexp.Regexp{"Server": regexp.MustCompile(``)}
+			},
+			wantErrText: "content mismatch",
+		},
+		{
+			name:     "expected header value mismatch",
+			response: page,
+			configure: func(s *config.HTTPSettings) {
+				s.ExpectHeader = map[string]*regexp.Regexp{"Content-Type": regexp.MustCompile(`json`)}
+			},
+			wantErrText: "content mismatch",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				c.Read(make([]byte, 4096))
+				c.Write([]byte(tc.response))
+			})
+			defer socksListener.Close()
+
+			ti := &tunnel.TunnelInstance{
+				Name: "expectations-test",
+				MetricLabels: tunnel.MetricLabels{
+					Server:   "test.example.com:443",
+					Security: "tls",
+					SNI:      "test.example.com",
+				},
+				SocksPort:     socksPort,
+				CheckURL:      "http://test.example.com",
+				CheckTimeout:  5 * time.Second,
+				CheckInterval: 30 * time.Second,
+			}
+			var s config.HTTPSettings
+			tc.configure(&s)
+			ti.MethodConfig = s
+
+			result := PerformCheck(context.Background(), ti)
+			if result.Up != tc.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", result.Up, tc.wantUp, result.Err)
+			}
+			if tc.wantErrText != "" && (result.Err == nil || !strings.Contains(result.Err.Error(), tc.wantErrText)) {
+				t.Errorf("expected error containing %q, got: %v", tc.wantErrText, result.Err)
+			}
+		})
+	}
+}
+
+func TestPerformCheck_CheckRequest(t *testing.T) {
+	type seen struct {
+		method, host, auth, contentType, body string
+	}
+	got := make(chan seen, 1)
+
+	socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		got <- seen{req.Method, req.Host, req.Header.Get("Authorization"), req.Header.Get("Content-Type"), string(body)}
+		c.Write([]byte("HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"))
+	})
+	defer socksListener.Close()
+
+	ti := &tunnel.TunnelInstance{
+		Name:          "check-request-test",
+		SocksPort:     socksPort,
+		CheckURL:      "http://api.example.com/health",
+		CheckTimeout:  5 * time.Second,
+		CheckInterval: 30 * time.Second,
+		MethodConfig: config.HTTPSettings{
+			ExpectedStatus: []config.StatusRange{{Min: 201, Max: 201}},
+			Request: &config.HTTPRequest{
+				Method: http.MethodPost,
+				Headers: map[string]string{
+					"Host":          "internal.example.com",
+					"Authorization": "Bearer secret",
+					"Content-Type":  "application/json",
+				},
+				Body: `{"ping":true}`,
+			},
+		},
+	}
+
+	result := PerformCheck(context.Background(), ti)
+	if !result.Up {
+		t.Fatalf("expected tunnel up, got error: %v", result.Err)
+	}
+
+	want := seen{http.MethodPost, "internal.example.com", "Bearer secret", "application/json", `{"ping":true}`}
+	if s := <-got; s != want {
+		t.Errorf("request = %+v, want %+v", s, want)
+	}
+}
+
+func TestPerformCheck_Redirects(t *testing.T) {
+	testCases := []struct {
+		name        string
+		request     *config.HTTPRequest
+		wantUp      bool
+		wantStatus  int
+		wantErrText string
+	}{
+		{
+			name:       "follow to final page",
+			request:    &config.HTTPRequest{Method: http.MethodGet, FollowRedirects: true, MaxRedirects: 10},
+			wantUp:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "do not follow",
+			request:    &config.HTTPRequest{Method: http.MethodGet, FollowRedirects: false, MaxRedirects: 10},
+			wantUp:     true,
+			wantStatus: http.StatusFound,
+		},
+		{
+			name:        "too many redirects",
+			request:     &config.HTTPRequest{Method: http.MethodGet, FollowRedirects: true, MaxRedirects: 1},
+			wantErrText: "stopped after 1 redirects",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// /start -> /hop -> /final
+			socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				switch req.URL.Path {
+				case "/start":
+					c.Write([]byte("HTTP/1.1 302 Found\r\nLocation: /hop\r\nContent-Length: 0\r\n\r\n"))
+				case "/hop":
+					c.Write([]byte("HTTP/1.1 302 Found\r\nLocation: /final\r\nContent-Length: 0\r\n\r\n"))
+				default:
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				}
+			})
+			defer socksListener.Close()
+
+			ti := &tunnel.TunnelInstance{
+				Name:          "redirect-test",
+				SocksPort:     socksPort,
+				CheckURL:      "http://test.example.com/start",
+				CheckTimeout:  5 * time.Second,
+				CheckInterval: 30 * time.Second,
+				MethodConfig:  config.HTTPSettings{Request: tc.request},
+			}
+
+			result := PerformCheck(context.Background(), ti)
+			if result.Up != tc.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", result.Up, tc.wantUp, result.Err)
+			}
+			if tc.wantStatus != 0 && result.HTTPStatus != tc.wantStatus {
+				t.Errorf("HTTPStatus = %d, want %d", result.HTTPStatus, tc.wantStatus)
+			}
+			if tc.wantErrText != "" && (result.Err == nil || !strings.Contains(result.Err.Error(), tc.wantErrText)) {
+				t.Errorf("expected error containing %q, got: %v", tc.wantErrText, result.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// checkByConcurrency starts Concurrency GET requests to CheckURL at once
+// through the tunnel, each on its own connection, so that multiplexed
+// transports (XHTTP, gRPC multi mode, mux) carry that many parallel streams.
+// A request succeeds when its status is accepted as for the http method. The
+// check passes when the fraction of successful requests reaches
+// concurrency_min_success.
+//
+// Latency is the median time to the response headers over the successful
+// requests; the full distribution, the success ratio and the most requests
+// connected at once are reported in Concurrency.
+func checkByConcurrency(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.ConcurrencySettings)
+	client, err := newSOCKSClient(ctx, ti, ti.CheckTimeout)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+
+	var (
+		mu          sync.Mutex
+		wg          sync.WaitGroup
+		inFlight    atomic.Int64
+		maxInFlight atomic.Int64
+		status      int
+		lastErr     error
+	)
+	stats := &tunnel.ConcurrencyStats{Requests: s.Requests}
+	start := make(chan struct{})
+	for range s.Requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			latency, code, err := concurrentRequest(ctx, client, ti.CheckURL, s.ExpectedStatus, &inFlight, &maxInFlight)
+			mu.Lock()
+			defer mu.Unlock()
+			if code > 0 {
+				status = code
+			}
+			if err != nil {
+				stats.Failed++
+				lastErr = err
+				return
+			}
+			stats.Latencies = append(stats.Latencies, latency)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	stats.MaxInFlight = int(maxInFlight.Load())
+
+	result := tunnel.CheckResult{
+		Up:          len(stats.Latencies) > 0 && stats.SuccessRatio() >= s.MinSuccess,
+		Latency:     stats.Quantile(0.5),
+		HTTPStatus:  status,
+		Concurrency: stats,
+	}
+	if !result.Up {
+		result.Err = concurrencyError(stats, s.MinSuccess, lastErr)
+	}
+	return result
+}
+
+// concurrencyError reports a failed concurrency check with the stage and
+// reason of the last failed request; an untagged request error is
+// attributed to the HTTP exchange.
+func concurrencyError(stats *tunnel.ConcurrencyStats, minSuccess float64, lastErr error) error {
+	err := fmt.Errorf("%d of %d concurrent requests failed (concurrency_min_success %g)",
+		stats.Failed, stats.Requests, minSuccess)
+	if lastErr != nil {
+		err = fmt.Errorf("%w: %w", err, lastErr)
+	}
+
+	stage := metrics.ErrorStage(lastErr)
+	if stage == metrics.ErrorStageUnknown {
+		stage = metrics.ErrorStageHTTP
+	}
+	return &metrics.CheckError{Stage: stage, Reason: metrics.ClassifyError(lastErr), Err: err}
+}
+
+// concurrentRequest performs one request of a concurrency check, a GET of
+// url whose status must be in expected. While the request holds a connection
+// it counts towards inFlight, and maxInFlight keeps the highest count seen.
+func concurrentRequest(ctx context.Context, client *http.Client, url string, expected []config.StatusRange, inFlight, maxInFlight *atomic.Int64) (time.Duration, int, error) {
+	var connected atomic.Bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			connected.Store(true)
+			n := inFlight.Add(1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+		},
+	}
+	defer func() {
+		if connected.Load() {
+			inFlight.Add(-1)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+
+	if !statusAccepted(resp.StatusCode, expected) {
+		return 0, resp.StatusCode, badStatusError("bad status code: %d", resp.StatusCode)
+	}
+	return latency, resp.StatusCode, nil
+}
@@ -0,0 +1,136 @@
+package checker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+func concurrencyTestInstance(socksPort int, url string, n int, minSuccess float64) *tunnel.TunnelInstance {
+	return &tunnel.TunnelInstance{
+		Name:         "concurrency-test",
+		SocksPort:    socksPort,
+		CheckMethod:  "concurrency",
+		CheckURL:     url,
+		CheckTimeout: 5 * time.Second,
+		MethodConfig: config.ConcurrencySettings{
+			Requests:   n,
+			MinSuccess: minSuccess,
+		},
+	}
+}
+
+func TestCheckByConcurrency_AllInFlight(t *testing.T) {
+	const n = 8
+	var (
+		mu      sync.Mutex
+		arrived int
+		all     = make(chan struct{})
+	)
+	// Every request waits until all n have arrived, so the check only
+	// completes quickly if they really run in parallel.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrived++
+		if arrived == n {
+			close(all)
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+		case <-time.After(2 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	socksListener, socksPort := startRelaySOCKS(t, srv.Listener.Addr().String())
+	defer socksListener.Close()
+
+	r := NewDefaultChecker("").Check(context.Background(), concurrencyTestInstance(socksPort, srv.URL, n, 1))
+	if !r.Up {
+		t.Fatalf("expected up, got error: %v", r.Err)
+	}
+	if r.Concurrency == nil {
+		t.Fatal("expected concurrency stats")
+	}
+	if r.Concurrency.Requests != n || r.Concurrency.Failed != 0 || len(r.Concurrency.Latencies) != n {
+		t.Errorf("stats = %+v, want %d successful requests", r.Concurrency, n)
+	}
+	if r.Concurrency.MaxInFlight != n {
+		t.Errorf("MaxInFlight = %d, want %d", r.Concurrency.MaxInFlight, n)
+	}
+	if r.Latency <= 0 || r.HTTPStatus != http.StatusOK {
+		t.Errorf("Latency = %v, HTTPStatus = %d; want a latency and 200", r.Latency, r.HTTPStatus)
+	}
+}
+
+func TestCheckByConcurrency_PartialFailure(t *testing.T) {
+	var count atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count.Add(1)%2 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	socksListener, socksPort := startRelaySOCKS(t, srv.Listener.Addr().String())
+	defer socksListener.Close()
+
+	tests := []struct {
+		name       string
+		minSuccess float64
+		wantUp     bool
+	}{
+		{"half allowed", 0.5, true},
+		{"all required", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewDefaultChecker("").Check(context.Background(), concurrencyTestInstance(socksPort, srv.URL, 10, tt.minSuccess))
+			if r.Up != tt.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", r.Up, tt.wantUp, r.Err)
+			}
+			if got := r.Concurrency.SuccessRatio(); got != 0.5 {
+				t.Errorf("SuccessRatio() = %v, want 0.5", got)
+			}
+			if !tt.wantUp {
+				assertCheckError(t, r.Err, metrics.ErrorStageValidation, "bad_status")
+			}
+		})
+	}
+}
+
+func TestCheckByConcurrency_SOCKSUnreachable(t *testing.T) {
+	r := NewDefaultChecker("").Check(context.Background(), concurrencyTestInstance(59993, "https://example.com", 4, 1))
+	if r.Up || r.Err == nil {
+		t.Errorf("expected the check to fail without a SOCKS proxy, got Up=%v err=%v", r.Up, r.Err)
+	}
+}
+
+func TestCheckByConcurrency_RequestErrorStage(t *testing.T) {
+	// The relay accepts CONNECT but the target drops every request, so each
+	// one fails in the HTTP exchange without a tag of its own.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+	socksListener, socksPort := startRelaySOCKS(t, srv.Listener.Addr().String())
+	defer socksListener.Close()
+
+	r := NewDefaultChecker("").Check(context.Background(), concurrencyTestInstance(socksPort, srv.URL, 4, 1))
+	if r.Up {
+		t.Fatal("expected the check to fail when every request is dropped")
+	}
+	if got := metrics.ErrorStage(r.Err); got != metrics.ErrorStageHTTP {
+		t.Errorf("ErrorStage(%v) = %q, want %q", r.Err, got, metrics.ErrorStageHTTP)
+	}
+}
@@ -0,0 +1,284 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// maxDNSMessageSize bounds DNS responses read over UDP and DoH.
+const maxDNSMessageSize = 65535
+
+// checkByDNS resolves dns_name against dns_server through the tunnel using
+// the configured transport: "tcp" (DNS over TCP via SOCKS CONNECT), "udp"
+// (DNS over UDP via SOCKS UDP ASSOCIATE) or "doh" (DNS over HTTPS via the
+// SOCKS HTTP client). The check passes when the answer contains at least one
+// record of dns_record_type and, if dns_expected is set, at least one record
+// matches an expected IP or CIDR. Latency is the full resolution time.
+func checkByDNS(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.DNSSettings)
+	qtype := dnsmessage.TypeA
+	if s.RecordType == "AAAA" {
+		qtype = dnsmessage.TypeAAAA
+	}
+
+	// RFC 8484 recommends ID 0 for DoH so responses stay cacheable.
+	var id uint16
+	if s.Transport != "doh" {
+		id = uint16(rand.UintN(1 << 16))
+	}
+
+	query, err := buildDNSQuery(id, s.Name, qtype)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ti.CheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	var resp []byte
+	var status int
+	switch s.Transport {
+	case "udp":
+		resp, err = exchangeDNSUDP(ctx, ti, s.Server, query)
+	case "doh":
+		resp, status, err = exchangeDoH(ctx, ti, s.Server, query)
+	default:
+		resp, err = exchangeDNSTCP(ctx, ti, s.Server, query)
+	}
+	if err != nil {
+		// DoH failures are left to withStages, which tells TLS from HTTP.
+		if s.Transport != "doh" && metrics.ErrorStage(err) == metrics.ErrorStageUnknown {
+			err = &metrics.CheckError{Stage: metrics.ErrorStageDNS, Err: err}
+		}
+		return tunnel.CheckResult{Up: false, HTTPStatus: status, Err: err}
+	}
+
+	latency := time.Since(start)
+
+	answers, err := parseDNSAnswers(resp, id, qtype)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, HTTPStatus: status, Err: &metrics.CheckError{Stage: metrics.ErrorStageDNS, Err: err}}
+	}
+	if len(answers) == 0 {
+		return tunnel.CheckResult{
+			Up:         false,
+			HTTPStatus: status,
+			Err:        validationError("", fmt.Errorf("dns: no %s records for %s", s.RecordType, s.Name)),
+		}
+	}
+	if !addrsMatch(answers, s.Expected) {
+		return tunnel.CheckResult{
+			Up:         false,
+			HTTPStatus: status,
+			Err:        validationError("", fmt.Errorf("dns: answer %v for %s does not match expected %v", answers, s.Name, s.Expected)),
+		}
+	}
+
+	return tunnel.CheckResult{
+		Up:         true,
+		Latency:    latency,
+		HTTPStatus: status,
+	}
+}
+
+// buildDNSQuery packs a recursive single-question query for name.
+func buildDNSQuery(id uint16, name string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("dns: invalid name %q: %v", name, err)
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return msg.Pack()
+}
+
+// exchangeDNSTCP sends query to server over a TCP connection opened through
+// the SOCKS5 proxy, using the two-byte length framing from RFC 1035 section 4.2.2.
+func exchangeDNSTCP(ctx context.Context, ti *tunnel.TunnelInstance, server string, query []byte) ([]byte, error) {
+	dialer := ti.SOCKSDialer(ti.CheckTimeout)
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setConnDeadline(ctx, conn)
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	framed = append(framed, query...)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeDNSUDP sends query to server as a single datagram through a SOCKS5
+// UDP association and waits for one reply.
+func exchangeDNSUDP(ctx context.Context, ti *tunnel.TunnelInstance, server string, query []byte) ([]byte, error) {
+	dialer := ti.SOCKSDialer(ti.CheckTimeout)
+	conn, err := dialer.DialUDP(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setConnDeadline(ctx, conn)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeDoH POSTs query to the DoH endpoint server (RFC 8484) through the
+// tunnel's SOCKS HTTP client. It returns the raw DNS response and the HTTP status.
+func exchangeDoH(ctx context.Context, ti *tunnel.TunnelInstance, server string, query []byte) ([]byte, int, error) {
+	client, err := newSOCKSClient(ctx, ti, ti.CheckTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, badStatusError("doh returned bad status: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+	if err != nil {
+		return nil, resp.StatusCode, bodyError(err)
+	}
+	return body, resp.StatusCode, nil
+}
+
+// setConnDeadline applies the context deadline, if any, to conn.
+func setConnDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+}
+
+// parseDNSAnswers validates the response header against the query and
+// returns the addresses of all answer records of type qtype.
+func parseDNSAnswers(resp []byte, id uint16, qtype dnsmessage.Type) ([]netip.Addr, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, fmt.Errorf("dns: malformed response: %v", err)
+	}
+	if h.ID != id {
+		return nil, fmt.Errorf("dns: response ID %d does not match query ID %d", h.ID, id)
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("dns: server returned %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("dns: malformed response: %v", err)
+	}
+
+	var addrs []netip.Addr
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dns: malformed response: %v", err)
+		}
+		switch {
+		case ah.Type == qtype && qtype == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, fmt.Errorf("dns: malformed response: %v", err)
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case ah.Type == qtype && qtype == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, fmt.Errorf("dns: malformed response: %v", err)
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		default:
+			// CNAME chains and other records are not asserted on.
+			if err := p.SkipAnswer(); err != nil {
+				return nil, fmt.Errorf("dns: malformed response: %v", err)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// addrsMatch reports whether at least one address is covered by the
+// expected IPs/CIDRs. An empty expectation list accepts any answer.
+func addrsMatch(answers []netip.Addr, expected []string) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	for _, e := range expected {
+		if prefix, err := netip.ParsePrefix(e); err == nil {
+			for _, a := range answers {
+				if prefix.Contains(a) {
+					return true
+				}
+			}
+			continue
+		}
+		if addr, err := netip.ParseAddr(e); err == nil {
+			for _, a := range answers {
+				if a == addr {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package checker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// dnsReply builds a response to query carrying one A record per address.
+func dnsReply(t *testing.T, query []byte, rcode dnsmessage.RCode, addrs ...string) []byte {
+	t.Helper()
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		t.Errorf("failed to unpack query: %v", err)
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RCode: rcode},
+		Questions: q.Questions,
+	}
+	for _, a := range addrs {
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: netip.MustParseAddr(a).As4()},
+		})
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		t.Errorf("failed to pack response: %v", err)
+	}
+	return packed
+}
+
+// startMockDNSOverTCP starts a mock SOCKS proxy that answers one DNS-over-TCP
+// query per connection with the given rcode and addresses.
+func startMockDNSOverTCP(t *testing.T, rcode dnsmessage.RCode, addrs ...string) (net.Listener, int) {
+	t.Helper()
+	return startMockSOCKS(t, func(c net.Conn) {
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+		resp := dnsReply(t, query, rcode, addrs...)
+		c.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+		c.Write(resp)
+	})
+}
+
+func dnsTestInstance(socksPort int, transport string, expected []string) *tunnel.TunnelInstance {
+	return &tunnel.TunnelInstance{
+		Name: "dns-test",
+		MetricLabels: tunnel.MetricLabels{
+			Server:   "test.example.com:443",
+			Security: "tls",
+			SNI:      "test.example.com",
+		},
+		SocksPort:     socksPort,
+		CheckMethod:   "dns",
+		CheckTimeout:  5 * time.Second,
+		CheckInterval: 30 * time.Second,
+		MethodConfig: config.DNSSettings{
+			Name:       "example.com",
+			Server:     "1.1.1.1:53",
+			Transport:  transport,
+			RecordType: "A",
+			Expected:   expected,
+		},
+	}
+}
+
+func TestCheckByDNS_TCP(t *testing.T) {
+	tests := []struct {
+		name     string
+		rcode    dnsmessage.RCode
+		addrs    []string
+		expected []string
+		wantUp   bool
+	}{
+		{"any answer", dnsmessage.RCodeSuccess, []string{"203.0.113.7"}, nil, true},
+		{"expected ip", dnsmessage.RCodeSuccess, []string{"203.0.113.7"}, []string{"203.0.113.7"}, true},
+		{"expected cidr", dnsmessage.RCodeSuccess, []string{"203.0.113.7"}, []string{"203.0.113.0/24"}, true},
+		{"unexpected answer", dnsmessage.RCodeSuccess, []string{"10.0.0.1"}, []string{"203.0.113.0/24"}, false},
+		{"nxdomain", dnsmessage.RCodeNameError, nil, nil, false},
+		{"empty answer", dnsmessage.RCodeSuccess, nil, nil, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			socksListener, socksPort := startMockDNSOverTCP(t, tc.rcode, tc.addrs...)
+			defer socksListener.Close()
+
+			result := NewDefaultChecker("").Check(context.Background(), dnsTestInstance(socksPort, "tcp", tc.expected))
+			if result.Up != tc.wantUp {
+				t.Errorf("Up = %v, want %v (err: %v)", result.Up, tc.wantUp, result.Err)
+			}
+			if tc.wantUp && result.Latency <= 0 {
+				t.Errorf("expected positive latency, got %v", result.Latency)
+			}
+		})
+	}
+}
+
+func TestCheckByDNS_UDP(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to create UDP relay: %v", err)
+	}
+	defer relay.Close()
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// Header: RSV RSV FRAG ATYP=1 IPv4 PORT
+			off := 4 + 4 + 2
+			resp := dnsReply(t, buf[off:n], dnsmessage.RCodeSuccess, "203.0.113.7")
+			relay.WriteToUDP(append([]byte{0, 0, 0, 1, 1, 1, 1, 1, 0, 53}, resp...), from)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create SOCKS listener: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				c.Read(make([]byte, 3))
+				c.Write([]byte{5, 0})
+				req := make([]byte, 4)
+				c.Read(req)
+				lenBuf := make([]byte, 1)
+				c.Read(lenBuf)
+				c.Read(make([]byte, int(lenBuf[0])+2))
+				port := relay.LocalAddr().(*net.UDPAddr).Port
+				c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port & 0xff)})
+				c.Read(make([]byte, 1))
+			}(conn)
+		}
+	}()
+
+	_, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	socksPort := 0
+	fmt.Sscanf(portStr, "%d", &socksPort)
+
+	result := NewDefaultChecker("").Check(context.Background(), dnsTestInstance(socksPort, "udp", []string{"203.0.113.7"}))
+	if !result.Up {
+		t.Errorf("expected tunnel up via DNS over UDP, got error: %v", result.Err)
+	}
+}
+
+func TestCheckByDNS_DoH(t *testing.T) {
+	socksListener, socksPort := startMockSOCKS(t, func(c net.Conn) {
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" {
+			c.Write([]byte("HTTP/1.1 415 Unsupported Media Type\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+		query, _ := io.ReadAll(req.Body)
+		resp := dnsReply(t, query, dnsmessage.RCodeSuccess, "203.0.113.7")
+		fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Type: application/dns-message\r\nContent-Length: %d\r\n\r\n", len(resp))
+		c.Write(resp)
+	})
+	defer socksListener.Close()
+
+	ti := dnsTestInstance(socksPort, "doh", nil)
+	s := ti.MethodConfig.(config.DNSSettings)
+	s.Server = "http://doh.example.com/dns-query"
+	ti.MethodConfig = s
+
+	result := NewDefaultChecker("").Check(context.Background(), ti)
+	if !result.Up {
+		t.Errorf("expected tunnel up via DoH, got error: %v", result.Err)
+	}
+	if result.HTTPStatus != 200 {
+		t.Errorf("expected HTTP 200, got %d", result.HTTPStatus)
+	}
+}
+
+func TestCheckByDNS_SOCKSNotReachable(t *testing.T) {
+	ti := dnsTestInstance(59997, "tcp", nil)
+	ti.CheckTimeout = time.Second
+
+	result := NewDefaultChecker("").Check(context.Background(), ti)
+	if result.Up {
+		t.Error("expected tunnel down when SOCKS port is unreachable")
+	}
+}
+
+func TestParseDNSAnswers_IDMismatch(t *testing.T) {
+	query, err := buildDNSQuery(1, "example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatalf("buildDNSQuery: %v", err)
+	}
+	resp := dnsReply(t, query, dnsmessage.RCodeSuccess, "203.0.113.7")
+	if _, err := parseDNSAnswers(resp, 2, dnsmessage.TypeA); err == nil {
+		t.Error("expected error for mismatched response ID")
+	}
+}
+
+func TestDNSAnswerMatches(t *testing.T) {
+	answers := []netip.Addr{netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("198.51.100.1")}
+	tests := []struct {
+		name     string
+		expected []string
+		want     bool
+	}{
+		{"no expectation", nil, true},
+		{"exact ip", []string{"198.51.100.1"}, true},
+		{"cidr", []string{"203.0.113.0/24"}, true},
+		{"no match", []string{"192.0.2.1", "10.0.0.0/8"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addrsMatch(answers, tt.expected); got != tt.want {
+				t.Errorf("addrsMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// maxExecOutput caps how much of the command's stdout and stderr is kept.
+const maxExecOutput = 64 << 10
+
+// execWaitDelay bounds how long the command's output pipes may stay open
+// after it was killed on timeout, e.g. by a grandchild that inherited them.
+const execWaitDelay = time.Second
+
+// checkByExec runs exec_command with the proxy environment pointing at the
+// tunnel's SOCKS port and the tunnel metadata in XRAY_* variables. Exit code
+// 0 passes; the command is killed after CheckTimeout. Latency is the run
+// time of the command. With exec_value_regex, a numeric value is extracted
+// from stdout and exported.
+func checkByExec(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.ExecSettings)
+	if len(s.Command) == 0 {
+		return tunnel.CheckResult{Up: false, Err: &metrics.CheckError{
+			Stage: metrics.ErrorStageExec, Reason: "exec_failed", Err: errors.New("exec command failed: exec_command is empty"),
+		}}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ti.CheckTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Env = append(os.Environ(), execEnv(ti)...)
+	cmd.WaitDelay = execWaitDelay
+	stdout := &cappedBuffer{max: maxExecOutput}
+	stderr := &cappedBuffer{max: maxExecOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	latency := time.Since(start)
+
+	if err != nil {
+		reason := "exec_failed"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = "timeout"
+			err = fmt.Errorf("exec command timed out after %s: %w", ti.CheckTimeout, ctx.Err())
+		} else {
+			err = fmt.Errorf("exec command failed: %w", err)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w (stderr: %s)", err, truncate(msg, 512))
+		}
+		return tunnel.CheckResult{Up: false, Err: &metrics.CheckError{Stage: metrics.ErrorStageExec, Reason: reason, Err: err}}
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		slog.Debug("exec check stderr", "tunnel", ti.Name, "check", ti.MetricLabels.Check, "stderr", truncate(msg, 512))
+	}
+
+	result := tunnel.CheckResult{Up: true, Latency: latency}
+	if s.ValueRegex != nil {
+		v, err := parseExecValue(s.ValueRegex, stdout.String())
+		if err != nil {
+			return tunnel.CheckResult{Up: false, Err: err}
+		}
+		result.ExecValue = &v
+	}
+	return result
+}
+
+// execEnv returns the environment added for the exec method: the usual proxy
+// variables in both cases, as tools disagree on which they read, the SOCKS
+// credentials and the tunnel metadata.
+func execEnv(ti *tunnel.TunnelInstance) []string {
+	proxyURL := url.URL{Scheme: "socks5h", Host: fmt.Sprintf("127.0.0.1:%d", ti.SocksPort)}
+	var username, password string
+	if ti.SocksAuth != nil {
+		username, password = ti.SocksAuth.Username, ti.SocksAuth.Password
+		proxyURL.User = url.UserPassword(username, password)
+	}
+	proxy := proxyURL.String()
+	return []string{
+		"ALL_PROXY=" + proxy, "all_proxy=" + proxy,
+		"HTTPS_PROXY=" + proxy, "https_proxy=" + proxy,
+		"HTTP_PROXY=" + proxy, "http_proxy=" + proxy,
+		"NO_PROXY=", "no_proxy=",
+		"XRAY_SOCKS_PORT=" + strconv.Itoa(ti.SocksPort),
+		"XRAY_SOCKS_USERNAME=" + username,
+		"XRAY_SOCKS_PASSWORD=" + password,
+		"XRAY_TUNNEL_NAME=" + ti.Name,
+		"XRAY_TUNNEL_SERVER=" + ti.MetricLabels.Server,
+		"XRAY_TUNNEL_SECURITY=" + ti.MetricLabels.Security,
+		"XRAY_TUNNEL_SNI=" + ti.MetricLabels.SNI,
+		"XRAY_TUNNEL_CHECK=" + ti.MetricLabels.Check,
+	}
+}
+
+// parseExecValue extracts the value from the command's stdout: the first
+// match of re, or its capture group if it has one.
+func parseExecValue(re *regexp.Regexp, out string) (float64, error) {
+	m := re.FindStringSubmatch(out)
+	if m == nil {
+		return 0, validationError("content_mismatch", fmt.Errorf("content mismatch: exec output does not match exec_value_regex %q: %q",
+			re, truncate(strings.TrimSpace(out), 100)))
+	}
+	value := m[len(m)-1]
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, validationError("content_mismatch", fmt.Errorf("content mismatch: exec output value %q is not a number", value))
+	}
+	return v, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the
+// rest, so a chatty command cannot exhaust memory.
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string { return b.buf.String() }
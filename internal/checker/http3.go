@@ -0,0 +1,123 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/apernet/quic-go"
+	"github.com/apernet/quic-go/http3"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// http3RootCAs are the roots HTTP/3 server certificates are verified
+// against; nil means the system roots. Tests replace it.
+var http3RootCAs *x509.CertPool
+
+// checkByHTTP3 sends the check request to CheckURL over HTTP/3, with QUIC
+// carried through the proxy by a SOCKS5 UDP ASSOCIATE session. Unlike the
+// http method there is no fallback to TCP: the check fails if QUIC does not
+// get through. Status expectations are those of the http method; redirects
+// are not followed.
+//
+// Latency is the time until the response headers arrived, including the
+// QUIC handshake, and Protocol is the negotiated ALPN (h3).
+func checkByHTTP3(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.HTTPSettings)
+	ctx, cancel := context.WithTimeout(ctx, ti.CheckTimeout)
+	defer cancel()
+
+	socksDialer, err := newSOCKSDialer(ctx, ti, ti.CheckTimeout)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+
+	transport := &http3.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: http3RootCAs},
+		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+			conn, err := socksDialer.DialUDP(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			qc, err := quic.DialEarly(ctx, udpPacketConn{conn}, conn.RemoteAddr(), tlsConf, conf)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("quic handshake with %s: %w", addr, err)
+			}
+			// quic-go does not close a PacketConn it was handed.
+			go func() {
+				<-qc.Context().Done()
+				conn.Close()
+			}()
+			return qc, nil
+		},
+	}
+	defer transport.Close()
+
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ti.CheckURL, nil)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+
+	protocol := resp.Proto
+	if resp.TLS != nil && resp.TLS.NegotiatedProtocol != "" {
+		protocol = resp.TLS.NegotiatedProtocol
+	}
+
+	if !statusAccepted(resp.StatusCode, s.ExpectedStatus) {
+		return tunnel.CheckResult{
+			Up:         false,
+			HTTPStatus: resp.StatusCode,
+			Protocol:   protocol,
+			Err:        badStatusError("bad status code: %d", resp.StatusCode),
+		}
+	}
+
+	return tunnel.CheckResult{
+		Up:         true,
+		Latency:    latency,
+		HTTPStatus: resp.StatusCode,
+		Protocol:   protocol,
+	}
+}
+
+// udpPacketConn adapts a connected SOCKS5 UDP session to the net.PacketConn
+// quic-go needs. Every datagram goes to, and comes from, the session's
+// destination, so the addresses are ignored. Embedding the interface hides
+// the underlying *net.UDPConn, whose own ReadFrom and WriteTo would bypass
+// the SOCKS5 headers.
+type udpPacketConn struct {
+	net.Conn
+}
+
+func (c udpPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c udpPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
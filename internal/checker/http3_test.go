@@ -0,0 +1,180 @@
+package checker
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apernet/quic-go/http3"
+
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// startHTTP3Server serves handler over HTTP/3 on a local UDP port with the
+// httptest certificate, which the checker is made to trust for the test.
+func startHTTP3Server(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	tlsSrv := httptest.NewTLSServer(handler)
+	t.Cleanup(tlsSrv.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsSrv.Certificate())
+	http3RootCAs = pool
+	t.Cleanup(func() { http3RootCAs = nil })
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen UDP: %v", err)
+	}
+	srv := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(tlsSrv.TLS.Clone())}
+	go srv.Serve(pc)
+	t.Cleanup(func() {
+		srv.Close()
+		pc.Close()
+	})
+	return pc.LocalAddr().String()
+}
+
+// startUDPRelaySOCKS is a SOCKS5 proxy that accepts UDP ASSOCIATE and relays
+// each datagram to the destination in its header, wrapping the replies.
+func startUDPRelaySOCKS(t *testing.T) int {
+	t.Helper()
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to create UDP relay: %v", err)
+	}
+	t.Cleanup(func() { relay.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		upstreams := map[string]*net.UDPConn{}
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// Header: RSV RSV FRAG ATYP DST.ADDR DST.PORT
+			var host string
+			var hostEnd int
+			switch buf[3] {
+			case 1:
+				hostEnd = 4 + 4
+				host = net.IP(buf[4:hostEnd]).String()
+			case 3:
+				hostEnd = 5 + int(buf[4])
+				host = string(buf[5:hostEnd])
+			case 4:
+				hostEnd = 4 + 16
+				host = net.IP(buf[4:hostEnd]).String()
+			default:
+				continue
+			}
+			upstream, ok := upstreams[from.String()]
+			if !ok {
+				port := int(buf[hostEnd])<<8 | int(buf[hostEnd+1])
+				target := net.JoinHostPort(host, strconv.Itoa(port))
+				raddr, err := net.ResolveUDPAddr("udp", target)
+				if err != nil {
+					continue
+				}
+				if upstream, err = net.DialUDP("udp", nil, raddr); err != nil {
+					continue
+				}
+				upstreams[from.String()] = upstream
+				t.Cleanup(func() { upstream.Close() })
+				go func(client *net.UDPAddr) {
+					reply := make([]byte, 2048)
+					for {
+						m, err := upstream.Read(reply)
+						if err != nil {
+							return
+						}
+						relay.WriteToUDP(append([]byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 0}, reply[:m]...), client)
+					}
+				}(from)
+			}
+			upstream.Write(buf[hostEnd+2 : n])
+		}
+	}()
+
+	listener, port := startMockSOCKS(t, func(c net.Conn) {
+		p := relay.LocalAddr().(*net.UDPAddr).Port
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, byte(p >> 8), byte(p & 0xff)})
+		c.Read(make([]byte, 1))
+	})
+	t.Cleanup(func() { listener.Close() })
+	return port
+}
+
+func TestCheckByHTTP3(t *testing.T) {
+	addr := startHTTP3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	socksPort := startUDPRelaySOCKS(t)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantUp     bool
+		wantStatus int
+	}{
+		{"ok", "/", true, http.StatusOK},
+		{"bad status", "/missing", false, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := &tunnel.TunnelInstance{
+				Name:         "h3-test",
+				SocksPort:    socksPort,
+				CheckMethod:  "http3",
+				CheckURL:     "https://" + addr + tt.path,
+				CheckTimeout: 5 * time.Second,
+			}
+
+			r := NewDefaultChecker("").Check(context.Background(), ti)
+			if r.Up != tt.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", r.Up, tt.wantUp, r.Err)
+			}
+			if r.HTTPStatus != tt.wantStatus {
+				t.Errorf("HTTPStatus = %d, want %d", r.HTTPStatus, tt.wantStatus)
+			}
+			if r.Protocol != "h3" {
+				t.Errorf("Protocol = %q, want h3", r.Protocol)
+			}
+			if !tt.wantUp {
+				if reason := metrics.ClassifyError(r.Err); reason != "bad_status" {
+					t.Errorf("ClassifyError(%v) = %q, want bad_status", r.Err, reason)
+				}
+				return
+			}
+			if r.Latency <= 0 {
+				t.Errorf("expected latency, got %v", r.Latency)
+			}
+		})
+	}
+}
+
+func TestCheckByHTTP3_SOCKSUnreachable(t *testing.T) {
+	ti := &tunnel.TunnelInstance{
+		Name:         "h3-down",
+		SocksPort:    59995,
+		CheckMethod:  "http3",
+		CheckURL:     "https://cloudflare.com/cdn-cgi/trace",
+		CheckTimeout: time.Second,
+	}
+	r := NewDefaultChecker("").Check(context.Background(), ti)
+	if r.Up || r.Err == nil {
+		t.Errorf("expected the check to fail without a SOCKS proxy, got Up=%v err=%v", r.Up, r.Err)
+	}
+}
@@ -0,0 +1,130 @@
+package checker
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// maxIPEchoBody caps how much of an IP-echo response is read. JSON services
+// such as ipinfo.io or ip-api.com answer with well under 1 KiB.
+const maxIPEchoBody = 4 << 10
+
+// ipEchoJSON holds the fields of the common JSON IP-echo services
+// (ipify, ipinfo.io, ip-api.com, ifconfig.co, ipapi.co).
+type ipEchoJSON struct {
+	IP          string          `json:"ip"`
+	Query       string          `json:"query"` // ip-api.com
+	CountryCode string          `json:"country_code"`
+	CountryISO  string          `json:"country_iso"` // ifconfig.co
+	CountryCC   string          `json:"countryCode"` // ip-api.com
+	Country     string          `json:"country"`     // a code on ipinfo.io, a name elsewhere
+	ASN         json.RawMessage `json:"asn"`         // number or "AS123" string
+	AS          string          `json:"as"`          // ip-api.com: "AS13335 Cloudflare, Inc."
+	Org         string          `json:"org"`         // ipinfo.io: "AS13335 Cloudflare, Inc."
+}
+
+// parseIPEcho extracts the exit information from an IP-echo response body.
+// A body starting with '{' is decoded as JSON; anything else is taken as a
+// bare IP address. The IP must be valid; country and ASN are best effort.
+func parseIPEcho(body []byte) (tunnel.ExitInfo, error) {
+	body = bytes.TrimSpace(body)
+
+	var info tunnel.ExitInfo
+	if len(body) > 0 && body[0] == '{' {
+		var j ipEchoJSON
+		if err := json.Unmarshal(body, &j); err != nil {
+			return info, fmt.Errorf("invalid IP-echo JSON: %w", err)
+		}
+		info.IP = cmp.Or(j.IP, j.Query)
+		for _, c := range []string{j.CountryCode, j.CountryISO, j.CountryCC, j.Country} {
+			if len(c) == 2 {
+				info.Country = strings.ToUpper(c)
+				break
+			}
+		}
+		info.ASN = cmp.Or(parseASN(j.ASN), asnPrefix(j.AS), asnPrefix(j.Org))
+	} else {
+		info.IP = string(body)
+	}
+
+	addr, err := netip.ParseAddr(info.IP)
+	if err != nil {
+		return info, fmt.Errorf("ip check returned no valid IP address: %q", truncate(info.IP, 64))
+	}
+	info.IP = addr.Unmap().String()
+	return info, nil
+}
+
+// checkExit asserts the exit against the ip method's expected_country and
+// expected_ip_cidr. Failures are validation errors with the unexpected_exit
+// reason.
+func checkExit(s config.IPSettings, info tunnel.ExitInfo) error {
+	if len(s.ExpectedIPCIDR) > 0 {
+		addr, _ := netip.ParseAddr(info.IP)
+		if !addrsMatch([]netip.Addr{addr}, s.ExpectedIPCIDR) {
+			return validationError("unexpected_exit", fmt.Errorf("unexpected exit IP %s: not in expected_ip_cidr %v", info.IP, s.ExpectedIPCIDR))
+		}
+	}
+	if len(s.ExpectedCountry) > 0 {
+		if info.Country == "" {
+			return validationError("unexpected_exit", errors.New("unexpected exit: IP-echo service reported no country, expected_country needs a JSON service that does"))
+		}
+		if !slices.Contains(s.ExpectedCountry, info.Country) {
+			return validationError("unexpected_exit", fmt.Errorf("unexpected exit country %s: want one of %v", info.Country, s.ExpectedCountry))
+		}
+	}
+	return nil
+}
+
+// parseASN accepts an ASN given as a JSON number (13335) or string
+// ("AS13335" or "13335") and returns it as "AS13335".
+func parseASN(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var n int64
+	if err := json.Unmarshal(raw, &n); err == nil && n > 0 {
+		return "AS" + strconv.FormatInt(n, 10)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return ""
+	}
+	if asn := asnPrefix(s); asn != "" {
+		return asn
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		return "AS" + strconv.FormatInt(n, 10)
+	}
+	return ""
+}
+
+// asnPrefix returns the leading "AS<number>" token of s, or "" if s does not
+// start with one.
+func asnPrefix(s string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(s), " ")
+	if len(token) < 3 || !strings.EqualFold(token[:2], "AS") {
+		return ""
+	}
+	if _, err := strconv.ParseUint(token[2:], 10, 32); err != nil {
+		return ""
+	}
+	return "AS" + token[2:]
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,141 @@
+package checker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+func TestParseIPEcho(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    tunnel.ExitInfo
+		wantErr bool
+	}{
+		{"plain text", "203.0.113.5\n", tunnel.ExitInfo{IP: "203.0.113.5"}, false},
+		{"plain IPv6", "2001:db8::1", tunnel.ExitInfo{IP: "2001:db8::1"}, false},
+		{"ipify json", `{"ip":"203.0.113.5"}`, tunnel.ExitInfo{IP: "203.0.113.5"}, false},
+		{
+			"ipinfo", `{"ip":"203.0.113.5","country":"de","org":"AS24940 Hetzner Online GmbH"}`,
+			tunnel.ExitInfo{IP: "203.0.113.5", Country: "DE", ASN: "AS24940"}, false,
+		},
+		{
+			"ip-api", `{"query":"203.0.113.5","country":"Netherlands","countryCode":"NL","as":"AS14061 DigitalOcean, LLC"}`,
+			tunnel.ExitInfo{IP: "203.0.113.5", Country: "NL", ASN: "AS14061"}, false,
+		},
+		{
+			"ifconfig.co", `{"ip":"203.0.113.5","country":"Finland","country_iso":"FI","asn":"AS16509"}`,
+			tunnel.ExitInfo{IP: "203.0.113.5", Country: "FI", ASN: "AS16509"}, false,
+		},
+		{
+			"numeric asn", `{"ip":"203.0.113.5","country_code":"US","asn":13335}`,
+			tunnel.ExitInfo{IP: "203.0.113.5", Country: "US", ASN: "AS13335"}, false,
+		},
+		{"html page", "<html>captive portal</html>", tunnel.ExitInfo{}, true},
+		{"json without ip", `{"country":"DE"}`, tunnel.ExitInfo{}, true},
+		{"broken json", `{"ip":`, tunnel.ExitInfo{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIPEcho([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIPEcho() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseIPEcho() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckExit(t *testing.T) {
+	exit := tunnel.ExitInfo{IP: "203.0.113.5", Country: "DE"}
+	tests := []struct {
+		name      string
+		countries []string
+		cidrs     []string
+		exit      tunnel.ExitInfo
+		wantErr   string
+	}{
+		{"no expectations", nil, nil, exit, ""},
+		{"country matches", []string{"NL", "DE"}, nil, exit, ""},
+		{"country mismatch", []string{"NL"}, nil, exit, "unexpected exit country DE"},
+		{"country unknown", []string{"DE"}, nil, tunnel.ExitInfo{IP: "203.0.113.5"}, "reported no country"},
+		{"cidr matches", nil, []string{"203.0.113.0/24"}, exit, ""},
+		{"exact ip matches", nil, []string{"203.0.113.5"}, exit, ""},
+		{"cidr mismatch", nil, []string{"198.51.100.0/24"}, exit, "unexpected exit IP 203.0.113.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkExit(config.IPSettings{ExpectedCountry: tt.countries, ExpectedIPCIDR: tt.cidrs}, tt.exit)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkExit() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkExit() = %v, want error containing %q", err, tt.wantErr)
+			}
+			if reason := metrics.ClassifyError(err); reason != "unexpected_exit" {
+				t.Errorf("ClassifyError() = %q, want unexpected_exit", reason)
+			}
+		})
+	}
+}
+
+func TestCheckByIP_JSONExit(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ip":"203.0.113.5","country":"DE","org":"AS24940 Hetzner Online GmbH"}`))
+	}))
+	defer echo.Close()
+
+	socksListener, socksPort := startRelaySOCKS(t, echo.Listener.Addr().String())
+	defer socksListener.Close()
+
+	tests := []struct {
+		name      string
+		countries []string
+		wantUp    bool
+	}{
+		{"any country", nil, true},
+		{"expected country", []string{"DE"}, true},
+		{"wrong country", []string{"NL"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := &tunnel.TunnelInstance{
+				Name:        "ip-json",
+				SocksPort:   socksPort,
+				CheckMethod: "ip",
+				MethodConfig: config.IPSettings{
+					URL:             echo.URL + "/json",
+					ExpectedCountry: tt.countries,
+				},
+				CheckTimeout:  5 * time.Second,
+				CheckInterval: 30 * time.Second,
+			}
+
+			result := NewDefaultChecker("192.0.2.1").Check(context.Background(), ti)
+			if result.Up != tt.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", result.Up, tt.wantUp, result.Err)
+			}
+			want := tunnel.ExitInfo{IP: "203.0.113.5", Country: "DE", ASN: "AS24940"}
+			if result.Exit == nil || *result.Exit != want {
+				t.Errorf("Exit = %+v, want %+v", result.Exit, want)
+			}
+		})
+	}
+}
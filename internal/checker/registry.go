@@ -0,0 +1,122 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// CheckFunc runs one check of a tunnel through its SOCKS5 proxy and returns
+// the result. It must return promptly once ctx is canceled.
+type CheckFunc func(ctx context.Context, ti *tunnel.TunnelInstance, env Env) tunnel.CheckResult
+
+// Env is what the DefaultChecker running a check hands to its CheckFunc
+// besides the tunnel.
+type Env struct {
+	// RealIP is the host's public IP resolved at startup, or empty if that
+	// failed. The ip method compares the exit IP against it.
+	RealIP string
+}
+
+// Method is a check method that can be selected with check_method: its
+// configuration handling and the function that runs it.
+type Method struct {
+	config.Method
+	Check CheckFunc
+	// Stages records the socks_dial, connect, tls and first_byte timings of
+	// the check's connections through the SOCKS5 dialer and net/http.
+	Stages bool
+}
+
+// methodTable holds every registered method in registration order. It is
+// the only table of methods: DefaultChecker dispatches from it and, through
+// config.SetMethodRegistry, configuration validation reads it.
+type methodTable struct {
+	sync.RWMutex
+	list []Method
+}
+
+var checks = &methodTable{}
+
+func init() {
+	builtin := map[string]Method{
+		"ip":          {Check: checkByIP, Stages: true},
+		"http":        {Check: checkByHTTP, Stages: true},
+		"http3":       {Check: checkByHTTP3, Stages: true},
+		"download":    {Check: checkByDownload, Stages: true},
+		"upload":      {Check: checkByUpload, Stages: true},
+		"dns":         {Check: checkByDNS, Stages: true},
+		"websocket":   {Check: checkByWebSocket, Stages: true},
+		"exec":        {Check: checkByExec},
+		"concurrency": {Check: checkByConcurrency},
+	}
+	// The configuration side of the built-in methods lives in the config
+	// package, which cannot depend on this one.
+	for _, cm := range config.BuiltinMethods() {
+		m, ok := builtin[cm.Name]
+		if !ok {
+			panic(fmt.Sprintf("checker: no check function for built-in method %q", cm.Name))
+		}
+		m.Method = cm
+		Register(m)
+	}
+	config.SetMethodRegistry(checks)
+}
+
+// Register adds a check method, making it valid in check_method and method
+// and dispatching it from DefaultChecker. Call it before the configuration
+// is loaded, typically from an init function. It panics if m has no name or
+// check function, or if the name is already registered.
+func Register(m Method) {
+	if m.Name == "" {
+		panic("checker: check method without a name")
+	}
+	if m.Check == nil {
+		panic(fmt.Sprintf("checker: check method %q without a check function", m.Name))
+	}
+
+	checks.Lock()
+	defer checks.Unlock()
+	for _, existing := range checks.list {
+		if existing.Name == m.Name {
+			panic(fmt.Sprintf("checker: check method %q registered twice", m.Name))
+		}
+	}
+	checks.list = append(checks.list, m)
+}
+
+// LookupMethod implements config.MethodRegistry.
+func (t *methodTable) LookupMethod(name string) (config.Method, bool) {
+	m, ok := t.lookup(name)
+	return m.Method, ok
+}
+
+// MethodNames implements config.MethodRegistry.
+func (t *methodTable) MethodNames() []string {
+	t.RLock()
+	defer t.RUnlock()
+	names := make([]string, len(t.list))
+	for i, m := range t.list {
+		names[i] = m.Name
+	}
+	return names
+}
+
+func (t *methodTable) lookup(name string) (Method, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	for _, m := range t.list {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Method{}, false
+}
+
+// lookupMethod returns the registered method called name.
+func lookupMethod(name string) (Method, bool) {
+	return checks.lookup(name)
+}
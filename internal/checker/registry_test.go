@@ -0,0 +1,101 @@
+package checker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+func TestRegister(t *testing.T) {
+	type staticOptions struct {
+		Up bool `yaml:"up"`
+	}
+	Register(Method{
+		Method: config.Method{
+			Name: "checker-test-static",
+			Decode: func(t *config.Tunnel) (any, error) {
+				var opts staticOptions
+				err := config.DecodeOptions(t.Options, &opts)
+				return opts, err
+			},
+		},
+		Check: func(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+			if ti.MethodConfig.(staticOptions).Up {
+				return tunnel.CheckResult{Up: true}
+			}
+			return tunnel.CheckResult{Up: false, Err: errors.New("static down")}
+		},
+	})
+
+	tun := &config.Tunnel{
+		Name: "static",
+		URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+		CheckSettings: config.CheckSettings{
+			CheckURL: "https://example.com",
+			Options:  map[string]any{"up": true},
+		},
+		CheckInterval: "30s",
+		CheckTimeout:  "10s",
+		CheckMethod:   "checker-test-static",
+	}
+	if err := tun.Validate(); err != nil {
+		t.Fatalf("expected the registered method to validate, got: %v", err)
+	}
+
+	m, ok := config.LookupMethod("checker-test-static")
+	if !ok {
+		t.Fatal("Register did not register the method's configuration")
+	}
+	for _, up := range []bool{true, false} {
+		tun.Options = map[string]any{"up": up}
+		opts, err := m.Decode(tun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ti := &tunnel.TunnelInstance{Name: "static", CheckMethod: "checker-test-static", MethodConfig: opts}
+		r := NewDefaultChecker("").Check(context.Background(), ti)
+		if r.Up != up {
+			t.Errorf("Up = %v, want %v (err: %v)", r.Up, up, r.Err)
+		}
+		if r.Stages != nil {
+			t.Errorf("Stages = %v, want none without Stages", r.Stages)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a method without a check function to panic")
+		}
+	}()
+	Register(Method{Method: config.Method{Name: "checker-test-nil"}})
+}
+
+func TestRegister_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a built-in name again to panic")
+		}
+	}()
+	Register(Method{Method: config.Method{Name: "http"}, Check: checkByHTTP})
+}
+
+func TestCheck_UnknownMethod(t *testing.T) {
+	r := NewDefaultChecker("").Check(context.Background(), &tunnel.TunnelInstance{CheckMethod: "nope"})
+	if r.Up || r.Err == nil || !strings.Contains(r.Err.Error(), `unknown check method "nope"`) {
+		t.Errorf("expected an unknown method error, got Up=%v err=%v", r.Up, r.Err)
+	}
+}
+
+func TestBuiltinMethodsRegistered(t *testing.T) {
+	for _, name := range config.MethodNames() {
+		if m, ok := lookupMethod(name); ok && m.Check == nil {
+			t.Errorf("method %q has no check function", name)
+		} else if !ok {
+			t.Errorf("method %q is valid in the configuration but not dispatched", name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/socks"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// stageTimer collects the per-stage timings of one check from SOCKS5Dialer
+// and httptrace hooks. A stage seen more than once (redirects) is summed.
+type stageTimer struct {
+	mu           sync.Mutex
+	stages       map[string]time.Duration
+	tlsStart     time.Time
+	tlsFailed    bool
+	wroteRequest time.Time
+}
+
+// withStages runs check with a copy of ctx that records stage timings and
+// attaches them to the result. An error the check did not tag with a stage
+// is attributed to the TLS handshake if one failed, otherwise to the HTTP
+// exchange.
+func withStages(ctx context.Context, ti *tunnel.TunnelInstance, env Env, check CheckFunc) tunnel.CheckResult {
+	st := &stageTimer{}
+	result := check(st.trace(ctx), ti, env)
+	result.Stages = st.durations()
+	if result.Err != nil && metrics.ErrorStage(result.Err) == metrics.ErrorStageUnknown {
+		stage := metrics.ErrorStageHTTP
+		if st.failedTLS() {
+			stage = metrics.ErrorStageTLS
+		}
+		result.Err = &metrics.CheckError{Stage: stage, Err: result.Err}
+	}
+	return result
+}
+
+// validationError tags err as a failed assertion on a response that arrived
+// intact. reason is one of metrics.ErrorReasons, or empty to classify err.
+func validationError(reason string, err error) error {
+	return &metrics.CheckError{Stage: metrics.ErrorStageValidation, Reason: reason, Err: err}
+}
+
+// badStatusError reports a response status the check does not accept.
+func badStatusError(format string, code int) error {
+	return validationError("bad_status", fmt.Errorf(format, code))
+}
+
+// bodyError tags err as a failure while reading a response body or
+// exchanging messages after the request succeeded.
+func bodyError(err error) error {
+	return &metrics.CheckError{Stage: metrics.ErrorStageBody, Err: err}
+}
+
+// trace returns a copy of ctx carrying the SOCKS and HTTP hooks that feed st.
+func (st *stageTimer) trace(ctx context.Context) context.Context {
+	ctx = socks.WithDialTrace(ctx, &socks.DialTrace{
+		ProxyHandshakeDone: func(d time.Duration) { st.add(metrics.StageSOCKSDial, d) },
+		RequestDone:        func(d time.Duration) { st.add(metrics.StageConnect, d) },
+	})
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { st.mark(&st.tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				st.mu.Lock()
+				st.tlsFailed = true
+				st.mu.Unlock()
+				return
+			}
+			st.since(metrics.StageTLS, &st.tlsStart)
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { st.mark(&st.wroteRequest) },
+		GotFirstResponseByte: func() { st.since(metrics.StageFirstByte, &st.wroteRequest) },
+	})
+}
+
+func (st *stageTimer) add(stage string, d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stages == nil {
+		st.stages = make(map[string]time.Duration)
+	}
+	st.stages[stage] += d
+}
+
+func (st *stageTimer) mark(t *time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	*t = time.Now()
+}
+
+// since adds the time elapsed from the mark at *from to stage, if marked.
+func (st *stageTimer) since(stage string, from *time.Time) {
+	st.mu.Lock()
+	start := *from
+	st.mu.Unlock()
+	if !start.IsZero() {
+		st.add(stage, time.Since(start))
+	}
+}
+
+// failedTLS reports whether a TLS handshake ended in an error.
+func (st *stageTimer) failedTLS() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.tlsFailed
+}
+
+// durations returns the recorded timings, or nil if no stage completed.
+func (st *stageTimer) durations() map[string]time.Duration {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.stages
+}
@@ -0,0 +1,86 @@
+package checker
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// checkByUpload verifies the uplink of the tunnel by POSTing upload_size
+// bytes of generated data to upload_url through the proxy. Any 2xx answer
+// passes.
+//
+// The upload speed is measured from writing the request headers to the first
+// response byte, so it assumes the sink answers only after reading the whole
+// body. Latency is the TTFB as for the other HTTP methods.
+func checkByUpload(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.UploadSettings)
+	start := time.Now()
+
+	client, err := newSOCKSClient(ctx, ti, s.Timeout)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+
+	var wroteHeadersNanos, ttfbNanos atomic.Int64
+	trace := &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			wroteHeadersNanos.Store(time.Since(start).Nanoseconds())
+		},
+		GotFirstResponseByte: func() {
+			ttfbNanos.Store(time.Since(start).Nanoseconds())
+		},
+	}
+	req, err := http.NewRequestWithContext(
+		httptrace.WithClientTrace(ctx, trace),
+		http.MethodPost, s.URL, uploadPayload(s.Size),
+	)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+	req.ContentLength = s.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return tunnel.CheckResult{
+			Up:         false,
+			HTTPStatus: resp.StatusCode,
+			Err:        badStatusError("upload returned bad status: %d", resp.StatusCode),
+		}
+	}
+
+	var throughput float64
+	if from, to := wroteHeadersNanos.Load(), ttfbNanos.Load(); from > 0 && to > from {
+		throughput = float64(s.Size) / time.Duration(to-from).Seconds()
+	}
+
+	result := tunnel.CheckResult{
+		Up:               true,
+		Latency:          resolveLatency(&ttfbNanos, start),
+		HTTPStatus:       resp.StatusCode,
+		BytesUploaded:    s.Size,
+		UploadThroughput: throughput,
+	}
+	applyMinThroughput(s.ThroughputSettings, &result, throughput)
+	return result
+}
+
+// uploadPayload returns size bytes of pseudo-random data. Random bytes keep
+// compressing middleboxes from shrinking the upload.
+func uploadPayload(size int64) io.Reader {
+	return io.LimitReader(rand.NewChaCha8([32]byte{}), size)
+}
@@ -0,0 +1,126 @@
+package checker
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+)
+
+// startRelaySOCKS starts a mock SOCKS proxy that relays every connection to
+// target, whatever address the client asked for.
+func startRelaySOCKS(t *testing.T, target string) (net.Listener, int) {
+	t.Helper()
+	return startMockSOCKS(t, func(c net.Conn) {
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			c.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, c)
+		io.Copy(c, upstream)
+	})
+}
+
+func TestCheckByUpload(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		min          float64
+		action       string
+		wantUp       bool
+		wantDegraded bool
+	}{
+		{"success", http.StatusOK, 0, "", true, false},
+		{"no content", http.StatusNoContent, 0, "", true, false},
+		{"bad status", http.StatusRequestEntityTooLarge, 0, "", false, false},
+		{"below threshold fails", http.StatusOK, 1e12, "down", false, false},
+		{"below threshold degrades", http.StatusOK, 1e12, "degraded", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received atomic.Int64
+			sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					t.Errorf("method = %s, want POST", r.Method)
+				}
+				n, _ := io.Copy(io.Discard, r.Body)
+				received.Store(n)
+				w.WriteHeader(tt.status)
+			}))
+			defer sink.Close()
+
+			socksListener, socksPort := startRelaySOCKS(t, sink.Listener.Addr().String())
+			defer socksListener.Close()
+
+			ti := &tunnel.TunnelInstance{
+				Name:        "upload-test",
+				SocksPort:   socksPort,
+				CheckMethod: "upload",
+				MethodConfig: config.UploadSettings{
+					URL:                sink.URL + "/upload",
+					Timeout:            10 * time.Second,
+					Size:               256 * 1024,
+					ThroughputSettings: config.ThroughputSettings{MinThroughput: tt.min, Action: tt.action},
+				},
+				CheckTimeout:  5 * time.Second,
+				CheckInterval: 30 * time.Second,
+			}
+
+			result := NewDefaultChecker("").Check(context.Background(), ti)
+			if result.Up != tt.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", result.Up, tt.wantUp, result.Err)
+			}
+			if result.Degraded != tt.wantDegraded {
+				t.Errorf("Degraded = %v, want %v", result.Degraded, tt.wantDegraded)
+			}
+			if result.HTTPStatus != tt.status {
+				t.Errorf("HTTPStatus = %d, want %d", result.HTTPStatus, tt.status)
+			}
+			size := ti.MethodConfig.(config.UploadSettings).Size
+			if got := received.Load(); got != size {
+				t.Errorf("sink received %d bytes, want %d", got, size)
+			}
+			if tt.status == http.StatusOK && tt.min == 0 {
+				if result.BytesUploaded != size {
+					t.Errorf("BytesUploaded = %d, want %d", result.BytesUploaded, size)
+				}
+				if result.UploadThroughput <= 0 {
+					t.Errorf("UploadThroughput = %v, want > 0", result.UploadThroughput)
+				}
+				if result.Latency <= 0 {
+					t.Errorf("Latency = %v, want > 0", result.Latency)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadPayload(t *testing.T) {
+	data, err := io.ReadAll(uploadPayload(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4096 {
+		t.Fatalf("len = %d, want 4096", len(data))
+	}
+	zeros := 0
+	for _, b := range data {
+		if b == 0 {
+			zeros++
+		}
+	}
+	if zeros > 256 {
+		t.Errorf("payload has %d zero bytes, expected random-looking data", zeros)
+	}
+}
@@ -0,0 +1,119 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+	"github.com/gorilla/websocket"
+)
+
+// errPong is returned by the pong handler to stop reading once the expected
+// pong arrived; control frames alone never end a read.
+var errPong = errors.New("pong received")
+
+// checkByWebSocket opens WebSocketURL through the proxy and exchanges one
+// message with the server: in echo mode a text message that must come back
+// unchanged (other messages, such as a greeting, are skipped), in ping mode
+// a ping that must be answered by a pong.
+//
+// Latency is the handshake time, from dialing until the 101 response; the
+// exchange is reported as RoundTrip.
+func checkByWebSocket(ctx context.Context, ti *tunnel.TunnelInstance, _ Env) tunnel.CheckResult {
+	s, _ := ti.MethodConfig.(config.WebSocketSettings)
+	ctx, cancel := context.WithTimeout(ctx, ti.CheckTimeout)
+	defer cancel()
+
+	socksDialer, err := newSOCKSDialer(ctx, ti, ti.CheckTimeout)
+	if err != nil {
+		return tunnel.CheckResult{Up: false, Err: err}
+	}
+	d := websocket.Dialer{
+		NetDialContext:   socksDialer.DialContext,
+		HandshakeTimeout: ti.CheckTimeout,
+		TLSClientConfig:  &tls.Config{},
+	}
+
+	start := time.Now()
+	conn, resp, err := d.DialContext(ctx, s.URL, nil)
+	if err != nil {
+		if resp != nil {
+			return tunnel.CheckResult{
+				Up:         false,
+				HTTPStatus: resp.StatusCode,
+				Err:        badStatusError("websocket handshake returned bad status: %d", resp.StatusCode),
+			}
+		}
+		return tunnel.CheckResult{Up: false, Err: fmt.Errorf("websocket handshake: %w", err)}
+	}
+	defer conn.Close()
+	handshake := time.Since(start)
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+	_ = conn.SetWriteDeadline(deadline)
+
+	token := fmt.Sprintf("xray-health-exporter %016x", rand.Uint64())
+	sent := time.Now()
+	if s.Mode == "ping" {
+		err = websocketPing(conn, token, deadline)
+	} else {
+		err = websocketEcho(conn, token)
+	}
+	if err != nil {
+		return tunnel.CheckResult{Up: false, HTTPStatus: resp.StatusCode, Err: bodyError(err)}
+	}
+	rtt := time.Since(sent)
+
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+
+	return tunnel.CheckResult{
+		Up:         true,
+		Latency:    handshake,
+		HTTPStatus: resp.StatusCode,
+		RoundTrip:  rtt,
+	}
+}
+
+// websocketEcho sends token as a text message and waits for it to come back.
+func websocketEcho(conn *websocket.Conn, token string) error {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(token)); err != nil {
+		return fmt.Errorf("websocket write: %w", err)
+	}
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("websocket echo not received: %w", err)
+		}
+		if string(msg) == token {
+			return nil
+		}
+	}
+}
+
+// websocketPing sends a ping carrying token and waits for the matching pong.
+func websocketPing(conn *websocket.Conn, token string, deadline time.Time) error {
+	conn.SetPongHandler(func(data string) error {
+		if data == token {
+			return errPong
+		}
+		return nil
+	})
+	if err := conn.WriteControl(websocket.PingMessage, []byte(token), deadline); err != nil {
+		return fmt.Errorf("websocket ping: %w", err)
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if errors.Is(err, errPong) {
+				return nil
+			}
+			return fmt.Errorf("websocket pong not received: %w", err)
+		}
+	}
+}
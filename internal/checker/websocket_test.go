@@ -0,0 +1,130 @@
+package checker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/tunnel"
+	"github.com/gorilla/websocket"
+)
+
+// startWebSocketServer serves an echo endpoint that greets first, like
+// echo.websocket.org, a /silent endpoint that never answers messages and
+// a /forbidden endpoint that refuses the upgrade.
+func startWebSocketServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var upgrader websocket.Upgrader
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("Request served by test"))
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(typ, msg)
+		}
+	})
+	mux.HandleFunc("/silent", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetPingHandler(func(string) error { return nil }) // no pong
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/forbidden", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCheckByWebSocket(t *testing.T) {
+	srv := startWebSocketServer(t)
+	socksListener, socksPort := startRelaySOCKS(t, srv.Listener.Addr().String())
+	defer socksListener.Close()
+	base := "ws://" + srv.Listener.Addr().String()
+
+	tests := []struct {
+		name       string
+		path       string
+		mode       string
+		wantUp     bool
+		wantReason string
+	}{
+		{"echo", "/echo", "echo", true, ""},
+		{"ping", "/echo", "ping", true, ""},
+		{"no echo", "/silent", "echo", false, "timeout"},
+		{"no pong", "/silent", "ping", false, "timeout"},
+		{"upgrade refused", "/forbidden", "echo", false, "bad_status"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := &tunnel.TunnelInstance{
+				Name:        "ws-test",
+				SocksPort:   socksPort,
+				CheckMethod: "websocket",
+				MethodConfig: config.WebSocketSettings{
+					URL:  base + tt.path,
+					Mode: tt.mode,
+				},
+				CheckTimeout: 500 * time.Millisecond,
+			}
+
+			r := NewDefaultChecker("").Check(context.Background(), ti)
+			if r.Up != tt.wantUp {
+				t.Fatalf("Up = %v, want %v (err: %v)", r.Up, tt.wantUp, r.Err)
+			}
+			if !tt.wantUp {
+				if reason := metrics.ClassifyError(r.Err); reason != tt.wantReason {
+					t.Errorf("ClassifyError(%v) = %q, want %q", r.Err, reason, tt.wantReason)
+				}
+				return
+			}
+			if r.HTTPStatus != http.StatusSwitchingProtocols {
+				t.Errorf("HTTPStatus = %d, want 101", r.HTTPStatus)
+			}
+			if r.Latency <= 0 || r.RoundTrip <= 0 {
+				t.Errorf("expected handshake latency and round trip, got %v / %v", r.Latency, r.RoundTrip)
+			}
+			if _, ok := r.Stages[metrics.StageSOCKSDial]; !ok {
+				t.Errorf("expected the socks_dial stage, got %v", r.Stages)
+			}
+		})
+	}
+}
+
+func TestCheckByWebSocket_SOCKSUnreachable(t *testing.T) {
+	ti := &tunnel.TunnelInstance{
+		Name:        "ws-down",
+		SocksPort:   59996,
+		CheckMethod: "websocket",
+		MethodConfig: config.WebSocketSettings{
+			URL:  "ws://example.com/",
+			Mode: "echo",
+		},
+		CheckTimeout: time.Second,
+	}
+	r := NewDefaultChecker("").Check(context.Background(), ti)
+	if r.Up || r.Err == nil {
+		t.Errorf("expected the check to fail without a SOCKS proxy, got Up=%v err=%v", r.Up, r.Err)
+	}
+}
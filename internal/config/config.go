@@ -3,19 +3,24 @@
 package config
 
 import (
+	"cmp"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"golang.org/x/net/http/httpguts"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,20 +35,34 @@ type Config struct {
 	Defaults      Defaults       `yaml:"defaults"`
 	Tunnels       []Tunnel       `yaml:"tunnels"`
 	Subscriptions []Subscription `yaml:"subscriptions"`
+	Baseline      Baseline       `yaml:"baseline"`
 }
 
 // Defaults holds default values that each Tunnel can override.
 type Defaults struct {
-	CheckURL          string   `yaml:"check_url"`
 	CheckInterval     string   `yaml:"check_interval"`
 	CheckTimeout      string   `yaml:"check_timeout"`
 	MaxBackoff        string   `yaml:"max_backoff"`
 	BackoffMultiplier *float64 `yaml:"backoff_multiplier"`
 	CheckMethod       string   `yaml:"check_method"`
-	IPCheckURL        string   `yaml:"ip_check_url"`
-	DownloadURL       string   `yaml:"download_url"`
-	DownloadTimeout   string   `yaml:"download_timeout"`
-	DownloadMinSize   int64    `yaml:"download_min_size"`
+	CheckSettings     `yaml:",inline"`
+	Checks            []Check `yaml:"checks"`
+	UpPolicy          string  `yaml:"up_policy"`
+	ServerProbe       *bool   `yaml:"server_probe"`
+	Soak              *bool   `yaml:"soak"`
+	SoakURL           string  `yaml:"soak_url"`
+	SoakHeartbeat     string  `yaml:"soak_heartbeat"`
+	SocksAuth         *bool   `yaml:"socks_auth"`
+}
+
+// Baseline configures the direct (non-proxied) probe that tells an outage of
+// the monitoring host apart from tunnel failures.
+type Baseline struct {
+	Enabled     bool     `yaml:"enabled"`
+	URLs        []string `yaml:"urls"` // empty => the check_url of every tunnel
+	Interval    string   `yaml:"interval"`
+	Timeout     string   `yaml:"timeout"`
+	MarkUnknown bool     `yaml:"mark_unknown"` // report failed checks as unknown while the baseline fails
 }
 
 // Subscription describes a remote subscription URL that provides tunnel entries.
@@ -57,25 +76,189 @@ type Tunnel struct {
 	Name              string   `yaml:"name"`
 	URL               string   `yaml:"url"`
 	XrayConfigFile    string   `yaml:"xray_config_file"`
-	CheckURL          string   `yaml:"check_url"`
 	CheckInterval     string   `yaml:"check_interval"`
 	CheckTimeout      string   `yaml:"check_timeout"`
 	SocksPort         int      `yaml:"socks_port"`
 	MaxBackoff        string   `yaml:"max_backoff"`
 	BackoffMultiplier *float64 `yaml:"backoff_multiplier"`
 	CheckMethod       string   `yaml:"check_method"`
-	IPCheckURL        string   `yaml:"ip_check_url"`
-	DownloadURL       string   `yaml:"download_url"`
-	DownloadTimeout   string   `yaml:"download_timeout"`
-	DownloadMinSize   int64    `yaml:"download_min_size"`
+	CheckSettings     `yaml:",inline"`
+	Checks            []Check `yaml:"checks"`
+	UpPolicy          string  `yaml:"up_policy"`
+	ServerProbe       *bool   `yaml:"server_probe"`
+	Soak              *bool   `yaml:"soak"`
+	SoakURL           string  `yaml:"soak_url"`
+	SoakHeartbeat     string  `yaml:"soak_heartbeat"`
+	SocksAuth         *bool   `yaml:"socks_auth"`
+}
+
+// Check is one named health-check in a tunnel's checks list. All checks run
+// against the tunnel's Xray instance; unset fields inherit from the tunnel.
+type Check struct {
+	Name          string `yaml:"name"`
+	Method        string `yaml:"method"`
+	Interval      string `yaml:"interval"`
+	Timeout       string `yaml:"timeout"`
+	Required      bool   `yaml:"required"`
+	CheckSettings `yaml:",inline"`
+}
+
+// CheckSettings holds the check settings that Defaults, Tunnel and Check
+// share. Each embeds it inline, so the YAML keys are the same at every level
+// and a zero field inherits from the level above (see overlay).
+type CheckSettings struct {
+	CheckURL              string            `yaml:"check_url"`
+	IPCheckURL            string            `yaml:"ip_check_url"`
+	DownloadURL           string            `yaml:"download_url"`
+	DownloadTimeout       string            `yaml:"download_timeout"`
+	DownloadMinSize       int64             `yaml:"download_min_size"`
+	DownloadMaxSize       int64             `yaml:"download_max_size"`
+	MinThroughput         string            `yaml:"min_throughput"`
+	MinThroughputAction   string            `yaml:"min_throughput_action"`
+	UploadURL             string            `yaml:"upload_url"`
+	UploadTimeout         string            `yaml:"upload_timeout"`
+	UploadSize            int64             `yaml:"upload_size"`
+	Samples               int               `yaml:"samples"`
+	SampleInterval        string            `yaml:"sample_interval"`
+	MaxLoss               *float64          `yaml:"max_loss"`
+	Concurrency           int               `yaml:"concurrency"`
+	ConcurrencyMinSuccess *float64          `yaml:"concurrency_min_success"`
+	DNSName               string            `yaml:"dns_name"`
+	DNSServer             string            `yaml:"dns_server"`
+	DNSTransport          string            `yaml:"dns_transport"`
+	DNSRecordType         string            `yaml:"dns_record_type"`
+	DNSExpected           []string          `yaml:"dns_expected"`
+	WebSocketURL          string            `yaml:"websocket_url"`
+	WebSocketMode         string            `yaml:"websocket_mode"`
+	ExecCommand           []string          `yaml:"exec_command"`
+	ExecValueRegex        string            `yaml:"exec_value_regex"`
+	Options               map[string]any    `yaml:"options"`
+	ExpectedCountry       []string          `yaml:"expected_country"`
+	ExpectedIPCIDR        []string          `yaml:"expected_ip_cidr"`
+	ExpectedStatus        []string          `yaml:"expected_status"`
+	ExpectBodyRegex       string            `yaml:"expect_body_regex"`
+	RejectBodyRegex       string            `yaml:"reject_body_regex"`
+	ExpectHeader          map[string]string `yaml:"expect_header"`
+	CheckRequest          CheckRequest      `yaml:"check_request"`
+}
+
+// overlay returns base with every non-zero field of top, recursively for
+// nested structs such as CheckRequest, taking its place.
+func overlay(base, top CheckSettings) CheckSettings {
+	overlayValue(reflect.ValueOf(&base).Elem(), reflect.ValueOf(top))
+	return base
+}
+
+func overlayValue(dst, src reflect.Value) {
+	for i := range src.NumField() {
+		f := src.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+			overlayValue(dst.Field(i), f)
+		case !f.IsZero():
+			dst.Field(i).Set(f)
+		}
+	}
+}
+
+// CheckRequest customizes the HTTP request sent by the http check method.
+// Unset fields inherit from defaults.check_request, then built-in defaults.
+type CheckRequest struct {
+	Method          string            `yaml:"method"`
+	Headers         map[string]string `yaml:"headers"`
+	Body            string            `yaml:"body"`
+	FollowRedirects *bool             `yaml:"follow_redirects"`
+	MaxRedirects    int               `yaml:"max_redirects"`
+}
+
+// StatusRange is an inclusive range of acceptable HTTP status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// Contains reports whether code falls within the range.
+func (r StatusRange) Contains(code int) bool {
+	return code >= r.Min && code <= r.Max
+}
+
+// ParseExpectedStatus parses expected_status entries. Each entry is a single
+// code ("200"), an inclusive range ("200-299") or a class ("2xx").
+func ParseExpectedStatus(specs []string) ([]StatusRange, error) {
+	var ranges []StatusRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		var r StatusRange
+		switch {
+		case len(spec) == 3 && strings.HasSuffix(strings.ToLower(spec), "xx"):
+			class, err := strconv.Atoi(spec[:1])
+			if err != nil || class < 1 || class > 5 {
+				return nil, fmt.Errorf("invalid status class %q", spec)
+			}
+			r = StatusRange{Min: class * 100, Max: class*100 + 99}
+		case strings.Contains(spec, "-"):
+			lo, hi, _ := strings.Cut(spec, "-")
+			minCode, err1 := strconv.Atoi(strings.TrimSpace(lo))
+			maxCode, err2 := strconv.Atoi(strings.TrimSpace(hi))
+			if err1 != nil || err2 != nil || minCode > maxCode {
+				return nil, fmt.Errorf("invalid status range %q", spec)
+			}
+			r = StatusRange{Min: minCode, Max: maxCode}
+		default:
+			code, err := strconv.Atoi(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid status code %q", spec)
+			}
+			r = StatusRange{Min: code, Max: code}
+		}
+		if r.Min < 100 || r.Max > 599 {
+			return nil, fmt.Errorf("status %q out of range [100-599]", spec)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// throughputUnits maps min_throughput suffixes to bytes per second. Decimal
+// (SI) multipliers are used, like most speed tests.
+var throughputUnits = map[string]float64{
+	"b/s":    1,
+	"kb/s":   1e3,
+	"mb/s":   1e6,
+	"gb/s":   1e9,
+	"kbit/s": 1e3 / 8,
+	"mbit/s": 1e6 / 8,
+	"gbit/s": 1e9 / 8,
+}
+
+// ParseThroughput parses a min_throughput value such as "500KB/s", "10Mbit/s"
+// or a bare number of bytes per second. An empty string yields 0 (disabled).
+func ParseThroughput(spec string) (float64, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(spec, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := spec, "b/s"
+	if i >= 0 {
+		num, unit = spec[:i], strings.ToLower(strings.TrimSpace(spec[i:]))
+	}
+	mult, ok := throughputUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in %q: use B/s, KB/s, MB/s, GB/s, Kbit/s, Mbit/s or Gbit/s", spec)
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("%q must be a positive number with an optional unit", spec)
+	}
+	return v * mult, nil
 }
 
 // ApplyTunnelDefaults fills zero-value fields on tunnel with values from
 // defaults first, then with built-in defaults for anything still empty.
 func ApplyTunnelDefaults(tunnel *Tunnel, defaults Defaults) {
-	if tunnel.CheckURL == "" {
-		tunnel.CheckURL = defaults.CheckURL
-	}
 	if tunnel.CheckInterval == "" {
 		tunnel.CheckInterval = defaults.CheckInterval
 	}
@@ -91,17 +274,40 @@ func ApplyTunnelDefaults(tunnel *Tunnel, defaults Defaults) {
 	if tunnel.CheckMethod == "" {
 		tunnel.CheckMethod = defaults.CheckMethod
 	}
-	if tunnel.IPCheckURL == "" {
-		tunnel.IPCheckURL = defaults.IPCheckURL
+
+	inherited := defaults.CheckSettings
+	if tunnel.DNSTransport != "" &&
+		tunnel.DNSTransport != cmp.Or(defaults.DNSTransport, metrics.DefaultDNSTransport) {
+		// The default resolver was chosen for the default transport; a
+		// tunnel with another one gets that transport's built-in server.
+		inherited.DNSServer = ""
 	}
-	if tunnel.DownloadURL == "" {
-		tunnel.DownloadURL = defaults.DownloadURL
+	if !methodTakesOptions(cmp.Or(tunnel.CheckMethod, metrics.DefaultCheckMethod)) {
+		// A method that takes no options must not inherit them.
+		inherited.Options = nil
 	}
-	if tunnel.DownloadTimeout == "" {
-		tunnel.DownloadTimeout = defaults.DownloadTimeout
+	tunnel.CheckSettings = overlay(inherited, tunnel.CheckSettings)
+
+	if tunnel.Checks == nil {
+		tunnel.Checks = defaults.Checks
 	}
-	if tunnel.DownloadMinSize == 0 {
-		tunnel.DownloadMinSize = defaults.DownloadMinSize
+	if tunnel.UpPolicy == "" {
+		tunnel.UpPolicy = defaults.UpPolicy
+	}
+	if tunnel.ServerProbe == nil {
+		tunnel.ServerProbe = defaults.ServerProbe
+	}
+	if tunnel.Soak == nil {
+		tunnel.Soak = defaults.Soak
+	}
+	if tunnel.SoakURL == "" {
+		tunnel.SoakURL = defaults.SoakURL
+	}
+	if tunnel.SoakHeartbeat == "" {
+		tunnel.SoakHeartbeat = defaults.SoakHeartbeat
+	}
+	if tunnel.SocksAuth == nil {
+		tunnel.SocksAuth = defaults.SocksAuth
 	}
 
 	// Built-in defaults (lowest priority).
@@ -136,6 +342,110 @@ func ApplyTunnelDefaults(tunnel *Tunnel, defaults Defaults) {
 	if tunnel.DownloadMinSize == 0 {
 		tunnel.DownloadMinSize = metrics.DefaultDownloadMinSize
 	}
+	if tunnel.UploadURL == "" {
+		tunnel.UploadURL = metrics.DefaultUploadURL
+	}
+	if tunnel.UploadTimeout == "" {
+		tunnel.UploadTimeout = metrics.DefaultUploadTimeout.String()
+	}
+	if tunnel.UploadSize == 0 {
+		tunnel.UploadSize = metrics.DefaultUploadSize
+	}
+	if tunnel.MinThroughputAction == "" {
+		tunnel.MinThroughputAction = metrics.DefaultThroughputAction
+	}
+	if tunnel.Samples == 0 {
+		tunnel.Samples = metrics.DefaultSamples
+	}
+	if tunnel.SampleInterval == "" {
+		tunnel.SampleInterval = "0s"
+	}
+	if tunnel.MaxLoss == nil {
+		l := metrics.DefaultMaxLoss
+		tunnel.MaxLoss = &l
+	}
+	if tunnel.Concurrency == 0 {
+		tunnel.Concurrency = metrics.DefaultConcurrency
+	}
+	if tunnel.ConcurrencyMinSuccess == nil {
+		s := metrics.DefaultConcurrencyMinSuccess
+		tunnel.ConcurrencyMinSuccess = &s
+	}
+	if tunnel.WebSocketURL == "" {
+		tunnel.WebSocketURL = metrics.DefaultWebSocketURL
+	}
+	if tunnel.SoakURL == "" {
+		tunnel.SoakURL = metrics.DefaultSoakURL
+	}
+	if tunnel.SoakHeartbeat == "" {
+		tunnel.SoakHeartbeat = metrics.DefaultSoakHeartbeat.String()
+	}
+	if tunnel.WebSocketMode == "" {
+		tunnel.WebSocketMode = metrics.DefaultWebSocketMode
+	}
+	if tunnel.DNSName == "" {
+		tunnel.DNSName = metrics.DefaultDNSName
+	}
+	if tunnel.DNSTransport == "" {
+		tunnel.DNSTransport = metrics.DefaultDNSTransport
+	}
+	if tunnel.DNSServer == "" {
+		// DoH needs a URL rather than a host:port resolver address.
+		if tunnel.DNSTransport == "doh" {
+			tunnel.DNSServer = metrics.DefaultDoHServer
+		} else {
+			tunnel.DNSServer = metrics.DefaultDNSServer
+		}
+	}
+	if tunnel.DNSRecordType == "" {
+		tunnel.DNSRecordType = metrics.DefaultDNSRecordType
+	}
+	if tunnel.CheckRequest.Method == "" {
+		tunnel.CheckRequest.Method = http.MethodGet
+	}
+	if tunnel.CheckRequest.FollowRedirects == nil {
+		follow := true
+		tunnel.CheckRequest.FollowRedirects = &follow
+	}
+	if tunnel.CheckRequest.MaxRedirects == 0 {
+		tunnel.CheckRequest.MaxRedirects = metrics.DefaultMaxRedirects
+	}
+	if tunnel.UpPolicy == "" {
+		tunnel.UpPolicy = metrics.DefaultUpPolicy
+	}
+}
+
+// WithCheck returns a copy of tunnel with the check's settings overriding the
+// tunnel's own check settings. The copy has no checks list of its own. Fields
+// still empty afterwards (e.g. dns_server after switching dns_transport) fall
+// back to built-in defaults.
+func (t Tunnel) WithCheck(c Check) Tunnel {
+	out := t
+	out.Checks = nil
+
+	if c.Method != "" {
+		out.CheckMethod = c.Method
+	}
+	if c.Interval != "" {
+		out.CheckInterval = c.Interval
+	}
+	if c.Timeout != "" {
+		out.CheckTimeout = c.Timeout
+	}
+
+	inherited := t.CheckSettings
+	if c.DNSTransport != "" && c.DNSTransport != t.DNSTransport {
+		// The tunnel's resolver was chosen for another transport.
+		inherited.DNSServer = ""
+	}
+	if c.Method != "" && c.Method != t.CheckMethod {
+		// The tunnel's options were for another method.
+		inherited.Options = nil
+	}
+	out.CheckSettings = overlay(inherited, c.CheckSettings)
+
+	ApplyTunnelDefaults(&out, Defaults{})
+	return out
 }
 
 // ApplyEnvDefaults fills empty fields on defaults from environment variables.
@@ -197,6 +507,17 @@ func LoadConfig(configPath string) (*Config, error) {
 		}
 	}
 
+	// Validate baseline
+	if config.Baseline.Interval == "" {
+		config.Baseline.Interval = metrics.DefaultBaselineInterval.String()
+	}
+	if config.Baseline.Timeout == "" {
+		config.Baseline.Timeout = metrics.DefaultBaselineTimeout.String()
+	}
+	if err := config.Baseline.validate(); err != nil {
+		return nil, fmt.Errorf("baseline: %w", err)
+	}
+
 	// Apply defaults to tunnels
 	for i := range config.Tunnels {
 		tunnel := &config.Tunnels[i]
@@ -355,6 +676,18 @@ func (t *Tunnel) Validate() error {
 		}
 	}
 
+	errs = append(errs, t.validateCheckSettings()...)
+	errs = append(errs, t.validateChecks()...)
+	errs = append(errs, t.validateSoak()...)
+
+	return errors.Join(errs...)
+}
+
+// validateCheckSettings checks the fields that configure how the tunnel is
+// probed. It is also applied to every entry of the checks list.
+func (t *Tunnel) validateCheckSettings() []error {
+	var errs []error
+
 	if _, err := time.ParseDuration(t.CheckInterval); err != nil {
 		errs = append(errs, fmt.Errorf("invalid check_interval: %v", err))
 	}
@@ -365,22 +698,224 @@ func (t *Tunnel) Validate() error {
 		errs = append(errs, fmt.Errorf("invalid check_url: must be http or https URL"))
 	}
 
-	// Validate check_method if explicitly set.
-	if t.CheckMethod != "" {
-		switch t.CheckMethod {
-		case "ip", "http", "download":
-			// valid
-		default:
-			errs = append(errs, fmt.Errorf("invalid check_method %q: must be one of ip, http, download", t.CheckMethod))
+	if t.Samples < 0 || t.Samples > metrics.MaxSamples {
+		errs = append(errs, fmt.Errorf("invalid samples %d: must be between 1 and %d", t.Samples, metrics.MaxSamples))
+	}
+	if t.SampleInterval != "" {
+		if d, err := time.ParseDuration(t.SampleInterval); err != nil {
+			errs = append(errs, fmt.Errorf("invalid sample_interval: %v", err))
+		} else if d < 0 {
+			errs = append(errs, fmt.Errorf("invalid sample_interval %q: must not be negative", t.SampleInterval))
+		}
+	}
+	if t.MaxLoss != nil && (*t.MaxLoss < 0 || *t.MaxLoss > 1) {
+		errs = append(errs, fmt.Errorf("invalid max_loss %v: must be between 0 and 1", *t.MaxLoss))
+	}
+
+	// The settings only one method uses are checked by that method.
+	errs = append(errs, t.validateMethod()...)
+
+	return errs
+}
+
+// validateChecks checks up_policy and the checks list. Each check is
+// validated with the tunnel's settings it inherits.
+func (t *Tunnel) validateChecks() []error {
+	var errs []error
+
+	switch t.UpPolicy {
+	case "", "all", "any", "required":
+		// valid
+	default:
+		errs = append(errs, fmt.Errorf("invalid up_policy %q: must be one of all, any, required", t.UpPolicy))
+	}
+
+	seen := make(map[string]bool, len(t.Checks))
+	hasRequired := false
+	for i, c := range t.Checks {
+		if c.Name == "" {
+			errs = append(errs, fmt.Errorf("checks[%d]: name is required", i))
+		} else if seen[c.Name] {
+			errs = append(errs, fmt.Errorf("checks[%d]: duplicate check name %q", i, c.Name))
+		}
+		seen[c.Name] = true
+		hasRequired = hasRequired || c.Required
+
+		ct := t.WithCheck(c)
+		for _, err := range ct.validateCheckSettings() {
+			errs = append(errs, fmt.Errorf("checks[%d] %q: %w", i, c.Name, err))
+		}
+	}
+
+	if t.UpPolicy == "required" && len(t.Checks) > 0 && !hasRequired {
+		errs = append(errs, fmt.Errorf("up_policy required needs at least one check with required: true"))
+	}
+
+	return errs
+}
+
+// validateSoak checks the soak_* fields, which apply to the tunnel as a
+// whole rather than to its checks.
+func (t *Tunnel) validateSoak() []error {
+	var errs []error
+
+	if t.SoakURL != "" {
+		if u, err := url.Parse(t.SoakURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			errs = append(errs, fmt.Errorf("invalid soak_url: must be ws or wss URL"))
+		}
+	}
+	if t.SoakHeartbeat != "" {
+		if d, err := time.ParseDuration(t.SoakHeartbeat); err != nil {
+			errs = append(errs, fmt.Errorf("invalid soak_heartbeat: %v", err))
+		} else if d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid soak_heartbeat %q: must be positive", t.SoakHeartbeat))
+		}
+	}
+
+	return errs
+}
+
+// validateThroughput checks min_throughput and min_throughput_action, which
+// the download and upload methods share.
+func (t *Tunnel) validateThroughput() []error {
+	var errs []error
+
+	if _, err := ParseThroughput(t.MinThroughput); err != nil {
+		errs = append(errs, fmt.Errorf("invalid min_throughput: %v", err))
+	}
+	switch t.MinThroughputAction {
+	case "", "down", "degraded":
+		// valid
+	default:
+		errs = append(errs, fmt.Errorf("invalid min_throughput_action %q: must be one of down, degraded", t.MinThroughputAction))
+	}
+
+	return errs
+}
+
+// validateDNS checks the dns_* fields that are explicitly set.
+func (t *Tunnel) validateDNS() []error {
+	var errs []error
+
+	switch t.DNSTransport {
+	case "", "tcp", "udp", "doh":
+		// valid
+	default:
+		errs = append(errs, fmt.Errorf("invalid dns_transport %q: must be one of tcp, udp, doh", t.DNSTransport))
+	}
+
+	switch t.DNSRecordType {
+	case "", "A", "AAAA":
+		// valid
+	default:
+		errs = append(errs, fmt.Errorf("invalid dns_record_type %q: must be A or AAAA", t.DNSRecordType))
+	}
+
+	if t.DNSServer != "" {
+		if t.DNSTransport == "doh" {
+			if u, err := url.Parse(t.DNSServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("invalid dns_server: must be http or https URL for doh transport"))
+			}
+		} else if _, _, err := net.SplitHostPort(t.DNSServer); err != nil {
+			errs = append(errs, fmt.Errorf("invalid dns_server: must be host:port: %v", err))
+		}
+	}
+
+	for _, e := range t.DNSExpected {
+		if _, err := netip.ParsePrefix(e); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(e); err != nil {
+			errs = append(errs, fmt.Errorf("invalid dns_expected entry %q: must be an IP address or CIDR", e))
+		}
+	}
+
+	return errs
+}
+
+// validateExitExpectations checks the exit location assertions of the ip
+// method.
+func (t *Tunnel) validateExitExpectations() []error {
+	var errs []error
+
+	for _, c := range t.ExpectedCountry {
+		if !isCountryCode(c) {
+			errs = append(errs, fmt.Errorf("invalid expected_country entry %q: must be a two-letter ISO 3166 code", c))
+		}
+	}
+	for _, e := range t.ExpectedIPCIDR {
+		if _, err := netip.ParsePrefix(e); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(e); err != nil {
+			errs = append(errs, fmt.Errorf("invalid expected_ip_cidr entry %q: must be an IP address or CIDR", e))
 		}
 	}
 
-	// Validate download_timeout if explicitly set.
-	if t.DownloadTimeout != "" {
-		if _, err := time.ParseDuration(t.DownloadTimeout); err != nil {
-			errs = append(errs, fmt.Errorf("invalid download_timeout: %v", err))
+	return errs
+}
+
+// isCountryCode reports whether c looks like an ISO 3166-1 alpha-2 code.
+// Case is not significant.
+func isCountryCode(c string) bool {
+	if len(c) != 2 {
+		return false
+	}
+	for _, r := range strings.ToUpper(c) {
+		if r < 'A' || r > 'Z' {
+			return false
 		}
 	}
+	return true
+}
+
+// validate checks the check_request settings that are explicitly set.
+func (r CheckRequest) validate() []error {
+	var errs []error
+
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		// valid
+	default:
+		errs = append(errs, fmt.Errorf("invalid check_request.method %q: must be one of GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", r.Method))
+	}
+	for name, value := range r.Headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs = append(errs, fmt.Errorf("invalid check_request.headers name %q", name))
+		} else if !httpguts.ValidHeaderFieldValue(value) {
+			errs = append(errs, fmt.Errorf("invalid check_request.headers value for %q", name))
+		}
+	}
+	if r.MaxRedirects < 0 {
+		errs = append(errs, fmt.Errorf("invalid check_request.max_redirects %d: must be >= 0", r.MaxRedirects))
+	}
+
+	return errs
+}
+
+// validate checks the baseline probe settings.
+func (b Baseline) validate() error {
+	var errs []error
+
+	if d, err := time.ParseDuration(b.Interval); err != nil {
+		errs = append(errs, fmt.Errorf("invalid interval: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, fmt.Errorf("invalid interval %q: must be positive", b.Interval))
+	}
+	if d, err := time.ParseDuration(b.Timeout); err != nil {
+		errs = append(errs, fmt.Errorf("invalid timeout: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, fmt.Errorf("invalid timeout %q: must be positive", b.Timeout))
+	}
+	for _, u := range b.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid url %q: must be http or https", u))
+		}
+	}
+	if b.MarkUnknown && !b.Enabled {
+		errs = append(errs, fmt.Errorf("mark_unknown requires enabled: true"))
+	}
 
 	return errors.Join(errs...)
 }
@@ -7,6 +7,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 
@@ -210,7 +212,7 @@ func TestValidateTunnels_SocksPort(t *testing.T) {
 	baseTunnel := func() Tunnel {
 		return Tunnel{
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 		}
@@ -327,7 +329,7 @@ func TestApplyTunnelDefaults(t *testing.T) {
 	t.Run("config defaults take priority over globals", func(t *testing.T) {
 		tunnel := &Tunnel{}
 		ApplyTunnelDefaults(tunnel, Defaults{
-			CheckURL:      "https://custom.com",
+			CheckSettings: CheckSettings{CheckURL: "https://custom.com"},
 			CheckInterval: "2m",
 			CheckTimeout:  "15s",
 		})
@@ -345,12 +347,12 @@ func TestApplyTunnelDefaults(t *testing.T) {
 
 	t.Run("tunnel values not overwritten", func(t *testing.T) {
 		tunnel := &Tunnel{
-			CheckURL:      "https://mine.com",
+			CheckSettings: CheckSettings{CheckURL: "https://mine.com"},
 			CheckInterval: "5m",
 			CheckTimeout:  "20s",
 		}
 		ApplyTunnelDefaults(tunnel, Defaults{
-			CheckURL:      "https://default.com",
+			CheckSettings: CheckSettings{CheckURL: "https://default.com"},
 			CheckInterval: "1m",
 			CheckTimeout:  "10s",
 		})
@@ -506,7 +508,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "valid",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 		}
@@ -519,7 +521,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "bad-url",
 			URL:           "vless://bad-url-no-port",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 		}
@@ -534,7 +536,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "ss-url",
 			URL:           "ss://some-data@example.com:8388",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 		}
@@ -547,7 +549,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "bad-interval",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "not-a-duration",
 			CheckTimeout:  "10s",
 		}
@@ -564,7 +566,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "bad-timeout",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "not-a-duration",
 		}
@@ -581,7 +583,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "bad-check-url",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "ftp://not-http.com",
+			CheckSettings: CheckSettings{CheckURL: "ftp://not-http.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 		}
@@ -598,7 +600,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "all-bad",
 			URL:           "vless://bad-url-no-port",
-			CheckURL:      "ftp://bad",
+			CheckSettings: CheckSettings{CheckURL: "ftp://bad"},
 			CheckInterval: "bad-interval",
 			CheckTimeout:  "bad-timeout",
 		}
@@ -623,7 +625,7 @@ func TestTunnelValidate(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "http-url",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "http://example.com",
+			CheckSettings: CheckSettings{CheckURL: "http://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 		}
@@ -642,7 +644,7 @@ func TestTunnelValidate_XrayConfigFile(t *testing.T) {
 		tunnel := Tunnel{
 			Name:           "xray-tunnel",
 			XrayConfigFile: tmpFile,
-			CheckURL:       "https://example.com",
+			CheckSettings:  CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval:  "30s",
 			CheckTimeout:   "10s",
 		}
@@ -655,7 +657,7 @@ func TestTunnelValidate_XrayConfigFile(t *testing.T) {
 		tunnel := Tunnel{
 			Name:           "bad-xray",
 			XrayConfigFile: "/nonexistent/xray.json",
-			CheckURL:       "https://example.com",
+			CheckSettings:  CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval:  "30s",
 			CheckTimeout:   "10s",
 		}
@@ -673,7 +675,7 @@ func TestTunnelValidate_XrayConfigFile(t *testing.T) {
 			Name:           "both",
 			URL:            "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
 			XrayConfigFile: "/tmp/some.json",
-			CheckURL:       "https://example.com",
+			CheckSettings:  CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval:  "30s",
 			CheckTimeout:   "10s",
 		}
@@ -689,7 +691,7 @@ func TestTunnelValidate_XrayConfigFile(t *testing.T) {
 	t.Run("neither url nor xray_config_file", func(t *testing.T) {
 		tunnel := Tunnel{
 			Name:          "neither",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 		}
@@ -708,14 +710,14 @@ func TestTunnelValidate_CheckMethod(t *testing.T) {
 		return &Tunnel{
 			Name:          "method-test",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "10s",
 			CheckMethod:   method,
 		}
 	}
 
-	validMethods := []string{"", "http", "ip", "download"}
+	validMethods := []string{"", "http", "ip", "download", "upload", "dns"}
 	for _, m := range validMethods {
 		t.Run("valid method "+m, func(t *testing.T) {
 			if err := baseTunnel(m).Validate(); err != nil {
@@ -738,15 +740,209 @@ func TestTunnelValidate_CheckMethod(t *testing.T) {
 	}
 }
 
+func TestSetMethodRegistry(t *testing.T) {
+	type probeOptions struct {
+		Target string `yaml:"target"`
+	}
+	probe := Method{
+		Name: "config-test-probe",
+		Validate: func(t *Tunnel) []error {
+			if t.Options["target"] == nil {
+				return []error{fmt.Errorf("config-test-probe requires options.target")}
+			}
+			return nil
+		},
+		Decode: func(t *Tunnel) (any, error) {
+			var opts probeOptions
+			err := DecodeOptions(t.Options, &opts)
+			return opts, err
+		},
+	}
+	prev := SetMethodRegistry(append(MethodList(BuiltinMethods()), probe))
+	defer SetMethodRegistry(prev)
+
+	if !slices.Contains(MethodNames(), "config-test-probe") {
+		t.Fatalf("MethodNames() = %v, want the registered method", MethodNames())
+	}
+	m, ok := LookupMethod("config-test-probe")
+	if !ok || m.Decode == nil {
+		t.Fatal("LookupMethod did not return the registered method")
+	}
+
+	tunnel := func(method string, opts map[string]any) *Tunnel {
+		return &Tunnel{
+			Name: "registry-test",
+			URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+			CheckSettings: CheckSettings{
+				CheckURL: "https://example.com",
+				Options:  opts,
+			},
+			CheckInterval: "30s",
+			CheckTimeout:  "10s",
+			CheckMethod:   method,
+		}
+	}
+	tests := []struct {
+		name    string
+		tunnel  *Tunnel
+		wantErr string
+	}{
+		{"valid", tunnel("config-test-probe", map[string]any{"target": "10.0.0.1"}), ""},
+		{"method validation", tunnel("config-test-probe", nil), "requires options.target"},
+		{"unknown option", tunnel("config-test-probe", map[string]any{"target": "x", "port": 1}), "invalid options for check_method config-test-probe"},
+		{"built-in takes no options", tunnel("http", map[string]any{"target": "x"}), "check_method http takes no options"},
+		{"unknown method lists registered", tunnel("nope", nil), "config-test-probe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tunnel.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	opts, err := m.Decode(tunnel("config-test-probe", map[string]any{"target": "10.0.0.1"}))
+	if err != nil || opts.(probeOptions).Target != "10.0.0.1" {
+		t.Errorf("Decode() = %+v, %v; want target 10.0.0.1", opts, err)
+	}
+
+	SetMethodRegistry(prev)
+	if err := tunnel("config-test-probe", nil).Validate(); err == nil || !strings.Contains(err.Error(), "invalid check_method") {
+		t.Errorf("expected the method to be unknown after restoring the registry, got: %v", err)
+	}
+}
+
+func TestWithCheck_Options(t *testing.T) {
+	probe := Method{
+		Name: "config-test-options",
+		Decode: func(t *Tunnel) (any, error) {
+			return t.Options, nil
+		},
+	}
+	prev := SetMethodRegistry(append(MethodList(BuiltinMethods()), probe))
+	defer SetMethodRegistry(prev)
+
+	defaults := Defaults{CheckMethod: "config-test-options", CheckSettings: CheckSettings{Options: map[string]any{"target": "default"}}}
+	tun := Tunnel{URL: "vless://uuid@example.com:443"}
+	ApplyTunnelDefaults(&tun, defaults)
+	if tun.Options["target"] != "default" {
+		t.Errorf("tunnel options = %v, want the defaults", tun.Options)
+	}
+	if c := tun.WithCheck(Check{Name: "inherit"}); c.Options["target"] != "default" {
+		t.Errorf("check options = %v, want the tunnel's", c.Options)
+	}
+	if c := tun.WithCheck(Check{Name: "own", CheckSettings: CheckSettings{Options: map[string]any{"target": "own"}}}); c.Options["target"] != "own" {
+		t.Errorf("check options = %v, want its own", c.Options)
+	}
+	if c := tun.WithCheck(Check{Name: "other", Method: "http"}); c.Options != nil {
+		t.Errorf("check options = %v, want none for another method", c.Options)
+	}
+
+	// A built-in method takes no options, so it must not inherit them.
+	httpTun := Tunnel{
+		Name:          "options-test",
+		URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+		CheckSettings: CheckSettings{CheckURL: "https://example.com"},
+	}
+	ApplyTunnelDefaults(&httpTun, Defaults{CheckSettings: CheckSettings{Options: defaults.Options}})
+	if httpTun.Options != nil {
+		t.Errorf("http tunnel options = %v, want none", httpTun.Options)
+	}
+	if err := httpTun.Validate(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestDecodeMethod_Builtin(t *testing.T) {
+	minSuccess := 0.5
+	tests := []struct {
+		method   string
+		settings CheckSettings
+		want     any
+	}{
+		{"ip", CheckSettings{ExpectedCountry: []string{"de"}}, IPSettings{URL: metrics.DefaultIPCheckURL, ExpectedCountry: []string{"DE"}}},
+		{"http", CheckSettings{}, HTTPSettings{Request: &HTTPRequest{Method: http.MethodGet, FollowRedirects: true, MaxRedirects: metrics.DefaultMaxRedirects}}},
+		{"http3", CheckSettings{ExpectedStatus: []string{"204"}}, HTTPSettings{ExpectedStatus: []StatusRange{{Min: 204, Max: 204}}}},
+		{"download", CheckSettings{MinThroughput: "1MB/s"}, DownloadSettings{
+			URL:                metrics.DefaultDownloadURL,
+			Timeout:            metrics.DefaultDownloadTimeout,
+			MinSize:            metrics.DefaultDownloadMinSize,
+			MaxSize:            metrics.DefaultDownloadMaxSize,
+			ThroughputSettings: ThroughputSettings{MinThroughput: 1e6, Action: metrics.DefaultThroughputAction},
+		}},
+		{"upload", CheckSettings{UploadSize: 10}, UploadSettings{
+			URL:                metrics.DefaultUploadURL,
+			Timeout:            metrics.DefaultUploadTimeout,
+			Size:               10,
+			ThroughputSettings: ThroughputSettings{Action: metrics.DefaultThroughputAction},
+		}},
+		{"dns", CheckSettings{DNSTransport: "doh"}, DNSSettings{
+			Name:       metrics.DefaultDNSName,
+			Server:     metrics.DefaultDoHServer,
+			Transport:  "doh",
+			RecordType: metrics.DefaultDNSRecordType,
+		}},
+		{"websocket", CheckSettings{WebSocketMode: "ping"}, WebSocketSettings{URL: metrics.DefaultWebSocketURL, Mode: "ping"}},
+		{"exec", CheckSettings{ExecCommand: []string{"true"}}, ExecSettings{Command: []string{"true"}}},
+		{"concurrency", CheckSettings{ConcurrencyMinSuccess: &minSuccess}, ConcurrencySettings{Requests: metrics.DefaultConcurrency, MinSuccess: 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			got, err := DecodeMethod(&Tunnel{CheckMethod: tt.method, CheckSettings: tt.settings})
+			if err != nil {
+				t.Fatalf("DecodeMethod() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeMethod() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_OtherMethodSettings(t *testing.T) {
+	// Settings of a method the tunnel does not use are not validated.
+	tun := &Tunnel{
+		Name: "other-method-test",
+		URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+		CheckSettings: CheckSettings{
+			CheckURL:       "https://example.com",
+			DNSTransport:   "udp",
+			ExpectedStatus: []string{"nope"},
+			UploadURL:      "ftp://example.com",
+		},
+		CheckInterval: "30s",
+		CheckTimeout:  "10s",
+		CheckMethod:   "dns",
+	}
+	if err := tun.Validate(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	tun.CheckMethod = "http"
+	if err := tun.Validate(); err == nil || !strings.Contains(err.Error(), "invalid expected_status") {
+		t.Errorf("expected expected_status error, got: %v", err)
+	}
+}
+
 func TestTunnelValidate_DownloadTimeout(t *testing.T) {
 	baseTunnel := func(timeout string) *Tunnel {
 		return &Tunnel{
-			Name:            "download-timeout-test",
-			URL:             "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:        "https://example.com",
-			CheckInterval:   "30s",
-			CheckTimeout:    "10s",
-			DownloadTimeout: timeout,
+			Name: "download-timeout-test",
+			URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+			CheckSettings: CheckSettings{
+				CheckURL:        "https://example.com",
+				DownloadTimeout: timeout,
+			},
+			CheckInterval: "30s",
+			CheckTimeout:  "10s",
+			CheckMethod:   "download",
 		}
 	}
 
@@ -771,6 +967,1050 @@ func TestTunnelValidate_DownloadTimeout(t *testing.T) {
 			t.Errorf("expected download_timeout error, got: %v", err)
 		}
 	})
+
+	t.Run("download_max_size below download_min_size", func(t *testing.T) {
+		tun := baseTunnel("")
+		tun.DownloadMaxSize = 1024
+		err := tun.Validate()
+		if err == nil {
+			t.Fatal("expected error for download_max_size below download_min_size")
+		}
+		if !strings.Contains(err.Error(), "download_max_size 1024 is below download_min_size 51200") {
+			t.Errorf("expected download_max_size error, got: %v", err)
+		}
+	})
+}
+
+func TestTunnelValidate_ExitExpectations(t *testing.T) {
+	tests := []struct {
+		name      string
+		countries []string
+		cidrs     []string
+		wantErr   string
+	}{
+		{"unset", nil, nil, ""},
+		{"valid", []string{"DE", "nl"}, []string{"203.0.113.0/24", "198.51.100.7"}, ""},
+		{"country name", []string{"Germany"}, nil, "invalid expected_country"},
+		{"numeric country", []string{"49"}, nil, "invalid expected_country"},
+		{"invalid cidr", nil, []string{"203.0.113.0/33"}, "invalid expected_ip_cidr"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "exit-test",
+				URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:        "https://example.com",
+					ExpectedCountry: tt.countries,
+					ExpectedIPCIDR:  tt.cidrs,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				CheckMethod:   "ip",
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_HTTP3(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{"https", "https://cloudflare.com/cdn-cgi/trace", false},
+		{"http", "http://cloudflare.com/cdn-cgi/trace", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name:          "h3-test",
+				URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{CheckURL: tt.url},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				CheckMethod:   "http3",
+			}
+			err := tun.Validate()
+			if tt.wantErr && (err == nil || !strings.Contains(err.Error(), "must be https URL")) {
+				t.Errorf("expected an https error, got: %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("expected no error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_Concurrency(t *testing.T) {
+	ratio := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name       string
+		n          int
+		minSuccess *float64
+		wantErr    string
+	}{
+		{"defaults", 0, nil, ""},
+		{"custom", 50, ratio(0.9), ""},
+		{"negative", -1, nil, "invalid concurrency"},
+		{"too many", metrics.MaxConcurrency + 1, nil, "invalid concurrency"},
+		{"ratio above 1", 10, ratio(1.5), "invalid concurrency_min_success"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "burst",
+				URL:  "vless://uuid@example.com:443?type=xhttp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:              "https://example.com",
+					Concurrency:           tt.n,
+					ConcurrencyMinSuccess: tt.minSuccess,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				CheckMethod:   "concurrency",
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	tun := Tunnel{URL: "vless://uuid@example.com:443"}
+	ApplyTunnelDefaults(&tun, Defaults{CheckSettings: CheckSettings{Concurrency: 20}})
+	if tun.Concurrency != 20 || tun.ConcurrencyMinSuccess == nil || *tun.ConcurrencyMinSuccess != metrics.DefaultConcurrencyMinSuccess {
+		t.Errorf("concurrency/min_success = %d/%v, want the defaults count and the built-in ratio", tun.Concurrency, tun.ConcurrencyMinSuccess)
+	}
+	if c := tun.WithCheck(Check{Name: "burst", CheckSettings: CheckSettings{Concurrency: 50}}); c.Concurrency != 50 {
+		t.Errorf("check concurrency = %d, want 50", c.Concurrency)
+	}
+}
+
+func TestTunnelValidate_Soak(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		heartbeat string
+		wantErr   string
+	}{
+		{"defaults", "", "", ""},
+		{"custom", "ws://10.0.0.1:8080/echo", "1m", ""},
+		{"http url", "https://echo.example.com", "", "invalid soak_url"},
+		{"bad heartbeat", "", "often", "invalid soak_heartbeat"},
+		{"zero heartbeat", "", "0s", "must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			soak := true
+			tun := &Tunnel{
+				Name:          "soak-test",
+				URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{CheckURL: "https://example.com"},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				Soak:          &soak,
+				SoakURL:       tt.url,
+				SoakHeartbeat: tt.heartbeat,
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	soak := true
+	tun := Tunnel{URL: "vless://uuid@example.com:443"}
+	ApplyTunnelDefaults(&tun, Defaults{Soak: &soak, SoakHeartbeat: "1m"})
+	if tun.Soak == nil || !*tun.Soak || tun.SoakURL != metrics.DefaultSoakURL || tun.SoakHeartbeat != "1m" {
+		t.Errorf("soak/soak_url/soak_heartbeat = %v/%q/%q, want the defaults soak and heartbeat and the built-in URL", tun.Soak, tun.SoakURL, tun.SoakHeartbeat)
+	}
+}
+
+func TestApplyTunnelDefaults_SocksAuth(t *testing.T) {
+	on, off := true, false
+
+	tun := Tunnel{URL: "vless://uuid@example.com:443"}
+	ApplyTunnelDefaults(&tun, Defaults{})
+	if tun.SocksAuth != nil {
+		t.Errorf("socks_auth = %v, want unset so the tunnel uses the built-in default", *tun.SocksAuth)
+	}
+
+	tun = Tunnel{URL: "vless://uuid@example.com:443"}
+	ApplyTunnelDefaults(&tun, Defaults{SocksAuth: &off})
+	if tun.SocksAuth == nil || *tun.SocksAuth {
+		t.Errorf("socks_auth = %v, want false from defaults", tun.SocksAuth)
+	}
+
+	tun = Tunnel{URL: "vless://uuid@example.com:443", SocksAuth: &on}
+	ApplyTunnelDefaults(&tun, Defaults{SocksAuth: &off})
+	if tun.SocksAuth == nil || !*tun.SocksAuth {
+		t.Errorf("socks_auth = %v, want the tunnel's true to win", tun.SocksAuth)
+	}
+}
+
+func TestTunnelValidate_WebSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		mode    string
+		wantErr string
+	}{
+		{"defaults", "", "", ""},
+		{"wss echo", "wss://echo.example.com/socket", "echo", ""},
+		{"ws ping", "ws://10.0.0.1:8080/", "ping", ""},
+		{"http url", "https://echo.example.com", "", "invalid websocket_url"},
+		{"unknown mode", "", "pong", "invalid websocket_mode"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "ws-test",
+				URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:      "https://example.com",
+					WebSocketURL:  tt.url,
+					WebSocketMode: tt.mode,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				CheckMethod:   "websocket",
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	tun := Tunnel{URL: "vless://uuid@example.com:443"}
+	ApplyTunnelDefaults(&tun, Defaults{CheckSettings: CheckSettings{WebSocketMode: "ping"}})
+	if tun.WebSocketURL != metrics.DefaultWebSocketURL || tun.WebSocketMode != "ping" {
+		t.Errorf("websocket_url/mode = %q/%q, want the built-in URL and the defaults mode", tun.WebSocketURL, tun.WebSocketMode)
+	}
+	if c := tun.WithCheck(Check{Name: "ws", CheckSettings: CheckSettings{WebSocketURL: "ws://10.0.0.1/"}}); c.WebSocketURL != "ws://10.0.0.1/" || c.WebSocketMode != "ping" {
+		t.Errorf("check websocket_url/mode = %q/%q, want the check URL and the inherited mode", c.WebSocketURL, c.WebSocketMode)
+	}
+}
+
+func TestTunnelValidate_Exec(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		command []string
+		regex   string
+		wantErr string
+	}{
+		{"valid", "exec", []string{"curl", "-sf", "https://example.com"}, `([0-9.]+) ms`, ""},
+		{"command without exec method", "http", []string{"true"}, "", ""},
+		{"missing command", "exec", nil, "", "requires exec_command"},
+		{"empty program", "exec", []string{""}, "", "requires exec_command"},
+		{"invalid regex", "exec", []string{"true"}, "([0-9", "invalid exec_value_regex"},
+		{"two capture groups", "exec", []string{"true"}, `(\d+) (\d+)`, "at most one capture group"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "exec-test",
+				URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:       "https://example.com",
+					ExecCommand:    tt.command,
+					ExecValueRegex: tt.regex,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				CheckMethod:   tt.method,
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_Samples(t *testing.T) {
+	loss := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		samples  int
+		interval string
+		maxLoss  *float64
+		wantErr  string
+	}{
+		{"unset", 0, "", nil, ""},
+		{"valid", 5, "200ms", loss(0.2), ""},
+		{"negative samples", -1, "", nil, "invalid samples"},
+		{"too many samples", metrics.MaxSamples + 1, "", nil, "invalid samples"},
+		{"invalid interval", 3, "often", nil, "invalid sample_interval"},
+		{"negative interval", 3, "-1s", nil, "invalid sample_interval"},
+		{"max_loss above 1", 3, "", loss(1.5), "invalid max_loss"},
+		{"negative max_loss", 3, "", loss(-0.1), "invalid max_loss"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "samples-test",
+				URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:       "https://example.com",
+					Samples:        tt.samples,
+					SampleInterval: tt.interval,
+					MaxLoss:        tt.maxLoss,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_Upload(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		timeout string
+		size    int64
+		wantErr string
+	}{
+		{"unset", "", "", 0, ""},
+		{"valid", "https://sink.example.com/upload", "2m", 4 << 20, ""},
+		{"non-http url", "ftp://sink.example.com", "", 0, "invalid upload_url"},
+		{"invalid timeout", "", "soon", 0, "invalid upload_timeout"},
+		{"negative size", "", "", -1, "invalid upload_size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "upload-test",
+				URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:      "https://example.com",
+					UploadURL:     tt.url,
+					UploadTimeout: tt.timeout,
+					UploadSize:    tt.size,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				CheckMethod:   "upload",
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_DNS(t *testing.T) {
+	baseTunnel := func() *Tunnel {
+		return &Tunnel{
+			Name:          "dns-test",
+			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
+			CheckInterval: "30s",
+			CheckTimeout:  "10s",
+			CheckMethod:   "dns",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*Tunnel)
+		wantErr string
+	}{
+		{"defaults are valid", func(t *Tunnel) {}, ""},
+		{"udp with host:port", func(t *Tunnel) { t.DNSTransport = "udp"; t.DNSServer = "8.8.8.8:53" }, ""},
+		{"doh with url", func(t *Tunnel) { t.DNSTransport = "doh"; t.DNSServer = "https://dns.google/dns-query" }, ""},
+		{"expected ips and cidrs", func(t *Tunnel) { t.DNSExpected = []string{"1.2.3.4", "2001:db8::/32"} }, ""},
+		{"invalid transport", func(t *Tunnel) { t.DNSTransport = "tls" }, "invalid dns_transport"},
+		{"invalid record type", func(t *Tunnel) { t.DNSRecordType = "MX" }, "invalid dns_record_type"},
+		{"tcp server without port", func(t *Tunnel) { t.DNSServer = "1.1.1.1" }, "invalid dns_server"},
+		{"doh server not a url", func(t *Tunnel) { t.DNSTransport = "doh"; t.DNSServer = "1.1.1.1:53" }, "invalid dns_server"},
+		{"invalid expected entry", func(t *Tunnel) { t.DNSExpected = []string{"not-an-ip"} }, "invalid dns_expected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := baseTunnel()
+			tt.modify(tun)
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestParseExpectedStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []StatusRange
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"single code", []string{"200"}, []StatusRange{{200, 200}}, false},
+		{"range", []string{"200-299"}, []StatusRange{{200, 299}}, false},
+		{"class", []string{"3xx"}, []StatusRange{{300, 399}}, false},
+		{"uppercase class", []string{"2XX"}, []StatusRange{{200, 299}}, false},
+		{"mixed", []string{"204", "300 - 302"}, []StatusRange{{204, 204}, {300, 302}}, false},
+		{"not a number", []string{"ok"}, nil, true},
+		{"inverted range", []string{"299-200"}, nil, true},
+		{"out of range", []string{"700"}, nil, true},
+		{"bad class", []string{"9xx"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExpectedStatus(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExpectedStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseExpectedStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseThroughput(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1000", 1000, false},
+		{"500KB/s", 500e3, false},
+		{"1.5 MB/s", 1.5e6, false},
+		{"10Mbit/s", 1.25e6, false},
+		{"1gb/s", 1e9, false},
+		{"fast", 0, true},
+		{"10MiB/s", 0, true},
+		{"0", 0, true},
+		{"-5MB/s", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseThroughput(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseThroughput(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseThroughput(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_MinThroughput(t *testing.T) {
+	tests := []struct {
+		name    string
+		min     string
+		action  string
+		wantErr string
+	}{
+		{"unset", "", "", ""},
+		{"valid", "2MB/s", "degraded", ""},
+		{"invalid value", "quick", "", "invalid min_throughput"},
+		{"invalid action", "2MB/s", "warn", "invalid min_throughput_action"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "throughput-test",
+				URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:            "https://example.com",
+					MinThroughput:       tt.min,
+					MinThroughputAction: tt.action,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				CheckMethod:   "download",
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTunnelValidate_HTTPExpectations(t *testing.T) {
+	baseTunnel := func() *Tunnel {
+		return &Tunnel{
+			Name:          "expectations-test",
+			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
+			CheckInterval: "30s",
+			CheckTimeout:  "10s",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*Tunnel)
+		wantErr string
+	}{
+		{"all valid", func(t *Tunnel) {
+			t.ExpectedStatus = []string{"2xx", "301"}
+			t.ExpectBodyRegex = "(?i)google"
+			t.RejectBodyRegex = "blocked"
+			t.ExpectHeader = map[string]string{"Server": "^gws$"}
+		}, ""},
+		{"invalid status", func(t *Tunnel) { t.ExpectedStatus = []string{"abc"} }, "invalid expected_status"},
+		{"invalid body regex", func(t *Tunnel) { t.ExpectBodyRegex = "(" }, "invalid expect_body_regex"},
+		{"invalid reject regex", func(t *Tunnel) { t.RejectBodyRegex = "[" }, "invalid reject_body_regex"},
+		{"invalid header regex", func(t *Tunnel) { t.ExpectHeader = map[string]string{"Server": "("} }, "invalid expect_header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := baseTunnel()
+			tt.modify(tun)
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_HTTPExpectations(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	content := `defaults:
+  expected_status: [200, "3xx"]
+  reject_body_regex: "captive"
+tunnels:
+  - name: "inherits"
+    url: "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome"
+  - name: "overrides"
+    url: "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome"
+    expected_status: ["204"]
+    expect_body_regex: "ok"
+    expect_header:
+      Server: "^nginx"
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	inherits := cfg.Tunnels[0]
+	if !reflect.DeepEqual(inherits.ExpectedStatus, []string{"200", "3xx"}) {
+		t.Errorf("ExpectedStatus = %v, want [200 3xx]", inherits.ExpectedStatus)
+	}
+	if inherits.RejectBodyRegex != "captive" {
+		t.Errorf("RejectBodyRegex = %q, want captive", inherits.RejectBodyRegex)
+	}
+
+	overrides := cfg.Tunnels[1]
+	if !reflect.DeepEqual(overrides.ExpectedStatus, []string{"204"}) {
+		t.Errorf("ExpectedStatus = %v, want [204]", overrides.ExpectedStatus)
+	}
+	if overrides.ExpectBodyRegex != "ok" || overrides.RejectBodyRegex != "captive" {
+		t.Errorf("unexpected body regexes: %q / %q", overrides.ExpectBodyRegex, overrides.RejectBodyRegex)
+	}
+	if overrides.ExpectHeader["Server"] != "^nginx" {
+		t.Errorf("ExpectHeader = %v, want Server: ^nginx", overrides.ExpectHeader)
+	}
+}
+
+func TestTunnelValidate_CheckRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request CheckRequest
+		wantErr string
+	}{
+		{"all valid", CheckRequest{
+			Method:       "POST",
+			Headers:      map[string]string{"Host": "api.example.com", "Authorization": "Bearer token"},
+			Body:         `{"ping":true}`,
+			MaxRedirects: 5,
+		}, ""},
+		{"empty", CheckRequest{}, ""},
+		{"invalid method", CheckRequest{Method: "FETCH"}, "invalid check_request.method"},
+		{"lowercase method", CheckRequest{Method: "post"}, "invalid check_request.method"},
+		{"invalid header name", CheckRequest{Headers: map[string]string{"Bad Header": "x"}}, "invalid check_request.headers name"},
+		{"invalid header value", CheckRequest{Headers: map[string]string{"X-Test": "a\nb"}}, "invalid check_request.headers value"},
+		{"negative max redirects", CheckRequest{MaxRedirects: -1}, "invalid check_request.max_redirects"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &Tunnel{
+				Name: "check-request-test",
+				URL:  "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+				CheckSettings: CheckSettings{
+					CheckURL:     "https://example.com",
+					CheckRequest: tt.request,
+				},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+			}
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_CheckRequest(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	content := `defaults:
+  check_request:
+    headers:
+      Authorization: "Bearer token"
+    follow_redirects: false
+tunnels:
+  - name: "inherits"
+    url: "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome"
+  - name: "overrides"
+    url: "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome"
+    check_request:
+      method: POST
+      body: '{"ping":true}'
+      follow_redirects: true
+      max_redirects: 3
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	inherits := cfg.Tunnels[0].CheckRequest
+	if inherits.Method != "GET" {
+		t.Errorf("Method = %q, want GET", inherits.Method)
+	}
+	if inherits.Headers["Authorization"] != "Bearer token" {
+		t.Errorf("Headers = %v, want Authorization inherited", inherits.Headers)
+	}
+	if inherits.FollowRedirects == nil || *inherits.FollowRedirects {
+		t.Errorf("FollowRedirects = %v, want false", inherits.FollowRedirects)
+	}
+	if inherits.MaxRedirects != metrics.DefaultMaxRedirects {
+		t.Errorf("MaxRedirects = %d, want %d", inherits.MaxRedirects, metrics.DefaultMaxRedirects)
+	}
+
+	overrides := cfg.Tunnels[1].CheckRequest
+	if overrides.Method != "POST" || overrides.Body != `{"ping":true}` {
+		t.Errorf("unexpected method/body: %q / %q", overrides.Method, overrides.Body)
+	}
+	if overrides.Headers["Authorization"] != "Bearer token" {
+		t.Errorf("Headers = %v, want Authorization inherited", overrides.Headers)
+	}
+	if overrides.FollowRedirects == nil || !*overrides.FollowRedirects {
+		t.Errorf("FollowRedirects = %v, want true", overrides.FollowRedirects)
+	}
+	if overrides.MaxRedirects != 3 {
+		t.Errorf("MaxRedirects = %d, want 3", overrides.MaxRedirects)
+	}
+}
+
+func TestTunnelValidate_Checks(t *testing.T) {
+	baseTunnel := func() *Tunnel {
+		return &Tunnel{
+			Name:          "checks-test",
+			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
+			CheckInterval: "30s",
+			CheckTimeout:  "10s",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*Tunnel)
+		wantErr string
+	}{
+		{"valid checks", func(t *Tunnel) {
+			t.UpPolicy = "required"
+			t.Checks = []Check{
+				{Name: "reach", Required: true},
+				{Name: "speed", Method: "download", Interval: "5m"},
+				{Name: "resolve", Method: "dns", CheckSettings: CheckSettings{DNSTransport: "doh"}},
+			}
+		}, ""},
+		{"invalid up_policy", func(t *Tunnel) { t.UpPolicy = "most" }, "invalid up_policy"},
+		{"missing name", func(t *Tunnel) { t.Checks = []Check{{Method: "ip"}} }, "name is required"},
+		{"duplicate name", func(t *Tunnel) {
+			t.Checks = []Check{{Name: "a"}, {Name: "a", Method: "ip"}}
+		}, `duplicate check name "a"`},
+		{"invalid method", func(t *Tunnel) {
+			t.Checks = []Check{{Name: "bad", Method: "ping"}}
+		}, `checks[0] "bad": invalid check_method`},
+		{"invalid interval", func(t *Tunnel) {
+			t.Checks = []Check{{Name: "bad", Interval: "often"}}
+		}, `checks[0] "bad": invalid check_interval`},
+		{"required policy without required checks", func(t *Tunnel) {
+			t.UpPolicy = "required"
+			t.Checks = []Check{{Name: "a"}, {Name: "b", Method: "ip"}}
+		}, "at least one check with required: true"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := baseTunnel()
+			tt.modify(tun)
+			err := tun.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTunnelWithCheck(t *testing.T) {
+	tun := Tunnel{
+		Name: "with-check",
+		URL:  "vless://uuid@example.com:443",
+		CheckSettings: CheckSettings{
+			CheckURL:     "https://example.com",
+			DNSServer:    "9.9.9.9:53",
+			CheckRequest: CheckRequest{Headers: map[string]string{"Authorization": "Bearer token"}},
+		},
+		CheckInterval: "30s",
+		CheckTimeout:  "10s",
+		Checks:        []Check{{Name: "a"}},
+	}
+	ApplyTunnelDefaults(&tun, Defaults{})
+
+	got := tun.WithCheck(Check{
+		Name:    "resolve",
+		Method:  "dns",
+		Timeout: "3s",
+		CheckSettings: CheckSettings{
+			DNSTransport: "doh",
+			CheckRequest: CheckRequest{Method: "POST"},
+		},
+	})
+
+	if got.Checks != nil {
+		t.Errorf("Checks = %v, want nil", got.Checks)
+	}
+	if got.CheckMethod != "dns" || got.CheckTimeout != "3s" || got.CheckInterval != "30s" {
+		t.Errorf("method/timeout/interval = %q/%q/%q", got.CheckMethod, got.CheckTimeout, got.CheckInterval)
+	}
+	if got.DNSServer != metrics.DefaultDoHServer {
+		t.Errorf("DNSServer = %q, want %q after switching to doh", got.DNSServer, metrics.DefaultDoHServer)
+	}
+	if got.CheckRequest.Method != "POST" || got.CheckRequest.Headers["Authorization"] != "Bearer token" {
+		t.Errorf("CheckRequest = %+v, want POST with inherited headers", got.CheckRequest)
+	}
+	if tun.CheckMethod != "http" || tun.DNSServer != "9.9.9.9:53" {
+		t.Error("WithCheck must not modify the tunnel")
+	}
+}
+
+// fillSettings sets every field of v, recursively for nested structs, to a
+// non-zero value that differs from the built-in defaults.
+func fillSettings(v reflect.Value) {
+	for i := range v.NumField() {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Struct:
+			fillSettings(f)
+		case reflect.String:
+			f.SetString("set-" + v.Type().Field(i).Name)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(int64(100 + i))
+		case reflect.Pointer:
+			p := reflect.New(f.Type().Elem())
+			switch p.Elem().Kind() {
+			case reflect.Bool:
+				p.Elem().SetBool(true)
+			case reflect.Float64:
+				p.Elem().SetFloat(0.25)
+			}
+			f.Set(p)
+		case reflect.Slice:
+			f.Set(reflect.ValueOf([]string{"set"}))
+		case reflect.Map:
+			m := reflect.MakeMap(f.Type())
+			m.SetMapIndex(reflect.ValueOf("key"), reflect.ValueOf("value").Convert(f.Type().Elem()))
+			f.Set(m)
+		default:
+			panic("fillSettings: unhandled kind " + f.Kind().String())
+		}
+	}
+}
+
+// TestCheckSettings_CarriedOver fails when a CheckSettings field is not
+// carried from a check onto the tunnel, or from defaults onto a tunnel.
+func TestCheckSettings_CarriedOver(t *testing.T) {
+	var want CheckSettings
+	fillSettings(reflect.ValueOf(&want).Elem())
+
+	compare := func(t *testing.T, got CheckSettings, skip ...string) {
+		t.Helper()
+		g, w := reflect.ValueOf(got), reflect.ValueOf(want)
+		for i := range w.NumField() {
+			name := w.Type().Field(i).Name
+			if slices.Contains(skip, name) {
+				continue
+			}
+			if !reflect.DeepEqual(g.Field(i).Interface(), w.Field(i).Interface()) {
+				t.Errorf("%s = %v, want %v", name, g.Field(i).Interface(), w.Field(i).Interface())
+			}
+		}
+	}
+
+	t.Run("check onto tunnel", func(t *testing.T) {
+		tun := Tunnel{Name: "carried", URL: "vless://uuid@example.com:443"}
+		ApplyTunnelDefaults(&tun, Defaults{})
+		compare(t, tun.WithCheck(Check{Name: "all", CheckSettings: want}).CheckSettings)
+	})
+
+	t.Run("defaults onto tunnel", func(t *testing.T) {
+		tun := Tunnel{Name: "carried", URL: "vless://uuid@example.com:443"}
+		ApplyTunnelDefaults(&tun, Defaults{CheckSettings: want})
+		// The default http method takes no options, so none are inherited
+		// (see TestWithCheck_Options).
+		compare(t, tun.CheckSettings, "Options")
+	})
+}
+
+func TestLoadConfig_Checks(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	content := `defaults:
+  up_policy: any
+  checks:
+    - name: reach
+    - name: exit
+      method: ip
+tunnels:
+  - name: "inherits"
+    url: "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome"
+  - name: "overrides"
+    url: "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome"
+    up_policy: required
+    checks:
+      - name: speed
+        method: download
+        interval: 5m
+        required: true
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if err := ValidateTunnels(cfg); err != nil {
+		t.Fatalf("ValidateTunnels() error = %v", err)
+	}
+
+	inherits := cfg.Tunnels[0]
+	if inherits.UpPolicy != "any" || len(inherits.Checks) != 2 || inherits.Checks[1].Method != "ip" {
+		t.Errorf("inherits: up_policy=%q checks=%+v", inherits.UpPolicy, inherits.Checks)
+	}
+
+	overrides := cfg.Tunnels[1]
+	if overrides.UpPolicy != "required" || len(overrides.Checks) != 1 {
+		t.Fatalf("overrides: up_policy=%q checks=%+v", overrides.UpPolicy, overrides.Checks)
+	}
+	if c := overrides.Checks[0]; c.Name != "speed" || c.Interval != "5m" || !c.Required {
+		t.Errorf("overrides check = %+v", c)
+	}
+}
+
+func TestApplyTunnelDefaults_ServerProbe(t *testing.T) {
+	on, off := true, false
+
+	tun := &Tunnel{}
+	ApplyTunnelDefaults(tun, Defaults{ServerProbe: &on})
+	if tun.ServerProbe == nil || !*tun.ServerProbe {
+		t.Errorf("ServerProbe = %v, want inherited true", tun.ServerProbe)
+	}
+
+	tun = &Tunnel{ServerProbe: &off}
+	ApplyTunnelDefaults(tun, Defaults{ServerProbe: &on})
+	if *tun.ServerProbe {
+		t.Error("expected the tunnel to override defaults.server_probe")
+	}
+
+	tun = &Tunnel{}
+	ApplyTunnelDefaults(tun, Defaults{})
+	if tun.ServerProbe != nil {
+		t.Errorf("ServerProbe = %v, want unset (disabled)", *tun.ServerProbe)
+	}
+}
+
+func TestApplyTunnelDefaults_DNS(t *testing.T) {
+	t.Run("built-in defaults", func(t *testing.T) {
+		tun := &Tunnel{}
+		ApplyTunnelDefaults(tun, Defaults{})
+
+		if tun.DNSName != metrics.DefaultDNSName {
+			t.Errorf("DNSName = %v, want %v", tun.DNSName, metrics.DefaultDNSName)
+		}
+		if tun.DNSServer != metrics.DefaultDNSServer {
+			t.Errorf("DNSServer = %v, want %v", tun.DNSServer, metrics.DefaultDNSServer)
+		}
+		if tun.DNSTransport != metrics.DefaultDNSTransport {
+			t.Errorf("DNSTransport = %v, want %v", tun.DNSTransport, metrics.DefaultDNSTransport)
+		}
+		if tun.DNSRecordType != metrics.DefaultDNSRecordType {
+			t.Errorf("DNSRecordType = %v, want %v", tun.DNSRecordType, metrics.DefaultDNSRecordType)
+		}
+	})
+
+	t.Run("doh transport gets a DoH server", func(t *testing.T) {
+		tun := &Tunnel{CheckSettings: CheckSettings{DNSTransport: "doh"}}
+		ApplyTunnelDefaults(tun, Defaults{})
+
+		if tun.DNSServer != metrics.DefaultDoHServer {
+			t.Errorf("DNSServer = %v, want %v", tun.DNSServer, metrics.DefaultDoHServer)
+		}
+	})
+
+	t.Run("config defaults take priority over globals", func(t *testing.T) {
+		tun := &Tunnel{}
+		ApplyTunnelDefaults(tun, Defaults{
+			CheckSettings: CheckSettings{
+				DNSName:       "example.org",
+				DNSServer:     "9.9.9.9:53",
+				DNSTransport:  "udp",
+				DNSRecordType: "AAAA",
+				DNSExpected:   []string{"2001:db8::/32"},
+			},
+		})
+
+		if tun.DNSName != "example.org" || tun.DNSServer != "9.9.9.9:53" || tun.DNSTransport != "udp" || tun.DNSRecordType != "AAAA" {
+			t.Errorf("unexpected DNS fields: %+v", tun)
+		}
+		if len(tun.DNSExpected) != 1 || tun.DNSExpected[0] != "2001:db8::/32" {
+			t.Errorf("DNSExpected = %v, want [2001:db8::/32]", tun.DNSExpected)
+		}
+	})
+
+	t.Run("default server stays with its transport", func(t *testing.T) {
+		defaults := Defaults{CheckSettings: CheckSettings{DNSServer: "1.1.1.1:53"}}
+
+		tun := &Tunnel{Name: "dns-pair", URL: "vless://uuid@example.com:443?security=tls&sni=example.com",
+			CheckMethod: "dns", CheckSettings: CheckSettings{DNSTransport: "doh"}}
+		ApplyTunnelDefaults(tun, defaults)
+		if tun.DNSServer != metrics.DefaultDoHServer {
+			t.Errorf("DNSServer = %v, want %v for doh", tun.DNSServer, metrics.DefaultDoHServer)
+		}
+		if err := tun.Validate(); err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+
+		tun = &Tunnel{CheckSettings: CheckSettings{DNSTransport: "tcp"}}
+		ApplyTunnelDefaults(tun, defaults)
+		if tun.DNSServer != "1.1.1.1:53" {
+			t.Errorf("DNSServer = %v, want the default server for the default transport", tun.DNSServer)
+		}
+	})
 }
 
 func TestApplyTunnelDefaults_CheckMethod(t *testing.T) {
@@ -793,16 +2033,33 @@ func TestApplyTunnelDefaults_CheckMethod(t *testing.T) {
 		if tun.DownloadMinSize != metrics.DefaultDownloadMinSize {
 			t.Errorf("DownloadMinSize = %v, want %v", tun.DownloadMinSize, metrics.DefaultDownloadMinSize)
 		}
+		if tun.UploadURL != metrics.DefaultUploadURL {
+			t.Errorf("UploadURL = %v, want %v", tun.UploadURL, metrics.DefaultUploadURL)
+		}
+		if tun.UploadTimeout != metrics.DefaultUploadTimeout.String() {
+			t.Errorf("UploadTimeout = %v, want %v", tun.UploadTimeout, metrics.DefaultUploadTimeout.String())
+		}
+		if tun.UploadSize != metrics.DefaultUploadSize {
+			t.Errorf("UploadSize = %v, want %v", tun.UploadSize, metrics.DefaultUploadSize)
+		}
+		if tun.Samples != metrics.DefaultSamples {
+			t.Errorf("Samples = %v, want %v", tun.Samples, metrics.DefaultSamples)
+		}
+		if tun.MaxLoss == nil || *tun.MaxLoss != metrics.DefaultMaxLoss {
+			t.Errorf("MaxLoss = %v, want %v", tun.MaxLoss, metrics.DefaultMaxLoss)
+		}
 	})
 
 	t.Run("config defaults take priority over globals", func(t *testing.T) {
 		tun := &Tunnel{}
 		ApplyTunnelDefaults(tun, Defaults{
-			CheckMethod:     "ip",
-			IPCheckURL:      "https://custom-ip.example.com",
-			DownloadURL:     "https://custom-download.example.com",
-			DownloadTimeout: "120s",
-			DownloadMinSize: 102400,
+			CheckMethod: "ip",
+			CheckSettings: CheckSettings{
+				IPCheckURL:      "https://custom-ip.example.com",
+				DownloadURL:     "https://custom-download.example.com",
+				DownloadTimeout: "120s",
+				DownloadMinSize: 102400,
+			},
 		})
 
 		if tun.CheckMethod != "ip" {
@@ -824,18 +2081,22 @@ func TestApplyTunnelDefaults_CheckMethod(t *testing.T) {
 
 	t.Run("tunnel values not overwritten", func(t *testing.T) {
 		tun := &Tunnel{
-			CheckMethod:     "download",
-			IPCheckURL:      "https://mine-ip.example.com",
-			DownloadURL:     "https://mine-download.example.com",
-			DownloadTimeout: "90s",
-			DownloadMinSize: 204800,
+			CheckMethod: "download",
+			CheckSettings: CheckSettings{
+				IPCheckURL:      "https://mine-ip.example.com",
+				DownloadURL:     "https://mine-download.example.com",
+				DownloadTimeout: "90s",
+				DownloadMinSize: 204800,
+			},
 		}
 		ApplyTunnelDefaults(tun, Defaults{
-			CheckMethod:     "ip",
-			IPCheckURL:      "https://default-ip.example.com",
-			DownloadURL:     "https://default-download.example.com",
-			DownloadTimeout: "60s",
-			DownloadMinSize: 51200,
+			CheckMethod: "ip",
+			CheckSettings: CheckSettings{
+				IPCheckURL:      "https://default-ip.example.com",
+				DownloadURL:     "https://default-download.example.com",
+				DownloadTimeout: "60s",
+				DownloadMinSize: 51200,
+			},
 		})
 
 		if tun.CheckMethod != "download" {
@@ -1001,7 +2262,7 @@ func TestValidateTunnels(t *testing.T) {
 				{
 					Name:          "valid",
 					URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-					CheckURL:      "https://example.com",
+					CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 					CheckInterval: "30s",
 					CheckTimeout:  "10s",
 				},
@@ -1018,14 +2279,14 @@ func TestValidateTunnels(t *testing.T) {
 				{
 					Name:          "bad1",
 					URL:           "vless://bad-url-no-port",
-					CheckURL:      "ftp://bad",
+					CheckSettings: CheckSettings{CheckURL: "ftp://bad"},
 					CheckInterval: "30s",
 					CheckTimeout:  "10s",
 				},
 				{
 					Name:          "bad2",
 					URL:           "vless://also-bad-no-port",
-					CheckURL:      "ftp://bad2",
+					CheckSettings: CheckSettings{CheckURL: "ftp://bad2"},
 					CheckInterval: "30s",
 					CheckTimeout:  "10s",
 				},
@@ -1050,14 +2311,14 @@ func TestValidateTunnels(t *testing.T) {
 				{
 					Name:          "good",
 					URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-					CheckURL:      "https://example.com",
+					CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 					CheckInterval: "30s",
 					CheckTimeout:  "10s",
 				},
 				{
 					Name:          "bad",
 					URL:           "vless://bad-url-no-port",
-					CheckURL:      "ftp://bad",
+					CheckSettings: CheckSettings{CheckURL: "ftp://bad"},
 					CheckInterval: "30s",
 					CheckTimeout:  "10s",
 				},
@@ -1170,6 +2431,64 @@ tunnels:
 	}
 }
 
+func TestLoadConfig_Baseline(t *testing.T) {
+	const tunnels = `
+tunnels:
+  - url: "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome"`
+	tests := []struct {
+		name      string
+		yaml      string
+		wantErr   string
+		checkFunc func(*testing.T, *Config)
+	}{
+		{
+			name: "defaults",
+			yaml: "baseline:\n  enabled: true" + tunnels,
+			checkFunc: func(t *testing.T, c *Config) {
+				if c.Baseline.Interval != "30s" || c.Baseline.Timeout != "10s" {
+					t.Errorf("interval/timeout = %q/%q, want 30s/10s", c.Baseline.Interval, c.Baseline.Timeout)
+				}
+			},
+		},
+		{
+			name: "custom",
+			yaml: `baseline:
+  enabled: true
+  urls: ["https://www.cloudflare.com"]
+  interval: "1m"
+  mark_unknown: true` + tunnels,
+			checkFunc: func(t *testing.T, c *Config) {
+				if !c.Baseline.MarkUnknown || len(c.Baseline.URLs) != 1 || c.Baseline.Interval != "1m" {
+					t.Errorf("baseline = %+v", c.Baseline)
+				}
+			},
+		},
+		{name: "invalid interval", yaml: "baseline:\n  enabled: true\n  interval: \"often\"" + tunnels, wantErr: "invalid interval"},
+		{name: "zero timeout", yaml: "baseline:\n  enabled: true\n  timeout: \"0s\"" + tunnels, wantErr: "invalid timeout"},
+		{name: "non-http url", yaml: "baseline:\n  enabled: true\n  urls: [\"ftp://example.com\"]" + tunnels, wantErr: "invalid url"},
+		{name: "mark_unknown without enabled", yaml: "baseline:\n  mark_unknown: true" + tunnels, wantErr: "mark_unknown requires enabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			os.WriteFile(configFile, []byte(tt.yaml), 0644)
+
+			config, err := LoadConfig(configFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadConfig() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			tt.checkFunc(t, config)
+		})
+	}
+}
+
 func base64Encode(s string) string {
 	return base64.StdEncoding.EncodeToString([]byte(s))
 }
@@ -1344,7 +2663,7 @@ func TestResolveSubscriptions(t *testing.T) {
 
 	config := &Config{
 		Defaults: Defaults{
-			CheckURL:      "https://example.com",
+			CheckSettings: CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "1m",
 			CheckTimeout:  "10s",
 		},
@@ -0,0 +1,545 @@
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"gopkg.in/yaml.v3"
+)
+
+// Method describes a check method as far as configuration is concerned: its
+// name, the validation of the settings only it uses, and the decoding of its
+// options. The checker package pairs every method with the function that
+// runs it and keeps the only table of methods; methods are added through
+// checker.Register.
+type Method struct {
+	Name string
+	// Validate checks a tunnel or check entry that uses the method, with
+	// defaults and check overrides already applied. Optional.
+	Validate func(t *Tunnel) []error
+	// Decode turns t.Options into the method's own settings, which are
+	// handed to its check function. Optional; without it the method takes no
+	// options.
+	Decode func(t *Tunnel) (any, error)
+
+	// builtin marks the methods of BuiltinMethods. Their Decode compiles
+	// their typed fields into settings rather than options, and they take
+	// no options.
+	builtin bool
+}
+
+// takesOptions reports whether the method reads the options field.
+func (m Method) takesOptions() bool {
+	return m.Decode != nil && !m.builtin
+}
+
+// IPSettings are the settings of the ip method, returned by its Decode.
+type IPSettings struct {
+	URL             string   // the IP echo service
+	ExpectedCountry []string // upper-case country codes the exit must be in
+	ExpectedIPCIDR  []string // IPs or CIDRs the exit IP must match
+}
+
+// HTTPSettings are the compiled request and response assertions of the http
+// method; the http3 method uses only ExpectedStatus. It is what their Decode
+// returns.
+type HTTPSettings struct {
+	Request         *HTTPRequest  // nil => plain GET following redirects
+	ExpectedStatus  []StatusRange // empty => 200, 301, 302, 307
+	ExpectBodyRegex *regexp.Regexp
+	RejectBodyRegex *regexp.Regexp
+	ExpectHeader    map[string]*regexp.Regexp
+}
+
+// HTTPRequest is the check_request of the http method with defaults
+// applied.
+type HTTPRequest struct {
+	Method          string
+	Headers         map[string]string // "Host" overrides the request host
+	Body            string
+	FollowRedirects bool
+	MaxRedirects    int
+}
+
+// ThroughputSettings are the min_throughput settings the download and upload
+// methods share.
+type ThroughputSettings struct {
+	MinThroughput float64 // bytes per second; 0 disables the threshold
+	Action        string  // down (default) or degraded
+}
+
+// DownloadSettings are the settings of the download method, returned by its
+// Decode.
+type DownloadSettings struct {
+	URL     string
+	Timeout time.Duration
+	MinSize int64
+	MaxSize int64 // read cap; never below MinSize
+	ThroughputSettings
+}
+
+// UploadSettings are the settings of the upload method, returned by its
+// Decode.
+type UploadSettings struct {
+	URL     string
+	Timeout time.Duration
+	Size    int64
+	ThroughputSettings
+}
+
+// DNSSettings are the settings of the dns method, returned by its Decode.
+type DNSSettings struct {
+	Name       string
+	Server     string // host:port, or a URL for doh
+	Transport  string
+	RecordType string
+	Expected   []string
+}
+
+// WebSocketSettings are the settings of the websocket method, returned by its
+// Decode.
+type WebSocketSettings struct {
+	URL  string
+	Mode string // echo (default) or ping
+}
+
+// ExecSettings are the compiled settings of the exec method, returned by its
+// Decode.
+type ExecSettings struct {
+	Command    []string // argv of the probe
+	ValueRegex *regexp.Regexp
+}
+
+// ConcurrencySettings are the settings of the concurrency method, returned by
+// its Decode.
+type ConcurrencySettings struct {
+	Requests       int     // parallel requests
+	MinSuccess     float64 // fraction of them that must succeed
+	ExpectedStatus []StatusRange
+}
+
+// MethodRegistry resolves the check methods that check_method may name.
+type MethodRegistry interface {
+	LookupMethod(name string) (Method, bool)
+	// MethodNames returns the names of all methods in registration order.
+	MethodNames() []string
+}
+
+// MethodList is a MethodRegistry over a fixed list of methods.
+type MethodList []Method
+
+// LookupMethod returns the method in l called name.
+func (l MethodList) LookupMethod(name string) (Method, bool) {
+	for _, m := range l {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Method{}, false
+}
+
+// MethodNames returns the names of the methods in l.
+func (l MethodList) MethodNames() []string {
+	names := make([]string, len(l))
+	for i, m := range l {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// BuiltinMethods returns the configuration side of the built-in check
+// methods, in the order they are listed to users.
+func BuiltinMethods() []Method {
+	return []Method{
+		{Name: "ip", Validate: (*Tunnel).validateExitExpectations, Decode: decodeIP, builtin: true},
+		{Name: "http", Validate: validateHTTP, Decode: decodeHTTP, builtin: true},
+		{Name: "http3", Validate: validateHTTP3, Decode: decodeStatus, builtin: true},
+		{Name: "download", Validate: validateDownload, Decode: decodeDownload, builtin: true},
+		{Name: "upload", Validate: validateUpload, Decode: decodeUpload, builtin: true},
+		{Name: "dns", Validate: (*Tunnel).validateDNS, Decode: decodeDNS, builtin: true},
+		{Name: "websocket", Validate: validateWebSocket, Decode: decodeWebSocket, builtin: true},
+		{Name: "exec", Validate: validateExec, Decode: decodeExec, builtin: true},
+		{Name: "concurrency", Validate: validateConcurrency, Decode: decodeConcurrency, builtin: true},
+	}
+}
+
+// methods is the registry validation reads. The checker package replaces it
+// with its method table at init; until then only the built-in methods are
+// known.
+var methods = struct {
+	sync.RWMutex
+	registry MethodRegistry
+}{registry: MethodList(BuiltinMethods())}
+
+// SetMethodRegistry makes r the source of check methods for validation and
+// option decoding, and returns the previous one. The checker package calls it
+// at init with the table it also dispatches from.
+func SetMethodRegistry(r MethodRegistry) MethodRegistry {
+	methods.Lock()
+	defer methods.Unlock()
+	prev := methods.registry
+	methods.registry = r
+	return prev
+}
+
+// LookupMethod returns the registered check method called name.
+func LookupMethod(name string) (Method, bool) {
+	methods.RLock()
+	defer methods.RUnlock()
+	return methods.registry.LookupMethod(name)
+}
+
+// MethodNames returns the names of all registered check methods.
+func MethodNames() []string {
+	methods.RLock()
+	defer methods.RUnlock()
+	return methods.registry.MethodNames()
+}
+
+// DecodeOptions decodes opts into out, which must be a pointer, using the
+// yaml tags of out. Unknown keys are an error. It is meant for the Decode
+// function of a Method.
+func DecodeOptions(opts map[string]any, out any) error {
+	data, err := yaml.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(out); err != nil {
+		return fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	return nil
+}
+
+// DecodeMethod returns what the Decode of t's check method produces, or nil
+// if the method has no Decode. An empty check_method means the default one.
+func DecodeMethod(t *Tunnel) (any, error) {
+	name := cmp.Or(t.CheckMethod, metrics.DefaultCheckMethod)
+	m, ok := LookupMethod(name)
+	if !ok || m.Decode == nil {
+		return nil, nil
+	}
+	v, err := m.Decode(t)
+	if err != nil && !m.builtin {
+		return nil, fmt.Errorf("invalid options for check_method %s: %w", name, err)
+	}
+	return v, err
+}
+
+// methodTakesOptions reports whether the method called name reads the options
+// field, so that options set for another method are not handed to it.
+func methodTakesOptions(name string) bool {
+	m, ok := LookupMethod(name)
+	return ok && m.takesOptions()
+}
+
+// validateMethod checks that check_method names a registered method and
+// applies that method's own validation and decoding. An empty check_method
+// means the default one.
+func (t *Tunnel) validateMethod() []error {
+	name := cmp.Or(t.CheckMethod, metrics.DefaultCheckMethod)
+	m, ok := LookupMethod(name)
+	if !ok {
+		return []error{fmt.Errorf("invalid check_method %q: must be one of %s", name, strings.Join(MethodNames(), ", "))}
+	}
+
+	var errs []error
+	if m.Validate != nil {
+		errs = append(errs, m.Validate(t)...)
+	}
+	switch {
+	case len(t.Options) > 0 && !m.takesOptions():
+		errs = append(errs, fmt.Errorf("check_method %s takes no options", name))
+	case m.Decode != nil && len(errs) == 0:
+		// Decode may assume the settings Validate accepted.
+		if _, err := DecodeMethod(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// validateHTTP checks the response assertions and check_request of the http
+// method.
+func validateHTTP(t *Tunnel) []error {
+	_, errs := compileHTTPSettings(t)
+	return append(errs, t.CheckRequest.validate()...)
+}
+
+func decodeHTTP(t *Tunnel) (any, error) {
+	s, errs := compileHTTPSettings(t)
+	s.Request = &HTTPRequest{
+		Method:          cmp.Or(t.CheckRequest.Method, http.MethodGet),
+		Headers:         t.CheckRequest.Headers,
+		Body:            t.CheckRequest.Body,
+		FollowRedirects: t.CheckRequest.FollowRedirects == nil || *t.CheckRequest.FollowRedirects,
+		MaxRedirects:    cmp.Or(t.CheckRequest.MaxRedirects, metrics.DefaultMaxRedirects),
+	}
+	return s, errors.Join(errs...)
+}
+
+// compileHTTPSettings compiles expected_status, the body regexes and
+// expect_header.
+func compileHTTPSettings(t *Tunnel) (HTTPSettings, []error) {
+	var s HTTPSettings
+	var errs []error
+
+	var err error
+	if s.ExpectedStatus, err = ParseExpectedStatus(t.ExpectedStatus); err != nil {
+		errs = append(errs, fmt.Errorf("invalid expected_status: %v", err))
+	}
+	if t.ExpectBodyRegex != "" {
+		if s.ExpectBodyRegex, err = regexp.Compile(t.ExpectBodyRegex); err != nil {
+			errs = append(errs, fmt.Errorf("invalid expect_body_regex: %v", err))
+		}
+	}
+	if t.RejectBodyRegex != "" {
+		if s.RejectBodyRegex, err = regexp.Compile(t.RejectBodyRegex); err != nil {
+			errs = append(errs, fmt.Errorf("invalid reject_body_regex: %v", err))
+		}
+	}
+	for name, pattern := range t.ExpectHeader {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid expect_header %q: %v", name, err))
+			continue
+		}
+		if s.ExpectHeader == nil {
+			s.ExpectHeader = make(map[string]*regexp.Regexp, len(t.ExpectHeader))
+		}
+		s.ExpectHeader[name] = re
+	}
+
+	return s, errs
+}
+
+// decodeStatus compiles expected_status for the http3 method, which checks
+// only the status code.
+func decodeStatus(t *Tunnel) (any, error) {
+	status, err := ParseExpectedStatus(t.ExpectedStatus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected_status: %v", err)
+	}
+	return HTTPSettings{ExpectedStatus: status}, nil
+}
+
+// validateHTTP3 requires an https check_url, since HTTP/3 runs over TLS.
+func validateHTTP3(t *Tunnel) []error {
+	var errs []error
+	if !strings.HasPrefix(t.CheckURL, "https://") {
+		errs = append(errs, fmt.Errorf("invalid check_url for http3: must be https URL"))
+	}
+	if _, err := decodeStatus(t); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// decodeIP returns the ip method's settings.
+func decodeIP(t *Tunnel) (any, error) {
+	s := IPSettings{
+		URL:            cmp.Or(t.IPCheckURL, metrics.DefaultIPCheckURL),
+		ExpectedIPCIDR: t.ExpectedIPCIDR,
+	}
+	for _, c := range t.ExpectedCountry {
+		s.ExpectedCountry = append(s.ExpectedCountry, strings.ToUpper(c))
+	}
+	return s, nil
+}
+
+// validateConcurrency checks the concurrency_* fields and expected_status.
+func validateConcurrency(t *Tunnel) []error {
+	var errs []error
+	if t.Concurrency < 0 || t.Concurrency > metrics.MaxConcurrency {
+		errs = append(errs, fmt.Errorf("invalid concurrency %d: must be between 1 and %d", t.Concurrency, metrics.MaxConcurrency))
+	}
+	if t.ConcurrencyMinSuccess != nil && (*t.ConcurrencyMinSuccess < 0 || *t.ConcurrencyMinSuccess > 1) {
+		errs = append(errs, fmt.Errorf("invalid concurrency_min_success %v: must be between 0 and 1", *t.ConcurrencyMinSuccess))
+	}
+	if _, err := decodeStatus(t); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func decodeConcurrency(t *Tunnel) (any, error) {
+	status, err := ParseExpectedStatus(t.ExpectedStatus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected_status: %v", err)
+	}
+	s := ConcurrencySettings{
+		Requests:       cmp.Or(t.Concurrency, metrics.DefaultConcurrency),
+		MinSuccess:     metrics.DefaultConcurrencyMinSuccess,
+		ExpectedStatus: status,
+	}
+	if t.ConcurrencyMinSuccess != nil {
+		s.MinSuccess = *t.ConcurrencyMinSuccess
+	}
+	return s, nil
+}
+
+// validateDownload checks the download_* and throughput fields.
+func validateDownload(t *Tunnel) []error {
+	var errs []error
+	if t.DownloadTimeout != "" {
+		if _, err := time.ParseDuration(t.DownloadTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("invalid download_timeout: %v", err))
+		}
+	}
+	if minSize := cmp.Or(t.DownloadMinSize, metrics.DefaultDownloadMinSize); t.DownloadMaxSize != 0 && t.DownloadMaxSize < minSize {
+		errs = append(errs, fmt.Errorf("download_max_size %d is below download_min_size %d", t.DownloadMaxSize, minSize))
+	}
+	return append(errs, t.validateThroughput()...)
+}
+
+func decodeDownload(t *Tunnel) (any, error) {
+	timeout, err := time.ParseDuration(cmp.Or(t.DownloadTimeout, metrics.DefaultDownloadTimeout.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid download_timeout: %v", err)
+	}
+	throughput, err := decodeThroughput(t)
+	if err != nil {
+		return nil, err
+	}
+	minSize := cmp.Or(t.DownloadMinSize, metrics.DefaultDownloadMinSize)
+	return DownloadSettings{
+		URL:                cmp.Or(t.DownloadURL, metrics.DefaultDownloadURL),
+		Timeout:            timeout,
+		MinSize:            minSize,
+		MaxSize:            max(cmp.Or(t.DownloadMaxSize, metrics.DefaultDownloadMaxSize), minSize),
+		ThroughputSettings: throughput,
+	}, nil
+}
+
+// decodeThroughput returns min_throughput in bytes per second and its
+// action.
+func decodeThroughput(t *Tunnel) (ThroughputSettings, error) {
+	minThroughput, err := ParseThroughput(t.MinThroughput)
+	if err != nil {
+		return ThroughputSettings{}, fmt.Errorf("invalid min_throughput: %v", err)
+	}
+	return ThroughputSettings{
+		MinThroughput: minThroughput,
+		Action:        cmp.Or(t.MinThroughputAction, metrics.DefaultThroughputAction),
+	}, nil
+}
+
+// validateUpload checks the upload_* and throughput fields.
+func validateUpload(t *Tunnel) []error {
+	var errs []error
+	if t.UploadURL != "" {
+		if u, err := url.Parse(t.UploadURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid upload_url: must be http or https URL"))
+		}
+	}
+	if t.UploadTimeout != "" {
+		if _, err := time.ParseDuration(t.UploadTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("invalid upload_timeout: %v", err))
+		}
+	}
+	if t.UploadSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid upload_size %d: must not be negative", t.UploadSize))
+	}
+	return append(errs, t.validateThroughput()...)
+}
+
+func decodeUpload(t *Tunnel) (any, error) {
+	timeout, err := time.ParseDuration(cmp.Or(t.UploadTimeout, metrics.DefaultUploadTimeout.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload_timeout: %v", err)
+	}
+	throughput, err := decodeThroughput(t)
+	if err != nil {
+		return nil, err
+	}
+	return UploadSettings{
+		URL:                cmp.Or(t.UploadURL, metrics.DefaultUploadURL),
+		Timeout:            timeout,
+		Size:               cmp.Or(t.UploadSize, metrics.DefaultUploadSize),
+		ThroughputSettings: throughput,
+	}, nil
+}
+
+// decodeDNS returns the dns method's settings. Without a dns_server, the
+// transport's built-in resolver is used.
+func decodeDNS(t *Tunnel) (any, error) {
+	s := DNSSettings{
+		Name:       cmp.Or(t.DNSName, metrics.DefaultDNSName),
+		Server:     t.DNSServer,
+		Transport:  cmp.Or(t.DNSTransport, metrics.DefaultDNSTransport),
+		RecordType: cmp.Or(t.DNSRecordType, metrics.DefaultDNSRecordType),
+		Expected:   t.DNSExpected,
+	}
+	if s.Server == "" {
+		// DoH needs a URL rather than a host:port resolver address.
+		if s.Transport == "doh" {
+			s.Server = metrics.DefaultDoHServer
+		} else {
+			s.Server = metrics.DefaultDNSServer
+		}
+	}
+	return s, nil
+}
+
+// validateWebSocket checks the websocket_* fields.
+func validateWebSocket(t *Tunnel) []error {
+	var errs []error
+	if t.WebSocketURL != "" {
+		if u, err := url.Parse(t.WebSocketURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			errs = append(errs, fmt.Errorf("invalid websocket_url: must be ws or wss URL"))
+		}
+	}
+	switch t.WebSocketMode {
+	case "", "echo", "ping":
+		// valid
+	default:
+		errs = append(errs, fmt.Errorf("invalid websocket_mode %q: must be one of echo, ping", t.WebSocketMode))
+	}
+	return errs
+}
+
+func decodeWebSocket(t *Tunnel) (any, error) {
+	return WebSocketSettings{
+		URL:  cmp.Or(t.WebSocketURL, metrics.DefaultWebSocketURL),
+		Mode: cmp.Or(t.WebSocketMode, metrics.DefaultWebSocketMode),
+	}, nil
+}
+
+// validateExec requires the command the exec method runs and checks
+// exec_value_regex.
+func validateExec(t *Tunnel) []error {
+	var errs []error
+	if len(t.ExecCommand) == 0 || t.ExecCommand[0] == "" {
+		errs = append(errs, fmt.Errorf("check_method exec requires exec_command"))
+	}
+	if t.ExecValueRegex != "" {
+		if re, err := regexp.Compile(t.ExecValueRegex); err != nil {
+			errs = append(errs, fmt.Errorf("invalid exec_value_regex: %v", err))
+		} else if re.NumSubexp() > 1 {
+			errs = append(errs, fmt.Errorf("invalid exec_value_regex %q: at most one capture group is allowed", t.ExecValueRegex))
+		}
+	}
+	return errs
+}
+
+func decodeExec(t *Tunnel) (any, error) {
+	s := ExecSettings{Command: t.ExecCommand}
+	if t.ExecValueRegex != "" {
+		re, err := regexp.Compile(t.ExecValueRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exec_value_regex: %v", err)
+		}
+		s.ValueRegex = re
+	}
+	return s, nil
+}
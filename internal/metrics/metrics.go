@@ -5,11 +5,17 @@ package metrics
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
+	"regexp"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/batonogov/xray-health-exporter/internal/socks"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -24,12 +30,88 @@ const (
 	SocksDialTimeout     = 5 * time.Second
 	SocksStartupTimeout  = 10 * time.Second
 
+	// StopTimeout bounds how long stopping tunnels waits for their canceled
+	// checks to return.
+	StopTimeout = 5 * time.Second
+
 	// Check method defaults (issue #114).
 	DefaultCheckMethod     = "http"
 	DefaultIPCheckURL      = "https://api.ipify.org?format=text"
 	DefaultDownloadURL     = "https://proof.ovh.net/files/1Mb.dat"
 	DefaultDownloadTimeout = 60 * time.Second
 	DefaultDownloadMinSize = int64(51200)
+	DefaultDownloadMaxSize = int64(10 << 20)
+
+	// Upload check method defaults. The default sink is Cloudflare's
+	// speed-test upload endpoint, which accepts and discards POST bodies.
+	DefaultUploadURL     = "https://speed.cloudflare.com/__up"
+	DefaultUploadTimeout = 60 * time.Second
+	DefaultUploadSize    = int64(1 << 20)
+
+	// DefaultThroughputAction marks a download check below min_throughput
+	// as failed.
+	DefaultThroughputAction = "down"
+
+	// WebSocket check method defaults. The default target is a public echo
+	// server.
+	DefaultWebSocketURL  = "wss://echo.websocket.org"
+	DefaultWebSocketMode = "echo"
+
+	// Soak defaults: the long-lived connection goes to the same public echo
+	// server as the websocket method and exchanges a heartbeat every 30s.
+	DefaultSoakURL       = DefaultWebSocketURL
+	DefaultSoakHeartbeat = 30 * time.Second
+
+	// DNS check method defaults.
+	DefaultDNSName       = "www.google.com"
+	DefaultDNSServer     = "1.1.1.1:53"
+	DefaultDoHServer     = "https://cloudflare-dns.com/dns-query"
+	DefaultDNSTransport  = "tcp"
+	DefaultDNSRecordType = "A"
+
+	// MaxBodyMatchSize bounds how much of the response body the http method
+	// reads when expect_body_regex or reject_body_regex is configured.
+	MaxBodyMatchSize = int64(256 * 1024)
+
+	// DefaultMaxRedirects caps redirects followed by the http check method,
+	// matching the net/http client default.
+	DefaultMaxRedirects = 10
+
+	// Multi-sample defaults: one probe per check cycle, and a check passes
+	// only if none of its samples failed.
+	DefaultSamples = 1
+	DefaultMaxLoss = 0.0
+	MaxSamples     = 100
+
+	// Concurrency check method defaults: 10 parallel requests, all of which
+	// must succeed.
+	DefaultConcurrency           = 10
+	DefaultConcurrencyMinSuccess = 1.0
+	MaxConcurrency               = 100
+
+	// Baseline probe defaults.
+	DefaultBaselineInterval = 30 * time.Second
+	DefaultBaselineTimeout  = 10 * time.Second
+
+	// DefaultUpPolicy derives xray_tunnel_up from all of a tunnel's checks.
+	DefaultUpPolicy = "all"
+)
+
+// Check stages reported in the stage label of
+// xray_tunnel_stage_latency_seconds. The SOCKS stages share their names with
+// the error stages of xray_tunnel_error_total.
+const (
+	StageSOCKSDial = socks.StageDial    // TCP connect and method negotiation with the local SOCKS inbound
+	StageConnect   = socks.StageConnect // SOCKS CONNECT (or UDP ASSOCIATE) request until the reply
+	StageTLS       = "tls"              // TLS handshake with the target
+	StageFirstByte = "first_byte"       // request fully written until the first response byte
+)
+
+// Stages of the direct server probe, reported in the stage label of
+// xray_tunnel_server_up and xray_tunnel_server_latency_seconds.
+const (
+	ServerStageTCP = "tcp" // TCP connect to the server
+	ServerStageTLS = "tls" // TLS handshake with the server (security=tls)
 )
 
 var (
@@ -42,13 +124,22 @@ var (
 		[]string{"name", "server", "security", "sni"},
 	)
 
+	// TunnelCheckUp is 1 if the named check of a tunnel passed, 0 otherwise.
+	TunnelCheckUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_check_up",
+			Help: "1 if the named tunnel check passed, 0 otherwise",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
 	// TunnelLatency is the latency of the tunnel check in seconds.
 	TunnelLatency = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "xray_tunnel_latency_seconds",
 			Help: "Latency of the tunnel check in seconds",
 		},
-		[]string{"name", "server", "security", "sni"},
+		[]string{"name", "server", "security", "sni", "check"},
 	)
 
 	// TunnelLatencyHistogram is a histogram of tunnel check latencies.
@@ -58,6 +149,243 @@ var (
 			Help:    "Latency of the tunnel check in seconds (histogram for percentile queries via histogram_quantile)",
 			Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
 		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelStageLatency is a histogram of per-stage check timings.
+	TunnelStageLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "xray_tunnel_stage_latency_seconds",
+			Help:    "Duration of one stage of the tunnel check in seconds (socks_dial, connect, tls, first_byte)",
+			Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		},
+		[]string{"name", "server", "security", "sni", "check", "stage"},
+	)
+
+	// TunnelSampleLatency holds latency statistics over the successful
+	// samples of the last multi-sample check cycle.
+	TunnelSampleLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_sample_latency_seconds",
+			Help: "Latency statistic (min, avg, max, stddev) over the successful samples of the last check cycle",
+		},
+		[]string{"name", "server", "security", "sni", "check", "stat"},
+	)
+
+	// TunnelSampleLoss is the fraction of failed samples in the last
+	// multi-sample check cycle.
+	TunnelSampleLoss = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_sample_loss_ratio",
+			Help: "Fraction of failed samples in the last check cycle (0-1)",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelConcurrencySuccessRatio is the fraction of the parallel requests
+	// of the last concurrency check that succeeded.
+	TunnelConcurrencySuccessRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_concurrency_success_ratio",
+			Help: "Fraction of the parallel requests of the last concurrency check that succeeded (0-1)",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelConcurrencyLatency exposes latency quantiles over the successful
+	// parallel requests of the last concurrency check.
+	TunnelConcurrencyLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_concurrency_latency_seconds",
+			Help: "Latency quantile (0.5, 0.9, 0.99, 1) over the successful parallel requests of the last concurrency check",
+		},
+		[]string{"name", "server", "security", "sni", "check", "quantile"},
+	)
+
+	// TunnelConcurrencyMaxInFlight is the largest number of parallel requests
+	// of the last concurrency check that held a connection at the same time.
+	TunnelConcurrencyMaxInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_concurrency_max_in_flight",
+			Help: "Most parallel requests of the last concurrency check that were connected through the tunnel at once",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelExitInfo exposes the exit reported by the last ip check as
+	// labels; the value is always 1.
+	TunnelExitInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_exit_info",
+			Help: "Exit IP, country and ASN reported by the last ip check (value is always 1)",
+		},
+		[]string{"name", "server", "security", "sni", "check", "ip", "country", "asn"},
+	)
+
+	// TunnelExitIPChangesTotal counts changes of the exit IP between ip
+	// checks.
+	TunnelExitIPChangesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "xray_tunnel_exit_ip_changes_total",
+			Help: "Total number of exit IP changes observed by ip checks",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelProtocolInfo exposes the application protocol negotiated by the
+	// last http3 check.
+	TunnelProtocolInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_protocol_info",
+			Help: "Application protocol (ALPN) negotiated by the last http3 check (value is always 1)",
+		},
+		[]string{"name", "server", "security", "sni", "check", "protocol"},
+	)
+
+	// TunnelWebSocketRTT is the round-trip time of the message (or ping)
+	// exchanged by the last successful websocket check.
+	TunnelWebSocketRTT = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_websocket_rtt_seconds",
+			Help: "Round-trip time of the echo message or ping of the last successful websocket check, seconds",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelExecValue is the numeric value parsed from the output of the last
+	// exec check.
+	TunnelExecValue = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_exec_value",
+			Help: "Numeric value parsed from the output of the last exec check (with exec_value_regex)",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelServerUp is 1 if the direct probe of the tunnel's server, bypassing
+	// Xray, passed the stage (tcp connect or tls handshake).
+	TunnelServerUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_server_up",
+			Help: "1 if the direct probe of the tunnel's server passed the stage (tcp, tls), 0 otherwise; only for tunnels with server_probe",
+		},
+		[]string{"name", "server", "security", "sni", "stage"},
+	)
+
+	// TunnelServerLatency is the duration of the last successful stage of the
+	// direct server probe.
+	TunnelServerLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_server_latency_seconds",
+			Help: "Duration of the last successful stage (tcp, tls) of the direct server probe, seconds; only for tunnels with server_probe",
+		},
+		[]string{"name", "server", "security", "sni", "stage"},
+	)
+
+	// TunnelServerCertExpiry is the NotAfter time of the certificate presented
+	// by a tls-security server to the direct probe.
+	TunnelServerCertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_server_cert_expiry_timestamp_seconds",
+			Help: "Expiry (NotAfter) of the server certificate seen by the direct probe, Unix time; only for security=tls tunnels with server_probe",
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelServerCertInfo exposes the issuer of the server certificate.
+	TunnelServerCertInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_server_cert_info",
+			Help: "Issuer of the server certificate seen by the direct probe (value is always 1); only for security=tls tunnels with server_probe",
+		},
+		[]string{"name", "server", "security", "sni", "issuer"},
+	)
+
+	// TunnelServerCertSANMatch is 1 if the server certificate is valid for the
+	// tunnel's SNI (or one of its vcn names).
+	TunnelServerCertSANMatch = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_server_cert_san_match",
+			Help: "1 if the server certificate's names cover the SNI (or a vcn name), 0 otherwise; only for security=tls tunnels with server_probe",
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelRealityTargetUp is 1 if the camouflage target named by a REALITY
+	// tunnel's SNI completed a verified TLS 1.3 handshake.
+	TunnelRealityTargetUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_reality_target_up",
+			Help: "1 if the REALITY target (the SNI host) completed a verified TLS 1.3 handshake, 0 otherwise; only for security=reality tunnels with server_probe and an sni",
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelRealityTargetLatency is the duration of the last successful
+	// REALITY target handshake, including the TCP connect.
+	TunnelRealityTargetLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_reality_target_latency_seconds",
+			Help: "Duration of the last successful connect and TLS 1.3 handshake with the REALITY target, seconds; only for security=reality tunnels with server_probe and an sni",
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelSoakUp is 1 while the tunnel's soak connection is open.
+	TunnelSoakUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_soak_up",
+			Help: "1 while the long-lived soak connection through the tunnel is open, 0 otherwise",
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelSoakConnectionAge is how long the current soak connection has
+	// been open, updated on every heartbeat.
+	TunnelSoakConnectionAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_soak_connection_age_seconds",
+			Help: "Time the current soak connection has been open, seconds (0 while down)",
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelSoakConnectionLifetime records how long soak connections lasted
+	// before they dropped.
+	TunnelSoakConnectionLifetime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "xray_tunnel_soak_connection_lifetime_seconds",
+			Help:    "Lifetime of soak connections that dropped, seconds",
+			Buckets: []float64{10, 30, 60, 120, 300, 600, 1800, 3600, 10800},
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelSoakDropsTotal counts soak connections that dropped, by reason.
+	TunnelSoakDropsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "xray_tunnel_soak_drops_total",
+			Help: "Total number of soak connections that dropped, by reason",
+		},
+		[]string{"name", "server", "security", "sni", "reason"},
+	)
+
+	// TunnelSoakReconnectsTotal counts soak connections opened after the
+	// first one.
+	TunnelSoakReconnectsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "xray_tunnel_soak_reconnects_total",
+			Help: "Total number of soak connections re-established after a drop or a failed attempt",
+		},
+		[]string{"name", "server", "security", "sni"},
+	)
+
+	// TunnelSoakHeartbeatRTT is the round trip of the last soak heartbeat.
+	TunnelSoakHeartbeatRTT = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_soak_heartbeat_rtt_seconds",
+			Help: "Round trip of the last answered soak heartbeat, seconds",
+		},
 		[]string{"name", "server", "security", "sni"},
 	)
 
@@ -67,7 +395,7 @@ var (
 			Name: "xray_tunnel_check_total",
 			Help: "Total number of tunnel checks by result",
 		},
-		[]string{"name", "server", "security", "sni", "result"},
+		[]string{"name", "server", "security", "sni", "check", "result"},
 	)
 
 	// TunnelLastSuccess is the timestamp of the last successful tunnel check.
@@ -85,16 +413,125 @@ var (
 			Name: "xray_tunnel_http_status",
 			Help: "HTTP status code from tunnel check",
 		},
-		[]string{"name", "server", "security", "sni"},
+		[]string{"name", "server", "security", "sni", "check"},
 	)
 
-	// TunnelErrorTotal counts tunnel errors categorized by reason.
+	// TunnelDownloadThroughput is the transfer speed measured by the last
+	// download check, in bytes per second.
+	TunnelDownloadThroughput = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_download_throughput_bytes_per_second",
+			Help: "Download speed measured by the last download check, in bytes per second",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelDownloadThroughputHistogram is a histogram of download speeds.
+	TunnelDownloadThroughputHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "xray_tunnel_download_throughput_histogram_bytes_per_second",
+			Help:    "Download speed of the download check in bytes per second (histogram for percentile queries via histogram_quantile)",
+			Buckets: []float64{1e5, 2.5e5, 5e5, 1e6, 2.5e6, 5e6, 1e7, 2.5e7, 5e7, 1e8},
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelDownloadBytesTotal counts bytes received by download checks.
+	TunnelDownloadBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "xray_tunnel_download_bytes_total",
+			Help: "Total number of bytes received by download checks",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelUploadThroughput is the transfer speed measured by the last
+	// upload check, in bytes per second.
+	TunnelUploadThroughput = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_upload_throughput_bytes_per_second",
+			Help: "Upload speed measured by the last upload check, in bytes per second",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelUploadThroughputHistogram is a histogram of upload speeds.
+	TunnelUploadThroughputHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "xray_tunnel_upload_throughput_histogram_bytes_per_second",
+			Help:    "Upload speed of the upload check in bytes per second (histogram for percentile queries via histogram_quantile)",
+			Buckets: []float64{1e5, 2.5e5, 5e5, 1e6, 2.5e6, 5e6, 1e7, 2.5e7, 5e7, 1e8},
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelUploadBytesTotal counts bytes sent by upload checks.
+	TunnelUploadBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "xray_tunnel_upload_bytes_total",
+			Help: "Total number of bytes sent by upload checks",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelDegraded is 1 if the named check passed but was slower than
+	// min_throughput (min_throughput_action: degraded), 0 otherwise.
+	TunnelDegraded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_degraded",
+			Help: "1 if the named tunnel check passed below min_throughput, 0 otherwise",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// TunnelErrorTotal counts tunnel errors categorized by reason and stage.
 	TunnelErrorTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "xray_tunnel_error_total",
-			Help: "Total number of tunnel errors categorized by reason",
+			Help: "Total number of tunnel errors categorized by reason and the stage they occurred in",
 		},
-		[]string{"name", "server", "security", "sni", "reason"},
+		[]string{"name", "server", "security", "sni", "check", "reason", "stage"},
+	)
+
+	// TunnelLastErrorInfo exposes the last error of a failing check as
+	// labels; the value is always 1. The series is removed when the check
+	// passes again.
+	TunnelLastErrorInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_last_error_info",
+			Help: "Reason, stage and message of the last error of a failing tunnel check (value is always 1)",
+		},
+		[]string{"name", "server", "security", "sni", "check", "reason", "stage", "message"},
+	)
+
+	// TunnelLastErrorTimestamp is the Unix time of the last error of a
+	// failing tunnel check. Like TunnelLastErrorInfo, it is removed when the
+	// check passes again.
+	TunnelLastErrorTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_tunnel_last_error_timestamp_seconds",
+			Help: "Unix timestamp of the last error of a failing tunnel check",
+		},
+		[]string{"name", "server", "security", "sni", "check"},
+	)
+
+	// BaselineUp is 1 if the direct (non-proxied) probe of a target got an
+	// HTTP response, 0 otherwise.
+	BaselineUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_baseline_up",
+			Help: "1 if the direct probe of the target, bypassing all tunnels, got an HTTP response, 0 otherwise",
+		},
+		[]string{"target"},
+	)
+
+	// BaselineLatency is the TTFB of the last successful direct probe.
+	BaselineLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "xray_baseline_latency_seconds",
+			Help: "TTFB of the last successful direct probe of the target, seconds",
+		},
+		[]string{"target"},
 	)
 
 	// ExporterLeader is 1 if this instance is actively probing tunnels.
@@ -155,12 +592,48 @@ var (
 
 func init() {
 	prometheus.MustRegister(TunnelUp)
+	prometheus.MustRegister(TunnelCheckUp)
 	prometheus.MustRegister(TunnelLatency)
 	prometheus.MustRegister(TunnelLatencyHistogram)
+	prometheus.MustRegister(TunnelStageLatency)
+	prometheus.MustRegister(TunnelSampleLatency)
+	prometheus.MustRegister(TunnelSampleLoss)
+	prometheus.MustRegister(TunnelConcurrencySuccessRatio)
+	prometheus.MustRegister(TunnelConcurrencyLatency)
+	prometheus.MustRegister(TunnelConcurrencyMaxInFlight)
+	prometheus.MustRegister(TunnelExitInfo)
+	prometheus.MustRegister(TunnelExitIPChangesTotal)
+	prometheus.MustRegister(TunnelProtocolInfo)
+	prometheus.MustRegister(TunnelWebSocketRTT)
+	prometheus.MustRegister(TunnelExecValue)
+	prometheus.MustRegister(TunnelServerUp)
+	prometheus.MustRegister(TunnelServerLatency)
+	prometheus.MustRegister(TunnelServerCertExpiry)
+	prometheus.MustRegister(TunnelServerCertInfo)
+	prometheus.MustRegister(TunnelServerCertSANMatch)
+	prometheus.MustRegister(TunnelRealityTargetUp)
+	prometheus.MustRegister(TunnelRealityTargetLatency)
+	prometheus.MustRegister(TunnelSoakUp)
+	prometheus.MustRegister(TunnelSoakConnectionAge)
+	prometheus.MustRegister(TunnelSoakConnectionLifetime)
+	prometheus.MustRegister(TunnelSoakDropsTotal)
+	prometheus.MustRegister(TunnelSoakReconnectsTotal)
+	prometheus.MustRegister(TunnelSoakHeartbeatRTT)
 	prometheus.MustRegister(TunnelCheckTotal)
 	prometheus.MustRegister(TunnelLastSuccess)
 	prometheus.MustRegister(TunnelHTTPStatus)
 	prometheus.MustRegister(TunnelErrorTotal)
+	prometheus.MustRegister(TunnelLastErrorInfo)
+	prometheus.MustRegister(TunnelLastErrorTimestamp)
+	prometheus.MustRegister(TunnelDownloadThroughput)
+	prometheus.MustRegister(TunnelDownloadThroughputHistogram)
+	prometheus.MustRegister(TunnelDownloadBytesTotal)
+	prometheus.MustRegister(TunnelUploadThroughput)
+	prometheus.MustRegister(TunnelUploadThroughputHistogram)
+	prometheus.MustRegister(TunnelUploadBytesTotal)
+	prometheus.MustRegister(TunnelDegraded)
+	prometheus.MustRegister(BaselineUp)
+	prometheus.MustRegister(BaselineLatency)
 	prometheus.MustRegister(ExporterLeader)
 	prometheus.MustRegister(ExporterConfigReloadTotal)
 	prometheus.MustRegister(ExporterConfigReloadErrorsTotal)
@@ -204,18 +677,140 @@ var ErrorReasons = []string{
 	"connection_refused",
 	"connection_reset",
 	"bad_status",
+	"content_mismatch",
+	"low_throughput",
+	"unexpected_exit",
+	"exec_failed",
+	"connection_closed",
+	"host_unreachable",
+	"socks_auth",
 	"socks_error",
 	"unknown",
 }
 
+// Stages of a failed check, reported in the stage label of
+// xray_tunnel_error_total.
+const (
+	ErrorStageSOCKSDial    = socks.StageDial    // connecting or authenticating to the local SOCKS inbound
+	ErrorStageSOCKSConnect = socks.StageConnect // SOCKS CONNECT (or UDP ASSOCIATE) to the target
+	ErrorStageTLS          = "tls"              // TLS handshake with the target
+	ErrorStageHTTP         = "http"             // request and response headers after the tunnel is up
+	ErrorStageBody         = "body"             // reading the response body or exchanging messages
+	ErrorStageValidation   = "validation"       // the response arrived but failed an assertion
+	ErrorStageDNS          = "dns"              // DNS exchange of the dns method
+	ErrorStageExec         = "exec"             // running the exec method's command
+	ErrorStageUnknown      = "unknown"
+)
+
+// ErrorStages lists all stages reported in xray_tunnel_error_total. Keep in
+// sync with ErrorStage.
+var ErrorStages = []string{
+	ErrorStageSOCKSDial,
+	ErrorStageSOCKSConnect,
+	ErrorStageTLS,
+	ErrorStageHTTP,
+	ErrorStageBody,
+	ErrorStageValidation,
+	ErrorStageDNS,
+	ErrorStageExec,
+	ErrorStageUnknown,
+}
+
+// CheckError is a check failure tagged with the stage it happened in and,
+// where the checker knows it, its reason. Reason is one of ErrorReasons; if
+// empty, ClassifyError classifies Err instead. The message is Err's.
+type CheckError struct {
+	Stage  string
+	Reason string
+	Err    error
+}
+
+func (e *CheckError) Error() string { return e.Err.Error() }
+
+func (e *CheckError) Unwrap() error { return e.Err }
+
+// ErrorStage returns the stage of a check failure for the
+// xray_tunnel_error_total metric: the Stage of a wrapped CheckError or
+// socks.Error, or "unknown".
+func ErrorStage(err error) string {
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) && checkErr.Stage != "" {
+		return checkErr.Stage
+	}
+	var socksErr *socks.Error
+	if errors.As(err, &socksErr) {
+		return socksErr.Stage
+	}
+	return ErrorStageUnknown
+}
+
+// MaxErrorMessageLen bounds the message label of xray_tunnel_last_error_info,
+// in bytes.
+const MaxErrorMessageLen = 200
+
+// addrPatterns match IP addresses with an optional port: bracketed IPv6,
+// IPv4, then bare IPv6. Local ports are ephemeral, so they would make every
+// failure a new series.
+var addrPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\[[0-9A-Fa-f:.%]+\](:\d+)?`),
+	regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`),
+	regexp.MustCompile(`(?i)\b([0-9a-f]{0,4}:){2,7}[0-9a-f]{1,4}\b`),
+}
+
+// ErrorMessage returns err's message for the message label of
+// xray_tunnel_last_error_info: IP addresses and their ports replaced with
+// "<addr>", whitespace collapsed to single spaces and cut to
+// MaxErrorMessageLen bytes on a rune boundary.
+func ErrorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	for _, re := range addrPatterns {
+		msg = re.ReplaceAllString(msg, "<addr>")
+	}
+	msg = strings.Join(strings.Fields(msg), " ")
+	if len(msg) <= MaxErrorMessageLen {
+		return msg
+	}
+	n := MaxErrorMessageLen - len("...")
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n] + "..."
+}
+
 // ClassifyError determines the category of an error for the
-// xray_tunnel_error_total metric.
+// xray_tunnel_error_total metric. Typed errors are matched first; the
+// message heuristics only cover errors nothing has tagged.
 func ClassifyError(err error) string {
 	if err == nil {
 		return "unknown"
 	}
 
-	msg := err.Error()
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) && checkErr.Reason != "" {
+		return checkErr.Reason
+	}
+
+	// SOCKS5 replies and authentication failures from the local inbound
+	var replyErr *socks.ReplyError
+	if errors.As(err, &replyErr) {
+		switch replyErr.Code {
+		case socks.ReplyNetworkUnreachable, socks.ReplyHostUnreachable:
+			return "host_unreachable"
+		case socks.ReplyConnectionRefused:
+			return "connection_refused"
+		case socks.ReplyTTLExpired:
+			return "timeout"
+		default:
+			return "socks_error"
+		}
+	}
+	var authErr *socks.AuthError
+	if errors.As(err, &authErr) || errors.Is(err, socks.ErrNoAcceptableMethod) {
+		return "socks_auth"
+	}
 
 	// Timeout errors
 	if errors.Is(err, context.DeadlineExceeded) {
@@ -225,6 +820,51 @@ func ClassifyError(err error) string {
 	if errors.As(err, &netErr) && netErr.Timeout() {
 		return "timeout"
 	}
+
+	// Typed network and TLS errors
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	var (
+		alertErr     tls.AlertError
+		recordErr    tls.RecordHeaderError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &alertErr) || errors.As(err, &recordErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return "tls"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "connection_refused"
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return "connection_reset"
+	}
+
+	// Nothing typed matched: fall back to the message text, starting with
+	// the check-method assertions not tagged with a CheckError reason.
+	msg := err.Error()
+	if strings.Contains(msg, "content mismatch") {
+		return "content_mismatch"
+	}
+	if strings.Contains(msg, "bad status") {
+		return "bad_status"
+	}
+	if strings.Contains(msg, "below min_throughput") {
+		return "low_throughput"
+	}
+	if strings.Contains(msg, "unexpected exit") {
+		return "unexpected_exit"
+	}
+	if strings.Contains(msg, "exec command failed") {
+		return "exec_failed"
+	}
+
+	// Timeout errors
 	if strings.Contains(msg, "deadline exceeded") || strings.Contains(msg, "context deadline") ||
 		strings.Contains(msg, "i/o timeout") {
 		return "timeout"
@@ -257,6 +897,11 @@ func ClassifyError(err error) string {
 		return "connection_reset"
 	}
 
+	// Long-lived connection closed by the far end or by the path
+	if strings.Contains(msg, "connection closed") {
+		return "connection_closed"
+	}
+
 	// SOCKS5 proxy errors
 	if strings.Contains(msg, "SOCKS5") || strings.Contains(msg, "socks5") ||
 		strings.Contains(msg, "SOCKS") {
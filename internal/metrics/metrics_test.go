@@ -2,14 +2,21 @@ package metrics
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/batonogov/xray-health-exporter/internal/socks"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
@@ -57,6 +64,40 @@ func TestClassifyError(t *testing.T) {
 		{"SOCKS5 connect failed", fmt.Errorf("SOCKS5 connect failed: 5"), "socks_error"},
 		{"SOCKS connect failed lowercase", fmt.Errorf("socks5 proxy error"), "socks_error"},
 		{"SOCKS generic", fmt.Errorf("SOCKS protocol error"), "socks_error"},
+		{"SOCKS general failure reply", &socks.ReplyError{Code: socks.ReplyGeneralFailure}, "socks_error"},
+		{"SOCKS ruleset reply", fmt.Errorf("get: %w", &socks.ReplyError{Code: socks.ReplyNotAllowed}), "socks_error"},
+
+		// SOCKS reply codes with a more precise reason
+		{"SOCKS network unreachable", &socks.ReplyError{Code: socks.ReplyNetworkUnreachable}, "host_unreachable"},
+		{"SOCKS host unreachable", fmt.Errorf("get: %w", &socks.ReplyError{Code: socks.ReplyHostUnreachable}), "host_unreachable"},
+		{"SOCKS connection refused", &socks.ReplyError{Code: socks.ReplyConnectionRefused}, "connection_refused"},
+		{"SOCKS TTL expired", &socks.ReplyError{Code: socks.ReplyTTLExpired}, "timeout"},
+
+		// socks_auth
+		{"SOCKS auth rejected", &socks.AuthError{Status: 1}, "socks_auth"},
+		{"SOCKS no acceptable method", fmt.Errorf("dial: %w", socks.ErrNoAcceptableMethod), "socks_auth"},
+
+		// bad_status
+		{"http bad status", fmt.Errorf("bad status code: 404"), "bad_status"},
+		{"download bad status", fmt.Errorf("download returned bad status: 503"), "bad_status"},
+
+		// content_mismatch
+		{"body regex mismatch", fmt.Errorf("content mismatch: body does not match expect_body_regex \"ok\""), "content_mismatch"},
+		{"content mismatch beats tls substring", fmt.Errorf("content mismatch: body matches reject_body_regex \"tls: blocked\""), "content_mismatch"},
+
+		// low_throughput
+		{"below min throughput", fmt.Errorf("throughput 1000 B/s below min_throughput 50000 B/s"), "low_throughput"},
+
+		// unexpected_exit
+		{"wrong exit country", fmt.Errorf("unexpected exit country DE: want one of [NL]"), "unexpected_exit"},
+
+		// exec_failed
+		{"exec non-zero exit", fmt.Errorf("exec command failed: exit status 7 (stderr: curl: (7) Failed to connect)"), "exec_failed"},
+		{"exec stderr mentions a refused connection", fmt.Errorf("exec command failed: exit status 1 (stderr: connection refused)"), "exec_failed"},
+
+		// connection_closed
+		{"soak connection closed", fmt.Errorf("soak connection closed: websocket: close 1006 (abnormal closure): unexpected EOF"), "connection_closed"},
+		{"soak reset wins", fmt.Errorf("soak connection closed: read tcp: connection reset by peer"), "connection_reset"},
 
 		// unknown
 		{"generic error", fmt.Errorf("some random error"), "unknown"},
@@ -75,6 +116,102 @@ func TestClassifyError(t *testing.T) {
 	}
 }
 
+func TestClassifyError_Typed(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{"check error reason", &CheckError{Stage: ErrorStageValidation, Reason: "bad_status", Err: errors.New("ip check returned status 418")}, "bad_status"},
+		{"check error reason beats message", &CheckError{Stage: ErrorStageValidation, Reason: "content_mismatch", Err: errors.New("tls: blocked")}, "content_mismatch"},
+		{"wrapped check error reason", fmt.Errorf("3 of 8 failed: %w", &CheckError{Reason: "bad_status", Err: errors.New("x")}), "bad_status"},
+		{"check error without reason", &CheckError{Stage: ErrorStageHTTP, Err: errors.New("read: connection reset by peer")}, "connection_reset"},
+		{"dns error", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "server misbehaving", Name: "example.invalid"}}, "dns"},
+		{"unknown authority", fmt.Errorf("get: %w", x509.UnknownAuthorityError{}), "tls"},
+		{"tls alert", fmt.Errorf("get: %w", tls.AlertError(40)), "tls"},
+		{"refused errno", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection_refused"},
+		{"reset errno", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "connection_reset"},
+		{"socks stage wrapping a reply", &socks.Error{Stage: socks.StageConnect, Err: &socks.ReplyError{Code: socks.ReplyHostUnreachable}}, "host_unreachable"},
+		{"typed error beats assertion text", fmt.Errorf("exec command failed: %w", &socks.AuthError{}), "socks_auth"},
+		{"typed timeout beats assertion text", fmt.Errorf("bad status probe: %w", context.DeadlineExceeded), "timeout"},
+		{"socks reply beats assertion text", fmt.Errorf("content mismatch probe: %w", &socks.ReplyError{Code: socks.ReplyConnectionRefused}), "connection_refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyError(tt.err)
+			if got != tt.reason {
+				t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestErrorStage(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		stage string
+	}{
+		{"nil error", nil, ErrorStageUnknown},
+		{"untagged error", errors.New("some random error"), ErrorStageUnknown},
+		{"check error", &CheckError{Stage: ErrorStageValidation, Err: errors.New("bad status code: 500")}, ErrorStageValidation},
+		{"wrapped check error", fmt.Errorf("get: %w", &CheckError{Stage: ErrorStageBody, Err: io.ErrUnexpectedEOF}), ErrorStageBody},
+		{"socks dial", &socks.Error{Stage: socks.StageDial, Err: socks.ErrNoAcceptableMethod}, ErrorStageSOCKSDial},
+		{"socks connect in url error", fmt.Errorf("Get \"https://example.com\": %w", &socks.Error{Stage: socks.StageConnect, Err: io.EOF}), ErrorStageSOCKSConnect},
+		{"check error wins over socks", &CheckError{Stage: ErrorStageDNS, Err: &socks.Error{Stage: socks.StageConnect, Err: io.EOF}}, ErrorStageDNS},
+		{"check error without stage", &CheckError{Reason: "bad_status", Err: &socks.Error{Stage: socks.StageDial, Err: io.EOF}}, ErrorStageSOCKSDial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorStage(tt.err); got != tt.stage {
+				t.Errorf("ErrorStage(%v) = %q, want %q", tt.err, got, tt.stage)
+			}
+		})
+	}
+}
+
+func TestCheckError_Message(t *testing.T) {
+	inner := errors.New("bad status code: 503")
+	err := &CheckError{Stage: ErrorStageValidation, Reason: "bad_status", Err: inner}
+	if err.Error() != inner.Error() {
+		t.Errorf("Error() = %q, want %q", err.Error(), inner.Error())
+	}
+	if !errors.Is(err, inner) {
+		t.Error("CheckError does not unwrap to its cause")
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	long := strings.Repeat("a", MaxErrorMessageLen-4) + "ééé"
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil error", nil, ""},
+		{"short", errors.New("bad status code: 503"), "bad status code: 503"},
+		{"multi-line", errors.New("exec command failed: exit status 1 (stderr: line one\n\tline two)"), "exec command failed: exit status 1 (stderr: line one line two)"},
+		{"addresses and ports", errors.New("read tcp 127.0.0.1:51234->127.0.0.1:1080: i/o timeout"), "read tcp <addr>-><addr>: i/o timeout"},
+		{"ipv6 addresses", errors.New("dial tcp [2001:db8::1]:443: connect: network is unreachable (via fe80::1)"), "dial tcp <addr>: connect: network is unreachable (via <addr>)"},
+		{"host names kept", errors.New(`Get "https://example.com:8443/": EOF`), `Get "https://example.com:8443/": EOF`},
+		{"cut on a rune boundary", errors.New(long), strings.Repeat("a", MaxErrorMessageLen-4) + "..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ErrorMessage(tt.err)
+			if got != tt.want {
+				t.Errorf("ErrorMessage() = %q, want %q", got, tt.want)
+			}
+			if len(got) > MaxErrorMessageLen {
+				t.Errorf("ErrorMessage() is %d bytes, want at most %d", len(got), MaxErrorMessageLen)
+			}
+		})
+	}
+}
+
 func TestClassifyError_NetError(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -113,33 +250,54 @@ func TestMetricsUpdate(t *testing.T) {
 		"security": "tls",
 		"sni":      "test.example.com",
 	}
+	checkLabels := prometheus.Labels{
+		"name":     "metrics-test",
+		"server":   "test.example.com:443",
+		"security": "tls",
+		"sni":      "test.example.com",
+		"check":    "http",
+	}
 
 	t.Run("success metrics", func(t *testing.T) {
 		TunnelUp.With(labels).Set(1)
-		TunnelLatency.With(labels).Set(0.5)
+		TunnelCheckUp.With(checkLabels).Set(1)
+		TunnelLatency.With(checkLabels).Set(0.5)
 		TunnelLastSuccess.With(labels).Set(float64(time.Now().Unix()))
-		TunnelHTTPStatus.With(labels).Set(200)
+		TunnelHTTPStatus.With(checkLabels).Set(200)
 		TunnelCheckTotal.With(prometheus.Labels{
 			"name":     "metrics-test",
 			"server":   "test.example.com:443",
 			"security": "tls",
 			"sni":      "test.example.com",
+			"check":    "http",
 			"result":   "success",
 		}).Inc()
 	})
 
 	t.Run("failure metrics", func(t *testing.T) {
 		TunnelUp.With(labels).Set(0)
+		TunnelCheckUp.With(checkLabels).Set(0)
 		TunnelCheckTotal.With(prometheus.Labels{
 			"name":     "metrics-test",
 			"server":   "test.example.com:443",
 			"security": "tls",
 			"sni":      "test.example.com",
+			"check":    "http",
 			"result":   "failure",
 		}).Inc()
 	})
 }
 
+// withCheckLabel returns a copy of labels with the check label added.
+func withCheckLabel(labels prometheus.Labels, check string) prometheus.Labels {
+	out := make(prometheus.Labels, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out["check"] = check
+	return out
+}
+
 func TestMetricsLabels(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -177,8 +335,8 @@ func TestMetricsLabels(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			TunnelUp.With(tt.labels).Set(1)
-			TunnelLatency.With(tt.labels).Set(0.1)
-			TunnelHTTPStatus.With(tt.labels).Set(200)
+			TunnelLatency.With(withCheckLabel(tt.labels, "http")).Set(0.1)
+			TunnelHTTPStatus.With(withCheckLabel(tt.labels, "http")).Set(200)
 		})
 	}
 }
@@ -192,7 +350,7 @@ func TestMetricsReset(t *testing.T) {
 	}
 
 	TunnelUp.With(oldLabels).Set(1)
-	TunnelLatency.With(oldLabels).Set(0.5)
+	TunnelLatency.With(withCheckLabel(oldLabels, "http")).Set(0.5)
 
 	newLabels := prometheus.Labels{
 		"name":     "new-tunnel",
@@ -202,7 +360,7 @@ func TestMetricsReset(t *testing.T) {
 	}
 
 	TunnelUp.With(newLabels).Set(1)
-	TunnelLatency.With(newLabels).Set(0.3)
+	TunnelLatency.With(withCheckLabel(newLabels, "http")).Set(0.3)
 }
 
 func TestMetricsEndpoint(t *testing.T) {
@@ -214,8 +372,8 @@ func TestMetricsEndpoint(t *testing.T) {
 	}
 
 	TunnelUp.With(labels).Set(1)
-	TunnelLatency.With(labels).Set(0.123)
-	TunnelHTTPStatus.With(labels).Set(200)
+	TunnelLatency.With(withCheckLabel(labels, "http")).Set(0.123)
+	TunnelHTTPStatus.With(withCheckLabel(labels, "http")).Set(200)
 	TunnelLastSuccess.With(labels).Set(float64(time.Now().Unix()))
 
 	checkLabels := prometheus.Labels{
@@ -223,6 +381,7 @@ func TestMetricsEndpoint(t *testing.T) {
 		"server":   labels["server"],
 		"security": labels["security"],
 		"sni":      labels["sni"],
+		"check":    "http",
 		"result":   "success",
 	}
 	TunnelCheckTotal.With(checkLabels).Inc()
@@ -278,6 +437,7 @@ func TestLatencyHistogramMetric(t *testing.T) {
 		"server":   "histogram.example.com:443",
 		"security": "tls",
 		"sni":      "histogram.example.com",
+		"check":    "http",
 	}
 
 	for _, v := range []float64{0.05, 0.1, 0.15, 0.2, 0.3, 0.5} {
@@ -328,6 +488,7 @@ func TestLatencyHistogramBuckets(t *testing.T) {
 		"server":   "bucket.example.com:443",
 		"security": "tls",
 		"sni":      "bucket.example.com",
+		"check":    "http",
 	}
 
 	TunnelLatencyHistogram.With(labels).Observe(0.07)
@@ -368,7 +529,7 @@ func TestLatencyHistogramBuckets(t *testing.T) {
 
 func TestMetricsEndpoint_IncludesHistogram(t *testing.T) {
 	TunnelLatencyHistogram.With(prometheus.Labels{
-		"name": "hist-test", "server": "s:443", "security": "tls", "sni": "s",
+		"name": "hist-test", "server": "s:443", "security": "tls", "sni": "s", "check": "http",
 	}).Observe(0.1)
 
 	req := httptest.NewRequest("GET", "/metrics", nil)
@@ -5,16 +5,68 @@ package socks
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"strconv"
 	"time"
 )
 
+// SOCKS5 request commands (RFC 1928, section 4).
+const (
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+)
+
+// SOCKS5 address types (RFC 1928, section 5).
+const (
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+// SOCKS5 authentication methods (RFC 1928, section 3).
+const (
+	methodNoAuth       = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xff
+)
+
 // SOCKS5Dialer implements a minimal SOCKS5 client that connects through a
-// given SOCKS5 proxy address.
+// given SOCKS5 proxy address. Timeout bounds both the TCP connection to the
+// proxy and the handshake that follows.
 type SOCKS5Dialer struct {
 	ProxyAddr string
 	Timeout   time.Duration
+	// Username and Password are offered for username/password
+	// authentication (RFC 1929) when Username is set.
+	Username string
+	Password string
+}
+
+// DialTrace holds optional hooks that SOCKS5Dialer calls while dialing, in
+// the spirit of net/http/httptrace. Attach it to the dial context with
+// WithDialTrace.
+type DialTrace struct {
+	// ProxyHandshakeDone is called once the TCP connection to the proxy is
+	// open and method negotiation has finished, with the time both took.
+	ProxyHandshakeDone func(time.Duration)
+	// RequestDone is called when the proxy has replied to the CONNECT or
+	// UDP ASSOCIATE request, with the time since the request was sent.
+	RequestDone func(time.Duration)
+}
+
+type dialTraceKey struct{}
+
+// WithDialTrace returns a copy of ctx carrying trace for SOCKS5Dialer.
+func WithDialTrace(ctx context.Context, trace *DialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, trace)
+}
+
+// ContextDialTrace returns the DialTrace attached to ctx, or nil.
+func ContextDialTrace(ctx context.Context) *DialTrace {
+	trace, _ := ctx.Value(dialTraceKey{}).(*DialTrace)
+	return trace
 }
 
 // NewSOCKS5Dialer creates a SOCKS5 dialer for the given proxy address and timeout.
@@ -28,88 +80,214 @@ func NewSOCKS5Dialer(proxyAddr string, timeout time.Duration) *SOCKS5Dialer {
 // DialContext connects to addr through the SOCKS5 proxy, respecting the
 // cancellation and deadline of ctx.
 func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	// Connect to SOCKS5 proxy
-	conn, err := net.DialTimeout("tcp", d.ProxyAddr, d.Timeout)
+	conn, _, err := d.request(ctx, cmdConnect, addr)
+	return conn, err
+}
+
+// request opens a control connection to the proxy, authenticates and sends
+// a single command for addr. It returns the control connection together with
+// the bound address from the proxy's reply. Timings are reported to the
+// DialTrace attached to ctx, if any. Canceling ctx interrupts the handshake.
+func (d *SOCKS5Dialer) request(ctx context.Context, cmd byte, addr string) (net.Conn, *net.UDPAddr, error) {
+	dst, err := appendAddr(nil, addr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// SOCKS5 handshake: [VER, NMETHODS, METHODS]
-	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
-		conn.Close()
-		return nil, err
+	trace := ContextDialTrace(ctx)
+	start := time.Now()
+
+	// Connect to SOCKS5 proxy
+	dialer := net.Dialer{Timeout: d.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, nil, &Error{Stage: StageDial, Err: err}
 	}
 
-	// Read response: [VER, METHOD]
-	buf := make([]byte, 2)
-	if _, err := conn.Read(buf); err != nil {
-		conn.Close()
-		return nil, err
+	if d.Timeout > 0 {
+		_ = conn.SetDeadline(start.Add(d.Timeout))
 	}
+	if deadline, ok := ctx.Deadline(); ok && (d.Timeout <= 0 || deadline.Before(start.Add(d.Timeout))) {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
 
-	if buf[0] != 5 || buf[1] != 0 {
+	bound, err := d.handshake(conn, cmd, dst, trace, start)
+	if !stop() {
 		conn.Close()
-		return nil, fmt.Errorf("SOCKS5 handshake failed")
+		stage := StageConnect
+		if e, ok := err.(*Error); ok {
+			stage = e.Stage
+		}
+		return nil, nil, &Error{Stage: stage, Err: ctx.Err()}
 	}
-
-	// Parse target address
-	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
 
-	port, err := strconv.Atoi(portStr)
+// handshake negotiates authentication on conn, sends cmd for the encoded
+// address dst and reads the proxy's reply. Errors are *Error values naming
+// the step that failed.
+func (d *SOCKS5Dialer) handshake(conn net.Conn, cmd byte, dst []byte, trace *DialTrace, start time.Time) (*net.UDPAddr, error) {
+	if err := d.negotiate(conn); err != nil {
+		return nil, &Error{Stage: StageDial, Err: err}
+	}
+	if trace != nil && trace.ProxyHandshakeDone != nil {
+		trace.ProxyHandshakeDone(time.Since(start))
+	}
+
+	bound, err := sendRequest(conn, cmd, dst, trace)
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return nil, &Error{Stage: StageConnect, Err: err}
+	}
+	return bound, nil
+}
+
+// negotiate performs method negotiation and, if the proxy asks for it,
+// username/password authentication.
+func (d *SOCKS5Dialer) negotiate(conn net.Conn) error {
+	// SOCKS5 handshake: [VER, NMETHODS, METHODS]
+	greeting := []byte{5, 1, methodNoAuth}
+	if d.Username != "" {
+		greeting = []byte{5, 2, methodNoAuth, methodPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
 	}
 
-	// Send CONNECT request
-	req := []byte{5, 1, 0, 3, byte(len(host))}
-	req = append(req, []byte(host)...)
-	req = append(req, byte(port>>8), byte(port&0xff))
+	// Read response: [VER, METHOD]
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return fmt.Errorf("SOCKS5 handshake failed: unexpected version %d", buf[0])
+	}
+	switch {
+	case buf[1] == methodNoAuth:
+		return nil
+	case buf[1] == methodPassword && d.Username != "":
+		return d.authenticate(conn)
+	case buf[1] == methodNoAcceptable:
+		return ErrNoAcceptableMethod
+	default:
+		return fmt.Errorf("SOCKS5 handshake failed: unexpected method %d", buf[1])
+	}
+}
 
+// sendRequest sends cmd for the encoded address dst and reads the proxy's
+// reply, returning the bound address.
+func sendRequest(conn net.Conn, cmd byte, dst []byte, trace *DialTrace) (*net.UDPAddr, error) {
+	// Send request: [VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT]
+	req := append([]byte{5, cmd, 0}, dst...)
+	requestStart := time.Now()
 	if _, err := conn.Write(req); err != nil {
-		conn.Close()
 		return nil, err
 	}
 
-	// Read response
+	// Read response: [VER, REP, RSV, ATYP]
 	resp := make([]byte, 4)
-	if _, err := conn.Read(resp); err != nil {
-		conn.Close()
+	if _, err := io.ReadFull(conn, resp); err != nil {
 		return nil, err
 	}
 
+	if trace != nil && trace.RequestDone != nil {
+		trace.RequestDone(time.Since(requestStart))
+	}
+
 	if resp[1] != 0 {
-		conn.Close()
-		return nil, fmt.Errorf("SOCKS5 connect failed: %d", resp[1])
+		return nil, &ReplyError{Command: cmd, Code: resp[1]}
 	}
 
 	// Read remaining response (bound address and port)
-	switch resp[3] {
-	case 1: // IPv4
-		if _, err := conn.Read(make([]byte, 4+2)); err != nil {
-			conn.Close()
-			return nil, err
-		}
-	case 3: // Domain
-		lenBuf := make([]byte, 1)
-		if _, err := conn.Read(lenBuf); err != nil {
-			conn.Close()
-			return nil, err
+	return readAddr(conn, resp[3])
+}
+
+// authenticate performs the username/password subnegotiation of RFC 1929.
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return fmt.Errorf("SOCKS5 username and password must be at most 255 bytes")
+	}
+	req := []byte{1, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return &AuthError{Status: resp[1]}
+	}
+	return nil
+}
+
+// appendAddr appends addr in SOCKS5 form, [ATYP, ADDR, PORT], to b. IP
+// literals use their own address type, so the proxy does not resolve them.
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Zone() == "" {
+		if ip.Is4() {
+			b = append(b, atypIPv4)
+		} else {
+			b = append(b, atypIPv6)
 		}
-		if _, err := conn.Read(make([]byte, int(lenBuf[0])+2)); err != nil {
-			conn.Close()
-			return nil, err
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if host == "" || len(host) > 255 {
+			return nil, fmt.Errorf("SOCKS5 cannot address host %q: domain names must be 1 to 255 bytes", host)
 		}
-	case 4: // IPv6
-		if _, err := conn.Read(make([]byte, 16+2)); err != nil {
-			conn.Close()
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readAddr reads a [ADDR, PORT] pair of address type atyp from r.
+func readAddr(r io.Reader, atyp byte) (*net.UDPAddr, error) {
+	var n int
+	switch atyp {
+	case atypIPv4:
+		n = 4
+	case atypIPv6:
+		n = 16
+	case atypDomain:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
 			return nil, err
 		}
+		n = int(lenBuf[0])
+	default:
+		return nil, fmt.Errorf("SOCKS5 reply has unknown address type %d", atyp)
 	}
 
-	return conn, nil
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	addr := &net.UDPAddr{Port: int(b[n])<<8 | int(b[n+1])}
+	if atyp == atypDomain {
+		addr.IP = net.ParseIP(string(b[:n]))
+	} else {
+		addr.IP = net.IP(b[:n])
+	}
+	return addr, nil
 }
@@ -1,8 +1,12 @@
 package socks
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -724,3 +728,321 @@ func TestDialContext_DomainLenThenClose(t *testing.T) {
 		t.Error("expected error for partial domain response")
 	}
 }
+
+func TestDialContext_Trace(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Read(make([]byte, 3))
+		conn.Write([]byte{5, 0})
+		// CONNECT to "example.com:80": 4-byte header, length, domain, port.
+		conn.Read(make([]byte, 4+1+len("example.com")+2))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	var handshake, request time.Duration
+	ctx := WithDialTrace(context.Background(), &DialTrace{
+		ProxyHandshakeDone: func(d time.Duration) { handshake = d },
+		RequestDone:        func(d time.Duration) { request = d },
+	})
+
+	dialer := NewSOCKS5Dialer(listener.Addr().String(), 5*time.Second)
+	conn, err := dialer.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	conn.Close()
+
+	if handshake <= 0 {
+		t.Errorf("ProxyHandshakeDone duration = %v, want > 0", handshake)
+	}
+	if request < 50*time.Millisecond {
+		t.Errorf("RequestDone duration = %v, want >= 50ms", request)
+	}
+	if ContextDialTrace(context.Background()) != nil {
+		t.Error("ContextDialTrace() on a bare context should be nil")
+	}
+}
+
+// startOneShotProxy accepts a single connection on a local listener and hands
+// it to serve, returning the listener's address.
+func startOneShotProxy(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return listener.Addr().String()
+}
+
+func TestDialContext_AddressTypes(t *testing.T) {
+	tests := []struct {
+		addr string
+		want []byte
+	}{
+		{"192.0.2.1:80", []byte{1, 192, 0, 2, 1, 0, 80}},
+		{"[2001:db8::1]:443", []byte{4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187}},
+		{"example.com:8080", append(append([]byte{3, 11}, "example.com"...), 0x1f, 0x90)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got := make(chan []byte, 1)
+			socksAddr := startOneShotProxy(t, func(conn net.Conn) {
+				io.ReadFull(conn, make([]byte, 3))
+				conn.Write([]byte{5, 0})
+				req := make([]byte, 3+len(tt.want))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					got <- nil
+					return
+				}
+				got <- req[3:]
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			})
+
+			conn, err := NewSOCKS5Dialer(socksAddr, 5*time.Second).DialContext(context.Background(), "tcp", tt.addr)
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			conn.Close()
+			if req := <-got; !bytes.Equal(req, tt.want) {
+				t.Errorf("request address = %v, want %v", req, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialContext_PasswordAuth(t *testing.T) {
+	// serve offers password authentication and answers the subnegotiation
+	// with status, recording the greeting and credentials it received.
+	serve := func(status byte, greeting, creds chan<- []byte) func(net.Conn) {
+		return func(conn net.Conn) {
+			buf := make([]byte, 4)
+			io.ReadFull(conn, buf)
+			greeting <- buf
+			conn.Write([]byte{5, methodPassword})
+
+			hdr := make([]byte, 2)
+			io.ReadFull(conn, hdr)
+			user := make([]byte, hdr[1])
+			io.ReadFull(conn, user)
+			plen := make([]byte, 1)
+			io.ReadFull(conn, plen)
+			pass := make([]byte, plen[0])
+			io.ReadFull(conn, pass)
+			creds <- []byte(string(user) + ":" + string(pass))
+			conn.Write([]byte{1, status})
+			if status != 0 {
+				return
+			}
+
+			io.ReadFull(conn, make([]byte, 4+1+len("example.com")+2))
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		}
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		greeting, creds := make(chan []byte, 1), make(chan []byte, 1)
+		dialer := NewSOCKS5Dialer(startOneShotProxy(t, serve(0, greeting, creds)), 5*time.Second)
+		dialer.Username, dialer.Password = "alice", "s3cret"
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", "example.com:80")
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		conn.Close()
+		if g := <-greeting; !bytes.Equal(g, []byte{5, 2, methodNoAuth, methodPassword}) {
+			t.Errorf("greeting = %v, want no-auth and password methods", g)
+		}
+		if c := string(<-creds); c != "alice:s3cret" {
+			t.Errorf("credentials = %q, want alice:s3cret", c)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		greeting, creds := make(chan []byte, 1), make(chan []byte, 1)
+		dialer := NewSOCKS5Dialer(startOneShotProxy(t, serve(1, greeting, creds)), 5*time.Second)
+		dialer.Username, dialer.Password = "alice", "wrong"
+
+		_, err := dialer.DialContext(context.Background(), "tcp", "example.com:80")
+		var authErr *AuthError
+		if !errors.As(err, &authErr) || authErr.Status != 1 {
+			t.Errorf("DialContext() error = %v, want AuthError with status 1", err)
+		}
+	})
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		socksAddr := startOneShotProxy(t, func(conn net.Conn) {
+			io.ReadFull(conn, make([]byte, 3))
+			conn.Write([]byte{5, methodNoAcceptable})
+		})
+
+		_, err := NewSOCKS5Dialer(socksAddr, 5*time.Second).DialContext(context.Background(), "tcp", "example.com:80")
+		if !errors.Is(err, ErrNoAcceptableMethod) {
+			t.Errorf("DialContext() error = %v, want ErrNoAcceptableMethod", err)
+		}
+	})
+}
+
+func TestDialContext_ReplyError(t *testing.T) {
+	for code := ReplyGeneralFailure; code <= ReplyAddrTypeNotSupported; code++ {
+		socksAddr := startOneShotProxy(t, func(conn net.Conn) {
+			io.ReadFull(conn, make([]byte, 3))
+			conn.Write([]byte{5, 0})
+			io.ReadFull(conn, make([]byte, 4+4+2))
+			conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+		})
+
+		_, err := NewSOCKS5Dialer(socksAddr, 5*time.Second).DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) || replyErr.Code != code {
+			t.Errorf("reply %d: DialContext() error = %v, want ReplyError with that code", code, err)
+			continue
+		}
+		if strings.Contains(err.Error(), "unknown reply") {
+			t.Errorf("reply %d: error %q does not describe the code", code, err)
+		}
+	}
+}
+
+func TestDialContext_ErrorStage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name  string
+		addr  func() string
+		stage string
+	}{
+		{"proxy down", func() string { return closedAddr }, StageDial},
+		{"method rejected", func() string {
+			return startOneShotProxy(t, func(conn net.Conn) {
+				io.ReadFull(conn, make([]byte, 3))
+				conn.Write([]byte{5, methodNoAcceptable})
+			})
+		}, StageDial},
+		{"connect refused", func() string {
+			return startOneShotProxy(t, func(conn net.Conn) {
+				io.ReadFull(conn, make([]byte, 3))
+				conn.Write([]byte{5, 0})
+				io.ReadFull(conn, make([]byte, 4+4+2))
+				conn.Write([]byte{5, ReplyConnectionRefused, 0, 1, 0, 0, 0, 0, 0, 0})
+			})
+		}, StageConnect},
+		{"closed before reply", func() string {
+			return startOneShotProxy(t, func(conn net.Conn) {
+				io.ReadFull(conn, make([]byte, 3))
+				conn.Write([]byte{5, 0})
+				io.ReadFull(conn, make([]byte, 4+4+2))
+			})
+		}, StageConnect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSOCKS5Dialer(tt.addr(), 5*time.Second).DialContext(context.Background(), "tcp", "192.0.2.1:80")
+			var socksErr *Error
+			if !errors.As(err, &socksErr) {
+				t.Fatalf("DialContext() error = %v, want *Error", err)
+			}
+			if socksErr.Stage != tt.stage {
+				t.Errorf("stage = %q, want %q (error %v)", socksErr.Stage, tt.stage, err)
+			}
+		})
+	}
+}
+
+func TestDialContext_ContextCanceled(t *testing.T) {
+	stalled := make(chan struct{})
+	socksAddr := startOneShotProxy(t, func(conn net.Conn) {
+		// Accept the handshake but never answer it.
+		io.ReadFull(conn, make([]byte, 3))
+		<-stalled
+	})
+	defer close(stalled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := NewSOCKS5Dialer(socksAddr, 10*time.Second).DialContext(ctx, "tcp", "example.com:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("DialContext() error = %v, want context.Canceled", err)
+	}
+	var socksErr *Error
+	if !errors.As(err, &socksErr) || socksErr.Stage != StageDial {
+		t.Errorf("DialContext() error = %#v, want an *Error at stage %q", err, StageDial)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("DialContext() returned after %v, want it to stop on cancel", elapsed)
+	}
+}
+
+func TestDialContext_ContextDeadline(t *testing.T) {
+	stalled := make(chan struct{})
+	socksAddr := startOneShotProxy(t, func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, 3))
+		<-stalled
+	})
+	defer close(stalled)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := NewSOCKS5Dialer(socksAddr, 10*time.Second).DialContext(ctx, "tcp", "example.com:80")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext() error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestDialContext_PartialReads(t *testing.T) {
+	socksAddr := startOneShotProxy(t, func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, 3))
+		// Dribble every reply out one byte at a time.
+		for _, b := range []byte{5, 0} {
+			conn.Write([]byte{b})
+			time.Sleep(5 * time.Millisecond)
+		}
+		io.ReadFull(conn, make([]byte, 4+16+2))
+		for _, b := range []byte{5, 0, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0x04, 0x38} {
+			conn.Write([]byte{b})
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	d := NewSOCKS5Dialer(socksAddr, 5*time.Second)
+	conn, bound, err := d.request(context.Background(), cmdConnect, "[2001:db8::1]:443")
+	if err != nil {
+		t.Fatalf("request() error = %v", err)
+	}
+	conn.Close()
+	if bound.String() != "[2001:db8::2]:1080" {
+		t.Errorf("bound address = %v, want [2001:db8::2]:1080", bound)
+	}
+}
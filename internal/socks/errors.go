@@ -0,0 +1,86 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Stages of a dial reported in Error. The metrics package reports them under
+// the same names, in both error and latency stage labels.
+const (
+	// StageDial covers connecting to the proxy, method negotiation and
+	// authentication.
+	StageDial = "socks_dial"
+	// StageConnect covers the CONNECT or UDP ASSOCIATE request and the
+	// proxy's reply.
+	StageConnect = "connect"
+)
+
+// Error is returned by SOCKS5Dialer when the proxy cannot be reached or
+// fails a request. Stage names the step that failed; Err is the underlying
+// error, such as a *ReplyError, and also provides the message.
+type Error struct {
+	Stage string
+	Err   error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// SOCKS5 reply codes (RFC 1928, section 6).
+const (
+	ReplyGeneralFailure       byte = 1
+	ReplyNotAllowed           byte = 2
+	ReplyNetworkUnreachable   byte = 3
+	ReplyHostUnreachable      byte = 4
+	ReplyConnectionRefused    byte = 5
+	ReplyTTLExpired           byte = 6
+	ReplyCommandNotSupported  byte = 7
+	ReplyAddrTypeNotSupported byte = 8
+)
+
+var replyText = map[byte]string{
+	ReplyGeneralFailure:       "general SOCKS server failure",
+	ReplyNotAllowed:           "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:   "network unreachable",
+	ReplyHostUnreachable:      "host unreachable",
+	ReplyConnectionRefused:    "connection refused",
+	ReplyTTLExpired:           "TTL expired",
+	ReplyCommandNotSupported:  "command not supported",
+	ReplyAddrTypeNotSupported: "address type not supported",
+}
+
+// ErrNoAcceptableMethod is returned when the proxy accepts none of the
+// authentication methods offered, typically because it requires a password
+// that the dialer was not given.
+var ErrNoAcceptableMethod = errors.New("SOCKS5 handshake failed: no acceptable authentication method")
+
+// ReplyError is returned when the proxy answers a CONNECT or UDP ASSOCIATE
+// request with a failure reply.
+type ReplyError struct {
+	Command byte // cmdConnect or cmdUDPAssociate
+	Code    byte // one of the Reply constants
+}
+
+func (e *ReplyError) Error() string {
+	cmd := "connect"
+	if e.Command == cmdUDPAssociate {
+		cmd = "udp associate"
+	}
+	text, ok := replyText[e.Code]
+	if !ok {
+		text = "unknown reply"
+	}
+	return fmt.Sprintf("SOCKS5 %s failed: %s (%d)", cmd, text, e.Code)
+}
+
+// AuthError is returned when the proxy rejects the dialer's username and
+// password.
+type AuthError struct {
+	Status byte
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("SOCKS5 authentication failed: status %d", e.Status)
+}
@@ -0,0 +1,112 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// maxUDPHeaderLen is the largest SOCKS5 UDP request header: RSV(2), FRAG(1),
+// ATYP(1), a length-prefixed domain of up to 255 bytes and DST.PORT(2).
+const maxUDPHeaderLen = 4 + 1 + 255 + 2
+
+// DialUDP opens a SOCKS5 UDP ASSOCIATE session and returns a connection that
+// exchanges datagrams with addr through the proxy. The association is torn
+// down when the returned connection is closed.
+func (d *SOCKS5Dialer) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	// Header: [RSV, RSV, FRAG, ATYP, DST.ADDR, DST.PORT]
+	header, err := appendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, bound, err := d.request(ctx, cmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+
+	// Proxies commonly reply with an unspecified bind address, meaning
+	// "the address you used to reach me".
+	relay := *bound
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		proxyHost, _, err := net.SplitHostPort(d.ProxyAddr)
+		if err != nil {
+			ctrl.Close()
+			return nil, err
+		}
+		relay.IP = net.ParseIP(proxyHost)
+	}
+
+	pc, err := net.DialUDP("udp", nil, &relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	return &udpConn{UDPConn: pc, ctrl: ctrl, header: header}, nil
+}
+
+// udpConn relays datagrams to a single destination through a SOCKS5 UDP
+// association. Each datagram is prefixed with the SOCKS5 UDP request header
+// on write, and the header is stripped from replies on read.
+type udpConn struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	pkt := make([]byte, 0, len(c.header)+len(b))
+	pkt = append(pkt, c.header...)
+	pkt = append(pkt, b...)
+	if _, err := c.UDPConn.Write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+maxUDPHeaderLen)
+	n, err := c.UDPConn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	off, err := udpHeaderLen(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, buf[off:n]), nil
+}
+
+func (c *udpConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// udpHeaderLen returns the length of the SOCKS5 UDP header at the start of pkt.
+func udpHeaderLen(pkt []byte) (int, error) {
+	if len(pkt) < 4 {
+		return 0, fmt.Errorf("SOCKS5 udp packet too short")
+	}
+	if pkt[2] != 0 {
+		return 0, fmt.Errorf("SOCKS5 udp fragmentation not supported")
+	}
+	var n int
+	switch pkt[3] {
+	case atypIPv4:
+		n = 4 + 4 + 2
+	case atypDomain:
+		if len(pkt) < 5 {
+			return 0, fmt.Errorf("SOCKS5 udp packet too short")
+		}
+		n = 4 + 1 + int(pkt[4]) + 2
+	case atypIPv6:
+		n = 4 + 16 + 2
+	default:
+		return 0, fmt.Errorf("SOCKS5 udp packet has unknown address type %d", pkt[3])
+	}
+	if len(pkt) < n {
+		return 0, fmt.Errorf("SOCKS5 udp packet too short")
+	}
+	return n, nil
+}
@@ -0,0 +1,145 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// startMockUDPAssociate starts a SOCKS5 server that answers UDP ASSOCIATE
+// with the given reply code and relays every datagram through handle,
+// wrapping the answer in a SOCKS5 UDP header.
+func startMockUDPAssociate(t *testing.T, reply byte, handle func([]byte) []byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to create UDP relay: %v", err)
+	}
+	t.Cleanup(func() { relay.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			off, err := udpHeaderLen(buf[:n])
+			if err != nil {
+				continue
+			}
+			out := append([]byte{0, 0, 0, 1, 1, 1, 1, 1, 0, 53}, handle(buf[off:n])...)
+			relay.WriteToUDP(out, from)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+
+				buf := make([]byte, 3)
+				c.Read(buf)
+				c.Write([]byte{5, 0})
+
+				req := make([]byte, 4)
+				c.Read(req)
+				if req[1] != cmdUDPAssociate || req[3] != atypIPv4 {
+					return
+				}
+				c.Read(make([]byte, 4+2))
+
+				port := relay.LocalAddr().(*net.UDPAddr).Port
+				c.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, byte(port >> 8), byte(port & 0xff)})
+
+				// Keep the association alive until the client hangs up.
+				c.Read(make([]byte, 1))
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestDialUDP(t *testing.T) {
+	socksAddr := startMockUDPAssociate(t, 0, func(p []byte) []byte {
+		return bytes.ToUpper(p)
+	})
+
+	dialer := NewSOCKS5Dialer(socksAddr, 5*time.Second)
+	conn, err := dialer.DialUDP(context.Background(), "1.1.1.1:53")
+	if err != nil {
+		t.Fatalf("DialUDP() error = %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if got := string(buf[:n]); got != "PING" {
+		t.Errorf("Read() = %q, want %q", got, "PING")
+	}
+}
+
+func TestDialUDP_AssociateRejected(t *testing.T) {
+	socksAddr := startMockUDPAssociate(t, 7, func(p []byte) []byte { return p })
+
+	dialer := NewSOCKS5Dialer(socksAddr, 5*time.Second)
+	_, err := dialer.DialUDP(context.Background(), "1.1.1.1:53")
+	if err == nil {
+		t.Fatal("expected error when UDP ASSOCIATE is rejected")
+	}
+}
+
+func TestDialUDP_InvalidAddress(t *testing.T) {
+	dialer := NewSOCKS5Dialer("127.0.0.1:1080", time.Second)
+	if _, err := dialer.DialUDP(context.Background(), "invalid-address"); err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
+
+func TestUDPHeaderLen(t *testing.T) {
+	tests := []struct {
+		name    string
+		pkt     []byte
+		want    int
+		wantErr bool
+	}{
+		{"ipv4", []byte{0, 0, 0, 1, 1, 2, 3, 4, 0, 53, 'x'}, 10, false},
+		{"domain", []byte{0, 0, 0, 3, 1, 'a', 0, 53}, 8, false},
+		{"ipv6", append([]byte{0, 0, 0, 4}, make([]byte, 18)...), 22, false},
+		{"too short", []byte{0, 0}, 0, true},
+		{"fragmented", []byte{0, 0, 1, 1, 1, 2, 3, 4, 0, 53}, 0, true},
+		{"unknown atyp", []byte{0, 0, 0, 9, 0, 0}, 0, true},
+		{"truncated ipv4", []byte{0, 0, 0, 1, 1, 2}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := udpHeaderLen(tt.pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("udpHeaderLen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("udpHeaderLen() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
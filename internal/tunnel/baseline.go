@@ -0,0 +1,233 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+)
+
+// baselineFreshness is how old a baseline result may be before a failed
+// tunnel check asks Run for an early probe. It keeps a host outage that
+// begins between two periodic probes from going unnoticed for a whole
+// interval.
+const baselineFreshness = 5 * time.Second
+
+// Baseline probes the check targets directly, bypassing every tunnel. When
+// no target answers, the monitoring host itself is offline and tunnel
+// failures say nothing about the tunnels.
+type Baseline struct {
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+	refresh  chan struct{} // asks Run for a probe before the next tick
+
+	probing sync.Mutex // serializes probes and target changes
+
+	mu      sync.Mutex // guards the fields below
+	urls    []string
+	probed  time.Time
+	failing bool
+}
+
+// NewBaseline creates a baseline prober from cfg. Without configured URLs it
+// probes the distinct check_url of the given tunnels.
+func NewBaseline(cfg config.Baseline, tunnels []config.Tunnel) (*Baseline, error) {
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid baseline interval: %v", err)
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid baseline timeout: %v", err)
+	}
+
+	urls := baselineTargets(cfg, tunnels)
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("baseline has no targets")
+	}
+
+	return &Baseline{
+		urls:     urls,
+		interval: interval,
+		timeout:  timeout,
+		refresh:  make(chan struct{}, 1),
+		client: &http.Client{
+			// Never through a proxy from the environment: the point is to
+			// test the host's own connectivity.
+			Transport: &http.Transport{Proxy: nil},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// baselineTargets returns the configured URLs, or else the distinct check_url
+// of the tunnels.
+func baselineTargets(cfg config.Baseline, tunnels []config.Tunnel) []string {
+	urls := slices.Clone(cfg.URLs)
+	if len(urls) == 0 {
+		for _, t := range tunnels {
+			if t.CheckURL != "" && !slices.Contains(urls, t.CheckURL) {
+				urls = append(urls, t.CheckURL)
+			}
+		}
+	}
+	return urls
+}
+
+// SetTargets replaces the targets after a config reload, from the same
+// settings NewBaseline takes, and asks Run to probe the new set. The series
+// of targets that are no longer probed are deleted. Without any target the
+// current ones are kept and an error is returned.
+func (b *Baseline) SetTargets(cfg config.Baseline, tunnels []config.Tunnel) error {
+	urls := baselineTargets(cfg, tunnels)
+	if len(urls) == 0 {
+		return fmt.Errorf("baseline has no targets")
+	}
+
+	b.probing.Lock()
+	defer b.probing.Unlock()
+
+	b.mu.Lock()
+	old := b.urls
+	b.urls = urls
+	b.mu.Unlock()
+
+	for _, u := range old {
+		if !slices.Contains(urls, u) {
+			metrics.BaselineUp.DeleteLabelValues(u)
+			metrics.BaselineLatency.DeleteLabelValues(u)
+		}
+	}
+	b.requestProbe()
+	return nil
+}
+
+// Run probes the targets every interval, and when asked for an early probe,
+// until ctx is canceled.
+func (b *Baseline) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		b.Probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.refresh:
+		}
+	}
+}
+
+// Failing reports whether the last probe reached none of the targets. It
+// never probes itself; if the result is older than baselineFreshness, Run is
+// asked for a new one.
+func (b *Baseline) Failing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.probed) > baselineFreshness {
+		b.requestProbe()
+	}
+	return b.failing
+}
+
+// requestProbe asks Run for a probe without waiting for it.
+func (b *Baseline) requestProbe() {
+	select {
+	case b.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Probe probes all targets concurrently and records the result. The
+// baseline fails when no target gets an HTTP response; any status counts,
+// since only reachability matters.
+func (b *Baseline) Probe(ctx context.Context) {
+	b.probing.Lock()
+	defer b.probing.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	b.mu.Lock()
+	urls := b.urls
+	b.mu.Unlock()
+
+	ok := make([]bool, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latency, err := b.probeTarget(ctx, u)
+			if err != nil {
+				slog.Debug("baseline probe failed", "target", u, "error", err)
+				metrics.BaselineUp.WithLabelValues(u).Set(0)
+				return
+			}
+			ok[i] = true
+			metrics.BaselineUp.WithLabelValues(u).Set(1)
+			metrics.BaselineLatency.WithLabelValues(u).Set(latency.Seconds())
+		}()
+	}
+	wg.Wait()
+
+	failing := !slices.Contains(ok, true)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if failing != b.failing {
+		if failing {
+			slog.Warn("baseline probe FAILING: no target reachable without a tunnel", "targets", len(urls))
+		} else if !b.probed.IsZero() {
+			slog.Info("baseline probe recovered")
+		}
+	}
+	b.failing = failing
+	b.probed = time.Now()
+}
+
+// probeTarget sends a direct GET to u and returns the time until the
+// response headers arrived.
+func (b *Baseline) probeTarget(ctx context.Context, u string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return time.Since(start), nil
+}
+
+// WithBaseline wraps checker so that failed results are marked unknown while
+// the baseline is failing.
+func WithBaseline(checker HealthChecker, b *Baseline) HealthChecker {
+	return baselineChecker{checker: checker, baseline: b}
+}
+
+type baselineChecker struct {
+	checker  HealthChecker
+	baseline *Baseline
+}
+
+func (c baselineChecker) Check(ctx context.Context, ti *TunnelInstance) CheckResult {
+	r := c.checker.Check(ctx, ti)
+	if !r.Up && c.baseline.Failing() {
+		r.Unknown = true
+	}
+	return r
+}
@@ -0,0 +1,292 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/config"
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// failingChecker is a HealthChecker whose checks always fail.
+type failingChecker struct{}
+
+func (failingChecker) Check(_ context.Context, ti *TunnelInstance) CheckResult {
+	return CheckResult{Err: errors.New("connection refused")}
+}
+
+// closedURL returns the URL of a server that no longer accepts connections.
+func closedURL(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+func newTestBaseline(t *testing.T, urls ...string) *Baseline {
+	t.Helper()
+	b, err := NewBaseline(config.Baseline{URLs: urls, Interval: "30s", Timeout: "2s"}, nil)
+	if err != nil {
+		t.Fatalf("NewBaseline() error = %v", err)
+	}
+	t.Cleanup(func() {
+		for _, u := range urls {
+			metrics.BaselineUp.DeleteLabelValues(u)
+			metrics.BaselineLatency.DeleteLabelValues(u)
+		}
+	})
+	return b
+}
+
+func TestNewBaseline_Targets(t *testing.T) {
+	tunnels := []config.Tunnel{
+		{CheckSettings: config.CheckSettings{CheckURL: "https://www.google.com"}},
+		{CheckSettings: config.CheckSettings{CheckURL: "https://www.cloudflare.com"}},
+		{CheckSettings: config.CheckSettings{CheckURL: "https://www.google.com"}},
+	}
+	cfg := config.Baseline{Interval: "30s", Timeout: "10s"}
+
+	b, err := NewBaseline(cfg, tunnels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"https://www.google.com", "https://www.cloudflare.com"}; !slices.Equal(b.urls, want) {
+		t.Errorf("urls = %v, want the distinct check URLs %v", b.urls, want)
+	}
+
+	cfg.URLs = []string{"https://1.1.1.1"}
+	if b, _ = NewBaseline(cfg, tunnels); !slices.Equal(b.urls, cfg.URLs) {
+		t.Errorf("urls = %v, want configured %v", b.urls, cfg.URLs)
+	}
+
+	if _, err := NewBaseline(config.Baseline{Interval: "30s", Timeout: "10s"}, nil); err == nil {
+		t.Error("expected an error without targets")
+	}
+}
+
+func TestBaseline_Failing(t *testing.T) {
+	// Any HTTP response, including an error status, proves connectivity.
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer reachable.Close()
+	unreachable := closedURL(t)
+
+	tests := []struct {
+		name        string
+		urls        []string
+		wantFailing bool
+	}{
+		{"one target reachable", []string{unreachable, reachable.URL}, false},
+		{"no target reachable", []string{unreachable}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBaseline(t, tt.urls...)
+			b.Probe(context.Background())
+			if got := b.Failing(); got != tt.wantFailing {
+				t.Errorf("Failing() = %v, want %v", got, tt.wantFailing)
+			}
+
+			var m dto.Metric
+			if err := metrics.BaselineUp.WithLabelValues(unreachable).Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.GetGauge().GetValue(); got != 0 {
+				t.Errorf("xray_baseline_up{target=unreachable} = %v, want 0", got)
+			}
+		})
+	}
+}
+
+func TestBaseline_FailingReadsCachedResult(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			panic(http.ErrAbortHandler) // drop the connection without a response
+		}
+	}))
+	defer srv.Close()
+
+	b := newTestBaseline(t, srv.URL)
+	b.Probe(context.Background())
+	if b.Failing() {
+		t.Fatal("expected the baseline to pass while the target answers")
+	}
+
+	down.Store(true)
+	if b.Failing() {
+		t.Error("expected a fresh result to be reused without probing")
+	}
+	select {
+	case <-b.refresh:
+		t.Error("expected no probe request for a fresh result")
+	default:
+	}
+
+	b.probed = time.Now().Add(-2 * baselineFreshness)
+	if b.Failing() {
+		t.Error("expected a stale result to be returned without probing")
+	}
+	select {
+	case <-b.refresh:
+	default:
+		t.Error("expected a stale result to request a probe from Run")
+	}
+
+	b.Probe(context.Background())
+	if !b.Failing() {
+		t.Error("expected the next probe to notice the outage")
+	}
+}
+
+func TestBaseline_SetTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	removed := closedURL(t)
+
+	cfg := config.Baseline{Interval: "30s", Timeout: "2s"}
+	b, err := NewBaseline(cfg, []config.Tunnel{{CheckSettings: config.CheckSettings{CheckURL: removed}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.BaselineUp.DeleteLabelValues(srv.URL)
+	defer metrics.BaselineLatency.DeleteLabelValues(srv.URL)
+	b.Probe(context.Background())
+
+	if err := b.SetTargets(cfg, []config.Tunnel{{CheckSettings: config.CheckSettings{CheckURL: srv.URL}}}); err != nil {
+		t.Fatalf("SetTargets() error = %v", err)
+	}
+	if !slices.Equal(b.urls, []string{srv.URL}) {
+		t.Errorf("urls = %v, want the reloaded check URL", b.urls)
+	}
+	if metricExistsWithLabels(t, "xray_baseline_up", prometheus.Labels{"target": removed}) {
+		t.Error("expected the series of the removed target to be deleted")
+	}
+	select {
+	case <-b.refresh:
+	default:
+		t.Error("expected SetTargets to request a probe of the new targets")
+	}
+
+	if err := b.SetTargets(cfg, nil); err == nil {
+		t.Error("expected an error without targets")
+	}
+	if !slices.Equal(b.urls, []string{srv.URL}) {
+		t.Errorf("urls = %v, want the previous targets kept", b.urls)
+	}
+}
+
+func TestBaseline_Run(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	b := newTestBaseline(t, srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !metricExistsWithLabels(t, "xray_baseline_latency_seconds", prometheus.Labels{"target": srv.URL}) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected Run to probe the targets immediately")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestWithBaseline_MarksUnknown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	healthy := newTestBaseline(t, srv.URL)
+	offline := newTestBaseline(t, closedURL(t))
+	healthy.Probe(context.Background())
+	offline.Probe(context.Background())
+
+	if r := WithBaseline(failingChecker{}, healthy).Check(context.Background(), &TunnelInstance{}); r.Unknown {
+		t.Error("expected a failure with a healthy baseline to stay a failure")
+	}
+	if r := WithBaseline(mockChecker{}, offline).Check(context.Background(), &TunnelInstance{}); !r.Up || r.Unknown {
+		t.Error("expected a passing check to stay up with a failing baseline")
+	}
+	if r := WithBaseline(failingChecker{}, offline).Check(context.Background(), &TunnelInstance{}); !r.Unknown {
+		t.Error("expected a failure with a failing baseline to be unknown")
+	}
+}
+
+func TestCheckAndRecord_Unknown(t *testing.T) {
+	offline := newTestBaseline(t, closedURL(t))
+	offline.Probe(context.Background())
+	checker := WithBaseline(failingChecker{}, offline)
+
+	ti := &TunnelInstance{
+		Name:         "unknown-test",
+		MetricLabels: MetricLabels{Server: "unknown.example.com:443", Security: "tls", SNI: "unknown.example.com"},
+		CheckMethod:  "http",
+	}
+	c := ti.checkList()[0]
+	labels := prometheus.Labels{
+		"name": ti.Name, "server": c.Instance.MetricLabels.Server, "security": c.Instance.MetricLabels.Security,
+		"sni": c.Instance.MetricLabels.SNI, "check": c.Instance.MetricLabels.Check,
+	}
+	defer deleteCheckMetrics(labels)
+	defer metrics.TunnelUp.DeletePartialMatch(prometheus.Labels{"name": ti.Name})
+
+	status := newTunnelStatus(ti.UpPolicy, ti.checkList())
+	r := checkAndRecord(context.Background(), ti, c, status, checker, NewPrometheusMetrics())
+	if !r.Unknown {
+		t.Fatalf("expected an unknown result, got %+v", r)
+	}
+
+	if _, recorded := status.results[c.Name]; recorded {
+		t.Error("expected an unknown result to leave the check status unset")
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_error_total", labels) {
+		t.Error("expected no error to be counted for an unknown result")
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_check_up", labels) {
+		t.Error("expected check_up to be left unset for an unknown result")
+	}
+	unknownLabels := prometheus.Labels{"result": "unknown"}
+	maps.Copy(unknownLabels, labels)
+	if !metricExistsWithLabels(t, "xray_tunnel_check_total", unknownLabels) {
+		t.Error("expected xray_tunnel_check_total{result=\"unknown\"}")
+	}
+}
+
+func TestSampleCheck_Unknown(t *testing.T) {
+	checker := &scriptedChecker{results: []CheckResult{
+		{Up: true, Latency: time.Millisecond},
+		{Unknown: true, Err: errors.New("connection refused")},
+	}}
+	ti := &TunnelInstance{Samples: 2}
+
+	r, errs := sampleCheck(context.Background(), ti, checker)
+	if r.Up || !r.Unknown {
+		t.Errorf("got Up=%v Unknown=%v, want an unknown result", r.Up, r.Unknown)
+	}
+	if len(errs) != 0 {
+		t.Errorf("got %d errors, want none for an unknown result", len(errs))
+	}
+}
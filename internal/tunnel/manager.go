@@ -1,12 +1,15 @@
 package tunnel
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"math"
 	"math/rand/v2"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +27,7 @@ type TunnelManager struct {
 	config        *config.Config
 	checker       HealthChecker
 	metrics       MetricsUpdater
+	baseline      *Baseline // nil unless the baseline probe is enabled
 }
 
 // NewTunnelManager creates a TunnelManager with the given dependencies.
@@ -35,14 +39,9 @@ func NewTunnelManager(checker HealthChecker, mu MetricsUpdater) *TunnelManager {
 
 // InitTunnel creates and starts a single tunnel instance from config.
 func InitTunnel(tunnel *config.Tunnel, socksPort int) (*TunnelInstance, error) {
-	checkInterval, err := time.ParseDuration(tunnel.CheckInterval)
+	ti, err := newCheckInstance(tunnel)
 	if err != nil {
-		return nil, fmt.Errorf("invalid check_interval: %v", err)
-	}
-
-	checkTimeout, err := time.ParseDuration(tunnel.CheckTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("invalid check_timeout: %v", err)
+		return nil, err
 	}
 
 	maxBackoffStr := tunnel.MaxBackoff
@@ -62,34 +61,32 @@ func InitTunnel(tunnel *config.Tunnel, socksPort int) (*TunnelInstance, error) {
 		return nil, fmt.Errorf("backoff_multiplier must be >= 1.0, got %v", backoffMultiplier)
 	}
 
-	// Check method fields (issue #114).
-	checkMethod := tunnel.CheckMethod
-	if checkMethod == "" {
-		checkMethod = metrics.DefaultCheckMethod
-	}
-
-	ipCheckURL := tunnel.IPCheckURL
-	if ipCheckURL == "" {
-		ipCheckURL = metrics.DefaultIPCheckURL
+	upPolicy := tunnel.UpPolicy
+	if upPolicy == "" {
+		upPolicy = metrics.DefaultUpPolicy
 	}
 
-	downloadURL := tunnel.DownloadURL
-	if downloadURL == "" {
-		downloadURL = metrics.DefaultDownloadURL
+	soakURL := cmp.Or(tunnel.SoakURL, metrics.DefaultSoakURL)
+	soakHeartbeat, err := time.ParseDuration(cmp.Or(tunnel.SoakHeartbeat, metrics.DefaultSoakHeartbeat.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid soak_heartbeat: %v", err)
 	}
 
-	downloadTimeoutStr := tunnel.DownloadTimeout
-	if downloadTimeoutStr == "" {
-		downloadTimeoutStr = metrics.DefaultDownloadTimeout.String()
-	}
-	downloadTimeout, err := time.ParseDuration(downloadTimeoutStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid download_timeout: %v", err)
+	var checks []TunnelCheck
+	for _, c := range tunnel.Checks {
+		ct := tunnel.WithCheck(c)
+		ci, err := newCheckInstance(&ct)
+		if err != nil {
+			return nil, fmt.Errorf("check %q: %v", c.Name, err)
+		}
+		checks = append(checks, TunnelCheck{Name: c.Name, Required: c.Required, Instance: ci})
 	}
 
-	downloadMinSize := tunnel.DownloadMinSize
-	if downloadMinSize == 0 {
-		downloadMinSize = metrics.DefaultDownloadMinSize
+	var socksAuth *SOCKSCredentials
+	if tunnel.SocksAuth == nil || *tunnel.SocksAuth {
+		if socksAuth, err = NewSOCKSCredentials(); err != nil {
+			return nil, err
+		}
 	}
 
 	var xrayConfigJSON []byte
@@ -98,7 +95,7 @@ func InitTunnel(tunnel *config.Tunnel, socksPort int) (*TunnelInstance, error) {
 
 	if tunnel.XrayConfigFile != "" {
 		// xray_config_file mode
-		xrayConfigJSON, metricLabels, err = LoadXrayConfigFile(tunnel.XrayConfigFile, socksPort)
+		xrayConfigJSON, metricLabels, err = LoadXrayConfigFile(tunnel.XrayConfigFile, socksPort, socksAuth)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load xray config file: %v", err)
 		}
@@ -115,7 +112,7 @@ func InitTunnel(tunnel *config.Tunnel, socksPort int) (*TunnelInstance, error) {
 			SNI:      vlessConfig.SNI,
 		}
 
-		xrayConfigJSON, err = CreateXrayConfig(vlessConfig, socksPort)
+		xrayConfigJSON, err = CreateXrayConfig(vlessConfig, socksPort, socksAuth)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create Xray config: %v", err)
 		}
@@ -137,25 +134,114 @@ func InitTunnel(tunnel *config.Tunnel, socksPort int) (*TunnelInstance, error) {
 		}
 	}
 
+	ti.Name = name
+	ti.VLESSConfig = vlessConfig
+	ti.MetricLabels = metricLabels
+	ti.XrayInstance = xrayInstance
+	ti.SocksPort = socksPort
+	ti.SocksAuth = socksAuth
+	ti.MaxBackoff = maxBackoff
+	ti.BackoffMultiplier = backoffMultiplier
+	ti.UpPolicy = upPolicy
+	ti.ServerProbe = tunnel.ServerProbe != nil && *tunnel.ServerProbe
+	ti.Soak = tunnel.Soak != nil && *tunnel.Soak
+	ti.SoakURL = soakURL
+	ti.SoakHeartbeat = soakHeartbeat
+	ti.Checks = checks
+	ti.bindChecks()
+
+	return ti, nil
+}
+
+// newCheckInstance parses the check settings of tunnel (interval, timeout,
+// method and its parameters) into a TunnelInstance without tunnel identity.
+// InitTunnel fills in the rest.
+func newCheckInstance(tunnel *config.Tunnel) (*TunnelInstance, error) {
+	checkInterval, err := time.ParseDuration(tunnel.CheckInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check_interval: %v", err)
+	}
+
+	checkTimeout, err := time.ParseDuration(tunnel.CheckTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check_timeout: %v", err)
+	}
+
+	// Check method fields (issue #114).
+	checkMethod := tunnel.CheckMethod
+	if checkMethod == "" {
+		checkMethod = metrics.DefaultCheckMethod
+	}
+
+	samples := tunnel.Samples
+	if samples == 0 {
+		samples = metrics.DefaultSamples
+	}
+
+	var sampleInterval time.Duration
+	if tunnel.SampleInterval != "" {
+		sampleInterval, err = time.ParseDuration(tunnel.SampleInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample_interval: %v", err)
+		}
+	}
+
+	maxLoss := metrics.DefaultMaxLoss
+	if tunnel.MaxLoss != nil {
+		maxLoss = *tunnel.MaxLoss
+	}
+
+	// The method compiles the settings only it uses.
+	methodConfig, err := config.DecodeMethod(tunnel)
+	if err != nil {
+		return nil, err
+	}
+
 	return &TunnelInstance{
-		Name:              name,
-		VLESSConfig:       vlessConfig,
-		MetricLabels:      metricLabels,
-		XrayInstance:      xrayInstance,
-		SocksPort:         socksPort,
-		CheckURL:          tunnel.CheckURL,
-		CheckInterval:     checkInterval,
-		CheckTimeout:      checkTimeout,
-		MaxBackoff:        maxBackoff,
-		BackoffMultiplier: backoffMultiplier,
-		CheckMethod:       checkMethod,
-		IPCheckURL:        ipCheckURL,
-		DownloadURL:       downloadURL,
-		DownloadTimeout:   downloadTimeout,
-		DownloadMinSize:   downloadMinSize,
+		CheckURL:       tunnel.CheckURL,
+		CheckInterval:  checkInterval,
+		CheckTimeout:   checkTimeout,
+		CheckMethod:    checkMethod,
+		Samples:        samples,
+		SampleInterval: sampleInterval,
+		MaxLoss:        maxLoss,
+		MethodConfig:   methodConfig,
 	}, nil
 }
 
+// bindChecks copies the tunnel identity, Xray instance, SOCKS port,
+// credentials and backoff settings into every check instance and sets its
+// check label.
+func (ti *TunnelInstance) bindChecks() {
+	for _, c := range ti.Checks {
+		ci := c.Instance
+		ci.Name = ti.Name
+		ci.VLESSConfig = ti.VLESSConfig
+		ci.MetricLabels = ti.MetricLabels
+		ci.MetricLabels.Check = c.Name
+		ci.XrayInstance = ti.XrayInstance
+		ci.SocksPort = ti.SocksPort
+		ci.SocksAuth = ti.SocksAuth
+		ci.MaxBackoff = ti.MaxBackoff
+		ci.BackoffMultiplier = ti.BackoffMultiplier
+	}
+}
+
+// checkList returns the checks to run for ti. A tunnel without a checks list
+// has a single required check named after its method.
+func (ti *TunnelInstance) checkList() []TunnelCheck {
+	if len(ti.Checks) > 0 {
+		return ti.Checks
+	}
+	method := ti.CheckMethod
+	if method == "" {
+		method = metrics.DefaultCheckMethod
+	}
+	ci := *ti
+	ci.MetricLabels.Check = method
+	return []TunnelCheck{{Name: method, Required: true, Instance: &ci}}
+}
+
 // createTunnelInstances creates and starts all tunnel instances from config,
 // assigns SOCKS ports, and waits for the ports to become ready. It does NOT
 // start periodic checker goroutines — that is the caller's responsibility.
@@ -223,7 +309,8 @@ func createTunnelInstances(cfg *config.Config, baseSocksPort int) ([]*TunnelInst
 }
 
 // InitializeTunnels creates and starts all tunnel instances from config and
-// launches periodic checker goroutines for each.
+// launches periodic checker goroutines for each, plus the soak connection of
+// tunnels that enable it.
 // Returns the instances and the next available auto-port (past all assigned auto-ports).
 func InitializeTunnels(cfg *config.Config, baseSocksPort int, checker HealthChecker, mu MetricsUpdater) ([]*TunnelInstance, int, error) {
 	tunnelInstances, nextAutoPort, err := createTunnelInstances(cfg, baseSocksPort)
@@ -233,15 +320,41 @@ func InitializeTunnels(cfg *config.Config, baseSocksPort int, checker HealthChec
 
 	// Start checker goroutines for all tunnels
 	for _, ti := range tunnelInstances {
-		ctx, cancel := context.WithCancel(context.Background())
-		ti.cancelFunc = cancel
-		go RunTunnelChecker(ctx, ti, checker, mu)
+		startChecks(ti, checker, mu)
 	}
 
 	return tunnelInstances, nextAutoPort, nil
 }
 
-// StopTunnels gracefully stops all tunnel instances.
+// startChecks launches the checker goroutine of ti, and its soak connection
+// if enabled, until StopTunnels cancels them.
+func startChecks(ti *TunnelInstance, checker HealthChecker, mu MetricsUpdater) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ti.cancelFunc = cancel
+	ti.done = make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		RunTunnelChecker(ctx, ti, checker, mu)
+	}()
+	if ti.Soak {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RunSoak(ctx, ti, mu)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ti.done)
+	}()
+}
+
+// StopTunnels gracefully stops all tunnel instances. In-flight checks are
+// canceled, and StopTunnels waits up to metrics.StopTimeout for them to
+// return, so that none records metrics after the tunnel is gone.
 func StopTunnels(instances []*TunnelInstance) {
 	for _, ti := range instances {
 		if ti.cancelFunc != nil {
@@ -251,37 +364,258 @@ func StopTunnels(instances []*TunnelInstance) {
 			ti.XrayInstance.Close()
 		}
 	}
+
+	timeout := time.NewTimer(metrics.StopTimeout)
+	defer timeout.Stop()
+	for _, ti := range instances {
+		if ti.done == nil {
+			continue
+		}
+		select {
+		case <-ti.done:
+		case <-timeout.C:
+			slog.Warn("tunnel checks did not stop in time", "tunnel", ti.Name, "timeout", metrics.StopTimeout)
+			return
+		}
+	}
+}
+
+// tunnelStatus tracks the latest result of every check of one tunnel and
+// derives the tunnel-level status from its up policy.
+type tunnelStatus struct {
+	mu      sync.Mutex
+	policy  string
+	checks  []TunnelCheck
+	results map[string]bool
+}
+
+func newTunnelStatus(policy string, checks []TunnelCheck) *tunnelStatus {
+	return &tunnelStatus{policy: policy, checks: checks, results: make(map[string]bool, len(checks))}
+}
+
+// record stores the result of the named check and returns whether the
+// tunnel is up. Checks that have not run yet do not affect the outcome.
+func (s *tunnelStatus) record(check string, up bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[check] = up
+	return evaluateUpPolicy(s.policy, s.checks, s.results)
+}
+
+// evaluateUpPolicy derives the tunnel status from per-check results:
+// "all" (default) needs every check up, "any" needs at least one, and
+// "required" needs every check marked required. Checks missing from results
+// have not run yet and are ignored.
+func evaluateUpPolicy(policy string, checks []TunnelCheck, results map[string]bool) bool {
+	anyUp := false
+	for _, c := range checks {
+		up, ok := results[c.Name]
+		if !ok {
+			continue
+		}
+		if up {
+			anyUp = true
+			continue
+		}
+		if policy == "all" || policy == "" || (policy == "required" && c.Required) {
+			return false
+		}
+	}
+	if policy == "any" {
+		return anyUp
+	}
+	return true
+}
+
+// sampleCheck runs the check of ci ci.Samples times, ci.SampleInterval
+// apart, and folds the samples into one result. The result is up when at
+// least one sample passed and the fraction of failed samples does not exceed
+// ci.MaxLoss. With a single sample the checker's result is returned as is.
+// The errors of failed samples are returned for error accounting, unless the
+// result is unknown because a sample failed while the baseline was failing.
+func sampleCheck(ctx context.Context, ci *TunnelInstance, checker HealthChecker) (CheckResult, []error) {
+	if ci.Samples <= 1 {
+		r := checker.Check(ctx, ci)
+		if !r.Up && !r.Unknown && r.Err != nil {
+			return r, []error{r.Err}
+		}
+		return r, nil
+	}
+
+	var (
+		agg          CheckResult
+		stats        SampleStats
+		errs         []error
+		dlSum, ulSum float64
+		dlN, ulN     int
+		unknown      bool
+	)
+	for i := range ci.Samples {
+		if i > 0 && ci.SampleInterval > 0 {
+			timer := time.NewTimer(ci.SampleInterval)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if i > 0 && ctx.Err() != nil {
+			break
+		}
+
+		r := checker.Check(ctx, ci)
+		stats.Count++
+		agg.BytesDownloaded += r.BytesDownloaded
+		agg.BytesUploaded += r.BytesUploaded
+		if r.HTTPStatus > 0 {
+			agg.HTTPStatus = r.HTTPStatus
+		}
+		if r.Stages != nil {
+			agg.Stages = r.Stages
+		}
+		if r.Exit != nil {
+			agg.Exit = r.Exit
+		}
+		if r.Concurrency != nil {
+			agg.Concurrency = r.Concurrency
+		}
+		if !r.Up {
+			stats.Failed++
+			unknown = unknown || r.Unknown
+			if r.Err != nil {
+				errs = append(errs, r.Err)
+			}
+			continue
+		}
+		stats.Latencies = append(stats.Latencies, r.Latency)
+		agg.Degraded = agg.Degraded || r.Degraded
+		if r.DownloadThroughput > 0 {
+			dlSum += r.DownloadThroughput
+			dlN++
+		}
+		if r.UploadThroughput > 0 {
+			ulSum += r.UploadThroughput
+			ulN++
+		}
+	}
+
+	agg.Samples = &stats
+	_, agg.Latency, _, _ = stats.LatencyStats()
+	if dlN > 0 {
+		agg.DownloadThroughput = dlSum / float64(dlN)
+	}
+	if ulN > 0 {
+		agg.UploadThroughput = ulSum / float64(ulN)
+	}
+
+	agg.Up = len(stats.Latencies) > 0 && stats.Loss() <= ci.MaxLoss
+	if !agg.Up {
+		agg.Degraded = false
+		agg.Err = fmt.Errorf("%d of %d samples failed (max_loss %g)", stats.Failed, stats.Count, ci.MaxLoss)
+		if len(errs) > 0 {
+			agg.Err = fmt.Errorf("%w: %w", agg.Err, errs[len(errs)-1])
+		}
+		if unknown {
+			agg.Unknown = true
+			return agg, nil
+		}
+	}
+	return agg, errs
 }
 
-// checkAndRecord performs a single health-check through the given checker and
-// records the result via metrics, with appropriate logging.
-func checkAndRecord(ti *TunnelInstance, checker HealthChecker, mu MetricsUpdater) {
-	result := checker.Check(ti)
+// checkAndRecord performs one check cycle (all samples of the check) through
+// the given checker, records the result via metrics with appropriate logging,
+// and updates the tunnel-level status. An unknown result is only counted; it
+// leaves the check and tunnel status as they were. A check interrupted by
+// canceling ctx records nothing. It returns the check result.
+func checkAndRecord(ctx context.Context, ti *TunnelInstance, c TunnelCheck, status *tunnelStatus, checker HealthChecker, mu MetricsUpdater) CheckResult {
+	result, errs := sampleCheck(ctx, c.Instance, checker)
+	if ctx.Err() != nil {
+		slog.Debug("tunnel check canceled", "tunnel", ti.Name, "check", c.Name)
+		return result
+	}
+
+	for _, err := range errs {
+		mu.RecordError(ti.Name, c.Instance.MetricLabels, err)
+	}
 
-	if !result.Up && result.Err != nil {
-		mu.RecordError(ti.Name, ti.MetricLabels, result.Err)
+	if result.Unknown {
+		slog.Warn("tunnel check UNKNOWN: baseline probe failing", "tunnel", ti.Name, "check", c.Name, "error", result.Err)
+		mu.Update(ti.Name, c.Instance.MetricLabels, result)
+		return result
 	}
 
 	if result.Up {
 		if result.Err != nil {
-			slog.Warn("failed to read response body", "tunnel", ti.Name, "error", result.Err)
+			slog.Warn("failed to read response body", "tunnel", ti.Name, "check", c.Name, "error", result.Err)
 		}
-		slog.Info("tunnel UP", "tunnel", ti.Name, "latency", result.Latency.Round(time.Millisecond))
-	} else {
-		if result.Err != nil {
-			slog.Error("tunnel DOWN", "tunnel", ti.Name, "error", result.Err)
+		if result.Degraded {
+			slog.Warn("tunnel DEGRADED", "tunnel", ti.Name, "check", c.Name,
+				"throughput_bps", int64(max(result.DownloadThroughput, result.UploadThroughput)),
+				"min_throughput_bps", int64(minThroughput(c.Instance)))
+		} else {
+			attrs := []any{"tunnel", ti.Name, "check", c.Name, "latency", result.Latency.Round(time.Millisecond)}
+			if result.Samples != nil {
+				attrs = append(attrs, "samples", result.Samples.Count, "loss", result.Samples.Loss())
+			}
+			slog.Info("tunnel UP", attrs...)
 		}
+	} else if result.Err != nil {
+		slog.Error("tunnel DOWN", "tunnel", ti.Name, "check", c.Name, "error", result.Err)
+	} else {
+		slog.Error("tunnel DOWN", "tunnel", ti.Name, "check", c.Name)
 	}
 
-	mu.Update(ti.Name, ti.MetricLabels, result)
+	mu.Update(ti.Name, c.Instance.MetricLabels, result)
+	mu.SetTunnelUp(ti.Name, ti.MetricLabels, status.record(c.Name, result.Up))
+	return result
+}
+
+// minThroughput returns the min_throughput of a download or upload check in
+// bytes per second, 0 for other methods.
+func minThroughput(ti *TunnelInstance) float64 {
+	switch s := ti.MethodConfig.(type) {
+	case config.DownloadSettings:
+		return s.MinThroughput
+	case config.UploadSettings:
+		return s.MinThroughput
+	}
+	return 0
 }
 
 // RunTunnelChecker runs periodic health-checks on a tunnel instance until ctx
-// is canceled. It applies exponential backoff on consecutive failures.
+// is canceled. Every check runs on its own interval and applies exponential
+// backoff on its consecutive failures. With server_probe, the VLESS server is
+// also probed directly every check_interval.
 func RunTunnelChecker(ctx context.Context, ti *TunnelInstance, checker HealthChecker, mu MetricsUpdater) {
+	checks := ti.checkList()
+	status := newTunnelStatus(ti.UpPolicy, checks)
+
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCheckLoop(ctx, ti, c, status, checker, mu)
+		}()
+	}
+	if ti.ServerProbe && ti.VLESSConfig != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runServerProbeLoop(ctx, ti, mu)
+		}()
+	}
+	wg.Wait()
+}
+
+// runCheckLoop runs one check of a tunnel periodically until ctx is canceled.
+func runCheckLoop(ctx context.Context, ti *TunnelInstance, c TunnelCheck, status *tunnelStatus, checker HealthChecker, mu MetricsUpdater) {
+	ci := c.Instance
+
 	// Jitter for initial check — prevents thundering herd
-	jitter := time.Duration(rand.Int64N(int64(ti.CheckInterval)))
-	slog.Debug("staggering initial check", "tunnel", ti.Name, "jitter", jitter)
+	jitter := time.Duration(rand.Int64N(int64(ci.CheckInterval)))
+	slog.Debug("staggering initial check", "tunnel", ti.Name, "check", c.Name, "jitter", jitter)
 	timer := time.NewTimer(jitter)
 	defer timer.Stop()
 	select {
@@ -291,9 +625,9 @@ func RunTunnelChecker(ctx context.Context, ti *TunnelInstance, checker HealthChe
 	}
 
 	consecutiveFailures := 0
-	checkAndRecord(ti, checker, mu)
+	checkAndRecord(ctx, ti, c, status, checker, mu)
 
-	ticker := time.NewTicker(ti.CheckInterval)
+	ticker := time.NewTicker(ci.CheckInterval)
 	defer ticker.Stop()
 
 	for {
@@ -302,27 +636,19 @@ func RunTunnelChecker(ctx context.Context, ti *TunnelInstance, checker HealthChe
 			return
 		case <-ticker.C:
 			if consecutiveFailures > 0 {
-				interval := BackoffDuration(ti.CheckInterval, ti.BackoffMultiplier, ti.MaxBackoff, consecutiveFailures)
-				slog.Debug("backoff active", "tunnel", ti.Name, "consecutive_failures", consecutiveFailures, "next_check_in", interval)
+				interval := BackoffDuration(ci.CheckInterval, ci.BackoffMultiplier, ci.MaxBackoff, consecutiveFailures)
+				slog.Debug("backoff active", "tunnel", ti.Name, "check", c.Name, "consecutive_failures", consecutiveFailures, "next_check_in", interval)
 				ticker.Reset(interval)
 			}
 
-			result := checker.Check(ti)
-			if result.Up {
-				if result.Err != nil {
-					slog.Warn("failed to read response body", "tunnel", ti.Name, "error", result.Err)
-				}
-				slog.Info("tunnel UP", "tunnel", ti.Name, "latency", result.Latency.Round(time.Millisecond))
+			// An unknown result says nothing about the tunnel, so it
+			// neither resets nor extends the backoff.
+			if r := checkAndRecord(ctx, ti, c, status, checker, mu); r.Up {
 				consecutiveFailures = 0
-				ticker.Reset(ti.CheckInterval)
-			} else {
-				if result.Err != nil {
-					slog.Error("tunnel DOWN", "tunnel", ti.Name, "error", result.Err)
-				}
+				ticker.Reset(ci.CheckInterval)
+			} else if !r.Unknown {
 				consecutiveFailures++
 			}
-
-			mu.Update(ti.Name, ti.MetricLabels, result)
 		}
 	}
 }
@@ -369,41 +695,122 @@ func tunnelMetricLabels(ti *TunnelInstance) []string {
 	}
 }
 
+// tunnelLabelSet returns the tunnel-level labels of ti as prometheus.Labels.
+func tunnelLabelSet(ti *TunnelInstance) prometheus.Labels {
+	return prometheus.Labels{
+		"name":     ti.Name,
+		"server":   ti.MetricLabels.Server,
+		"security": ti.MetricLabels.Security,
+		"sni":      ti.MetricLabels.SNI,
+	}
+}
+
 // CleanupRemovedTunnelMetrics removes all Prometheus metrics for tunnel
-// instances that exist in oldInstances but not in newInstances.
+// instances that exist in oldInstances but not in newInstances, and the
+// per-check metrics of checks that a kept tunnel no longer has.
 func CleanupRemovedTunnelMetrics(oldInstances, newInstances []*TunnelInstance) {
 	if len(oldInstances) == 0 {
 		return
 	}
 
-	newKeys := make(map[string]struct{}, len(newInstances))
+	newChecks := make(map[string]map[string]struct{}, len(newInstances))
+	newServerProbes := make(map[string]struct{})
+	newSoaks := make(map[string]struct{})
 	for _, ti := range newInstances {
 		key := strings.Join(tunnelMetricLabels(ti), "|")
-		newKeys[key] = struct{}{}
+		names := make(map[string]struct{})
+		for _, c := range ti.checkList() {
+			names[c.Name] = struct{}{}
+		}
+		newChecks[key] = names
+		if ti.ServerProbe {
+			newServerProbes[key] = struct{}{}
+		}
+		if ti.Soak {
+			newSoaks[key] = struct{}{}
+		}
 	}
 
 	for _, ti := range oldInstances {
 		key := strings.Join(tunnelMetricLabels(ti), "|")
-		if _, exists := newKeys[key]; exists {
+		if _, probed := newServerProbes[key]; ti.ServerProbe && !probed {
+			deleteServerProbeMetrics(tunnelLabelSet(ti))
+		}
+		if _, soaked := newSoaks[key]; ti.Soak && !soaked {
+			deleteSoakMetrics(tunnelLabelSet(ti))
+		}
+		if kept, exists := newChecks[key]; exists {
+			for _, c := range ti.checkList() {
+				if _, ok := kept[c.Name]; !ok {
+					labels := tunnelLabelSet(ti)
+					labels["check"] = c.Name
+					deleteCheckMetrics(labels)
+				}
+			}
 			continue
 		}
 
 		labels := tunnelMetricLabels(ti)
 		metrics.TunnelUp.DeleteLabelValues(labels...)
-		metrics.TunnelLatency.DeleteLabelValues(labels...)
-		metrics.TunnelLatencyHistogram.DeleteLabelValues(labels...)
 		metrics.TunnelLastSuccess.DeleteLabelValues(labels...)
-		metrics.TunnelHTTPStatus.DeleteLabelValues(labels...)
-		metrics.TunnelCheckTotal.DeleteLabelValues(labels[0], labels[1], labels[2], labels[3], "success")
-		metrics.TunnelCheckTotal.DeleteLabelValues(labels[0], labels[1], labels[2], labels[3], "failure")
-
-		// Delete error metrics for all known reason categories
-		for _, reason := range metrics.ErrorReasons {
-			metrics.TunnelErrorTotal.DeleteLabelValues(labels[0], labels[1], labels[2], labels[3], reason)
-		}
+		deleteCheckMetrics(tunnelLabelSet(ti))
 	}
 }
 
+// deleteServerProbeMetrics deletes the direct server probe series matching
+// labels.
+func deleteServerProbeMetrics(labels prometheus.Labels) {
+	metrics.TunnelServerUp.DeletePartialMatch(labels)
+	metrics.TunnelServerLatency.DeletePartialMatch(labels)
+	metrics.TunnelServerCertExpiry.DeletePartialMatch(labels)
+	metrics.TunnelServerCertInfo.DeletePartialMatch(labels)
+	metrics.TunnelServerCertSANMatch.DeletePartialMatch(labels)
+	metrics.TunnelRealityTargetUp.DeletePartialMatch(labels)
+	metrics.TunnelRealityTargetLatency.DeletePartialMatch(labels)
+}
+
+// deleteSoakMetrics deletes the soak connection series matching labels.
+func deleteSoakMetrics(labels prometheus.Labels) {
+	metrics.TunnelSoakUp.DeletePartialMatch(labels)
+	metrics.TunnelSoakConnectionAge.DeletePartialMatch(labels)
+	metrics.TunnelSoakConnectionLifetime.DeletePartialMatch(labels)
+	metrics.TunnelSoakDropsTotal.DeletePartialMatch(labels)
+	metrics.TunnelSoakReconnectsTotal.DeletePartialMatch(labels)
+	metrics.TunnelSoakHeartbeatRTT.DeletePartialMatch(labels)
+}
+
+// deleteCheckMetrics deletes every per-check series matching labels,
+// whatever their check, result and reason labels.
+func deleteCheckMetrics(labels prometheus.Labels) {
+	metrics.TunnelCheckUp.DeletePartialMatch(labels)
+	metrics.TunnelLatency.DeletePartialMatch(labels)
+	metrics.TunnelLatencyHistogram.DeletePartialMatch(labels)
+	metrics.TunnelStageLatency.DeletePartialMatch(labels)
+	metrics.TunnelSampleLatency.DeletePartialMatch(labels)
+	metrics.TunnelSampleLoss.DeletePartialMatch(labels)
+	metrics.TunnelConcurrencySuccessRatio.DeletePartialMatch(labels)
+	metrics.TunnelConcurrencyLatency.DeletePartialMatch(labels)
+	metrics.TunnelConcurrencyMaxInFlight.DeletePartialMatch(labels)
+	metrics.TunnelExitInfo.DeletePartialMatch(labels)
+	metrics.TunnelExitIPChangesTotal.DeletePartialMatch(labels)
+	forgetExitIPs(labels)
+	metrics.TunnelProtocolInfo.DeletePartialMatch(labels)
+	metrics.TunnelWebSocketRTT.DeletePartialMatch(labels)
+	metrics.TunnelExecValue.DeletePartialMatch(labels)
+	metrics.TunnelHTTPStatus.DeletePartialMatch(labels)
+	metrics.TunnelCheckTotal.DeletePartialMatch(labels)
+	metrics.TunnelErrorTotal.DeletePartialMatch(labels)
+	metrics.TunnelLastErrorInfo.DeletePartialMatch(labels)
+	metrics.TunnelLastErrorTimestamp.DeletePartialMatch(labels)
+	metrics.TunnelDegraded.DeletePartialMatch(labels)
+	metrics.TunnelDownloadThroughput.DeletePartialMatch(labels)
+	metrics.TunnelDownloadThroughputHistogram.DeletePartialMatch(labels)
+	metrics.TunnelDownloadBytesTotal.DeletePartialMatch(labels)
+	metrics.TunnelUploadThroughput.DeletePartialMatch(labels)
+	metrics.TunnelUploadThroughputHistogram.DeletePartialMatch(labels)
+	metrics.TunnelUploadBytesTotal.DeletePartialMatch(labels)
+}
+
 // reloadConfig gracefully reloads configuration using a "start new, then stop
 // old" strategy to avoid downtime: new tunnels are started on fresh ports
 // before old ones are stopped.
@@ -462,6 +869,14 @@ func (tm *TunnelManager) reloadConfig(configFile string) error {
 
 	metrics.SetTunnelsConfigured(len(newInstances))
 
+	// The baseline follows the new check targets; enabling or disabling it,
+	// or changing its interval, takes a restart.
+	if tm.baseline != nil {
+		if err := tm.baseline.SetTargets(newConfig.Baseline, newConfig.Tunnels); err != nil {
+			slog.Warn("keeping the previous baseline targets", "error", err)
+		}
+	}
+
 	slog.Info("configuration reloaded successfully", "tunnel_count", len(newInstances))
 	return nil
 }
@@ -470,12 +885,54 @@ func (tm *TunnelManager) reloadConfig(configFile string) error {
 // Prometheus gauge/counter vectors.
 type prometheusMetrics struct{}
 
+// exitKey identifies the series of one check for exit IP tracking.
+type exitKey struct {
+	name, server, security, sni, check string
+}
+
+// exitIPs remembers the last exit IP of every check, so that Update can count
+// exit IP changes. Entries are dropped together with the check's metrics.
+var exitIPs = struct {
+	sync.Mutex
+	last map[exitKey]string
+}{last: make(map[exitKey]string)}
+
+// recordExitIP stores ip as the latest exit of k and reports whether it
+// differs from a previously seen one.
+func recordExitIP(k exitKey, ip string) bool {
+	exitIPs.Lock()
+	defer exitIPs.Unlock()
+	prev, seen := exitIPs.last[k]
+	exitIPs.last[k] = ip
+	return seen && prev != ip
+}
+
+// forgetExitIPs drops the remembered exits of all checks matching labels.
+func forgetExitIPs(labels prometheus.Labels) {
+	exitIPs.Lock()
+	defer exitIPs.Unlock()
+	for k := range exitIPs.last {
+		values := map[string]string{"name": k.name, "server": k.server, "security": k.security, "sni": k.sni, "check": k.check}
+		match := true
+		for l, v := range labels {
+			if values[l] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			delete(exitIPs.last, k)
+		}
+	}
+}
+
 func (prometheusMetrics) Update(name string, ml MetricLabels, r CheckResult) {
 	labels := prometheus.Labels{
 		"name":     name,
 		"server":   ml.Server,
 		"security": ml.Security,
 		"sni":      ml.SNI,
+		"check":    ml.Check,
 	}
 
 	resultLabels := func(result string) prometheus.Labels {
@@ -484,37 +941,238 @@ func (prometheusMetrics) Update(name string, ml MetricLabels, r CheckResult) {
 			"server":   ml.Server,
 			"security": ml.Security,
 			"sni":      ml.SNI,
+			"check":    ml.Check,
 			"result":   result,
 		}
 	}
 
+	if r.Unknown {
+		metrics.TunnelCheckTotal.With(resultLabels("unknown")).Inc()
+		return
+	}
+
 	if r.Up {
-		metrics.TunnelUp.With(labels).Set(1)
+		metrics.TunnelCheckUp.With(labels).Set(1)
+		metrics.TunnelLastErrorInfo.DeletePartialMatch(labels)
+		metrics.TunnelLastErrorTimestamp.Delete(labels)
 		if r.Err == nil {
 			metrics.TunnelLatency.With(labels).Set(r.Latency.Seconds())
-			metrics.TunnelLatencyHistogram.With(labels).Observe(r.Latency.Seconds())
+			latencies := []time.Duration{r.Latency}
+			if r.Samples != nil {
+				latencies = r.Samples.Latencies
+			} else if r.Concurrency != nil {
+				latencies = r.Concurrency.Latencies
+			}
+			for _, l := range latencies {
+				metrics.TunnelLatencyHistogram.With(labels).Observe(l.Seconds())
+			}
 		}
-		metrics.TunnelLastSuccess.With(labels).Set(float64(time.Now().Unix()))
 		metrics.TunnelCheckTotal.With(resultLabels("success")).Inc()
 	} else {
-		metrics.TunnelUp.With(labels).Set(0)
+		metrics.TunnelCheckUp.With(labels).Set(0)
 		metrics.TunnelCheckTotal.With(resultLabels("failure")).Inc()
 	}
 
 	if r.HTTPStatus > 0 {
 		metrics.TunnelHTTPStatus.With(labels).Set(float64(r.HTTPStatus))
 	}
+
+	if r.Exit != nil {
+		metrics.TunnelExitInfo.DeletePartialMatch(labels)
+		exitLabels := prometheus.Labels{"ip": r.Exit.IP, "country": r.Exit.Country, "asn": r.Exit.ASN}
+		maps.Copy(exitLabels, labels)
+		metrics.TunnelExitInfo.With(exitLabels).Set(1)
+
+		changes := metrics.TunnelExitIPChangesTotal.With(labels)
+		if recordExitIP(exitKey{name, ml.Server, ml.Security, ml.SNI, ml.Check}, r.Exit.IP) {
+			changes.Inc()
+		}
+	}
+
+	if r.Protocol != "" {
+		metrics.TunnelProtocolInfo.DeletePartialMatch(labels)
+		protocolLabels := prometheus.Labels{"protocol": r.Protocol}
+		maps.Copy(protocolLabels, labels)
+		metrics.TunnelProtocolInfo.With(protocolLabels).Set(1)
+	}
+	if r.RoundTrip > 0 {
+		metrics.TunnelWebSocketRTT.With(labels).Set(r.RoundTrip.Seconds())
+	}
+	if r.ExecValue != nil {
+		metrics.TunnelExecValue.With(labels).Set(*r.ExecValue)
+	}
+
+	if r.Samples != nil {
+		metrics.TunnelSampleLoss.With(labels).Set(r.Samples.Loss())
+		if len(r.Samples.Latencies) > 0 {
+			minL, avg, maxL, stddev := r.Samples.LatencyStats()
+			for stat, d := range map[string]time.Duration{"min": minL, "avg": avg, "max": maxL, "stddev": stddev} {
+				statLabels := prometheus.Labels{"stat": stat}
+				maps.Copy(statLabels, labels)
+				metrics.TunnelSampleLatency.With(statLabels).Set(d.Seconds())
+			}
+		}
+	}
+
+	if r.Concurrency != nil {
+		metrics.TunnelConcurrencySuccessRatio.With(labels).Set(r.Concurrency.SuccessRatio())
+		metrics.TunnelConcurrencyMaxInFlight.With(labels).Set(float64(r.Concurrency.MaxInFlight))
+		metrics.TunnelConcurrencyLatency.DeletePartialMatch(labels)
+		if len(r.Concurrency.Latencies) > 0 {
+			for _, q := range []float64{0.5, 0.9, 0.99, 1} {
+				quantileLabels := prometheus.Labels{"quantile": strconv.FormatFloat(q, 'g', -1, 64)}
+				maps.Copy(quantileLabels, labels)
+				metrics.TunnelConcurrencyLatency.With(quantileLabels).Set(r.Concurrency.Quantile(q).Seconds())
+			}
+		}
+	}
+
+	for stage, d := range r.Stages {
+		stageLabels := prometheus.Labels{"stage": stage}
+		maps.Copy(stageLabels, labels)
+		metrics.TunnelStageLatency.With(stageLabels).Observe(d.Seconds())
+	}
+
+	if r.Degraded {
+		metrics.TunnelDegraded.With(labels).Set(1)
+	} else {
+		metrics.TunnelDegraded.With(labels).Set(0)
+	}
+	if r.BytesDownloaded > 0 {
+		metrics.TunnelDownloadBytesTotal.With(labels).Add(float64(r.BytesDownloaded))
+	}
+	if r.DownloadThroughput > 0 {
+		metrics.TunnelDownloadThroughput.With(labels).Set(r.DownloadThroughput)
+		metrics.TunnelDownloadThroughputHistogram.With(labels).Observe(r.DownloadThroughput)
+	}
+	if r.BytesUploaded > 0 {
+		metrics.TunnelUploadBytesTotal.With(labels).Add(float64(r.BytesUploaded))
+	}
+	if r.UploadThroughput > 0 {
+		metrics.TunnelUploadThroughput.With(labels).Set(r.UploadThroughput)
+		metrics.TunnelUploadThroughputHistogram.With(labels).Observe(r.UploadThroughput)
+	}
 }
 
+// RecordError counts err in xray_tunnel_error_total and makes it the check's
+// last error, replacing the previous xray_tunnel_last_error_info series.
 func (prometheusMetrics) RecordError(name string, ml MetricLabels, err error) {
-	errorLabels := prometheus.Labels{
+	labels := prometheus.Labels{
 		"name":     name,
 		"server":   ml.Server,
 		"security": ml.Security,
 		"sni":      ml.SNI,
-		"reason":   metrics.ClassifyError(err),
+		"check":    ml.Check,
+	}
+	errorLabels := prometheus.Labels{
+		"reason": metrics.ClassifyError(err),
+		"stage":  metrics.ErrorStage(err),
 	}
+	maps.Copy(errorLabels, labels)
 	metrics.TunnelErrorTotal.With(errorLabels).Inc()
+
+	metrics.TunnelLastErrorInfo.DeletePartialMatch(labels)
+	errorLabels["message"] = metrics.ErrorMessage(err)
+	metrics.TunnelLastErrorInfo.With(errorLabels).Set(1)
+	metrics.TunnelLastErrorTimestamp.With(labels).Set(float64(time.Now().Unix()))
+}
+
+func (prometheusMetrics) UpdateServerProbe(name string, ml MetricLabels, r ServerProbeResult) {
+	set := func(stage string, up bool, latency time.Duration) {
+		labels := prometheus.Labels{
+			"name":     name,
+			"server":   ml.Server,
+			"security": ml.Security,
+			"sni":      ml.SNI,
+			"stage":    stage,
+		}
+		if !up {
+			metrics.TunnelServerUp.With(labels).Set(0)
+			return
+		}
+		metrics.TunnelServerUp.With(labels).Set(1)
+		metrics.TunnelServerLatency.With(labels).Set(latency.Seconds())
+	}
+
+	set(metrics.ServerStageTCP, r.TCPUp, r.TCPLatency)
+	if r.TLS {
+		set(metrics.ServerStageTLS, r.TLSUp, r.TLSLatency)
+	}
+
+	labels := prometheus.Labels{
+		"name":     name,
+		"server":   ml.Server,
+		"security": ml.Security,
+		"sni":      ml.SNI,
+	}
+	if r.Target {
+		if r.TargetUp {
+			metrics.TunnelRealityTargetUp.With(labels).Set(1)
+			metrics.TunnelRealityTargetLatency.With(labels).Set(r.TargetLatency.Seconds())
+		} else {
+			metrics.TunnelRealityTargetUp.With(labels).Set(0)
+		}
+	}
+
+	// Without a certificate in this probe, the last one stays exported.
+	if r.Cert == nil {
+		return
+	}
+	metrics.TunnelServerCertExpiry.With(labels).Set(float64(r.Cert.NotAfter.Unix()))
+	if r.Cert.SANMatch {
+		metrics.TunnelServerCertSANMatch.With(labels).Set(1)
+	} else {
+		metrics.TunnelServerCertSANMatch.With(labels).Set(0)
+	}
+	metrics.TunnelServerCertInfo.DeletePartialMatch(labels)
+	infoLabels := prometheus.Labels{"issuer": r.Cert.Issuer}
+	maps.Copy(infoLabels, labels)
+	metrics.TunnelServerCertInfo.With(infoLabels).Set(1)
+}
+
+func (prometheusMetrics) UpdateSoak(name string, ml MetricLabels, ev SoakEvent) {
+	labels := prometheus.Labels{
+		"name":     name,
+		"server":   ml.Server,
+		"security": ml.Security,
+		"sni":      ml.SNI,
+	}
+
+	if ev.Reconnect {
+		metrics.TunnelSoakReconnectsTotal.With(labels).Inc()
+	}
+	if ev.RTT > 0 {
+		metrics.TunnelSoakHeartbeatRTT.With(labels).Set(ev.RTT.Seconds())
+	}
+	if ev.Dropped {
+		metrics.TunnelSoakConnectionLifetime.With(labels).Observe(ev.Lifetime.Seconds())
+		dropLabels := prometheus.Labels{"reason": metrics.ClassifyError(ev.Err)}
+		maps.Copy(dropLabels, labels)
+		metrics.TunnelSoakDropsTotal.With(dropLabels).Inc()
+	}
+	if !ev.Up {
+		metrics.TunnelSoakUp.With(labels).Set(0)
+		metrics.TunnelSoakConnectionAge.With(labels).Set(0)
+		return
+	}
+	metrics.TunnelSoakUp.With(labels).Set(1)
+	metrics.TunnelSoakConnectionAge.With(labels).Set(ev.Lifetime.Seconds())
+}
+
+func (prometheusMetrics) SetTunnelUp(name string, ml MetricLabels, up bool) {
+	labels := prometheus.Labels{
+		"name":     name,
+		"server":   ml.Server,
+		"security": ml.Security,
+		"sni":      ml.SNI,
+	}
+
+	if up {
+		metrics.TunnelUp.With(labels).Set(1)
+		metrics.TunnelLastSuccess.With(labels).Set(float64(time.Now().Unix()))
+	} else {
+		metrics.TunnelUp.With(labels).Set(0)
+	}
 }
 
 // NewPrometheusMetrics returns a MetricsUpdater backed by the global Prometheus
@@ -541,7 +1199,21 @@ func RunProbing(ctx context.Context, configFile string, checker HealthChecker, m
 
 	slog.Debug("loaded config", "tunnel_count", len(cfg.Tunnels))
 
+	var baseline *Baseline
+	if cfg.Baseline.Enabled {
+		baseline, err = NewBaseline(cfg.Baseline, cfg.Tunnels)
+		if err != nil {
+			return err
+		}
+		go baseline.Run(ctx)
+		if cfg.Baseline.MarkUnknown {
+			checker = WithBaseline(checker, baseline)
+		}
+		slog.Info("baseline probe enabled", "targets", len(baseline.urls), "mark_unknown", cfg.Baseline.MarkUnknown)
+	}
+
 	tunnelManager := NewTunnelManager(checker, mu)
+	tunnelManager.baseline = baseline
 
 	tunnelInstances, nextAutoPort, err := InitializeTunnels(cfg, metrics.DefaultSocksPort, tunnelManager.checker, tunnelManager.metrics)
 	if err != nil {
@@ -2,17 +2,22 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/batonogov/xray-health-exporter/internal/config"
 	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/batonogov/xray-health-exporter/internal/socks"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 )
@@ -20,7 +25,7 @@ import (
 // mockChecker is a test-only HealthChecker that does nothing.
 type mockChecker struct{}
 
-func (mockChecker) Check(ti *TunnelInstance) CheckResult {
+func (mockChecker) Check(_ context.Context, ti *TunnelInstance) CheckResult {
 	return CheckResult{Up: true, HTTPStatus: 200, Latency: time.Millisecond}
 }
 
@@ -47,7 +52,7 @@ func TestInitializeTunnels(t *testing.T) {
 				{
 					Name:          "invalid",
 					URL:           "invalid-url",
-					CheckURL:      "https://example.com",
+					CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
 					CheckInterval: "30s",
 					CheckTimeout:  "10s",
 				},
@@ -76,7 +81,7 @@ func TestInitializeTunnels_SocksPort(t *testing.T) {
 				{
 					Name:           "custom-port",
 					XrayConfigFile: xrayConfigPath,
-					CheckURL:       "https://example.com",
+					CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 					CheckInterval:  "30s",
 					CheckTimeout:   "10s",
 					SocksPort:      25000,
@@ -106,14 +111,14 @@ func TestInitializeTunnels_SocksPort(t *testing.T) {
 				{
 					Name:           "auto1",
 					XrayConfigFile: xrayConfigPath,
-					CheckURL:       "https://example.com",
+					CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 					CheckInterval:  "30s",
 					CheckTimeout:   "10s",
 				},
 				{
 					Name:           "custom",
 					XrayConfigFile: xrayConfigPath,
-					CheckURL:       "https://example.com",
+					CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 					CheckInterval:  "30s",
 					CheckTimeout:   "10s",
 					SocksPort:      25000,
@@ -121,7 +126,7 @@ func TestInitializeTunnels_SocksPort(t *testing.T) {
 				{
 					Name:           "auto2",
 					XrayConfigFile: xrayConfigPath,
-					CheckURL:       "https://example.com",
+					CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 					CheckInterval:  "30s",
 					CheckTimeout:   "10s",
 				},
@@ -153,10 +158,10 @@ func TestInitializeTunnels_SocksPort(t *testing.T) {
 
 		cfg := &config.Config{
 			Tunnels: []config.Tunnel{
-				{Name: "auto1", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s"},
-				{Name: "custom", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s", SocksPort: 1081},
-				{Name: "auto2", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s"},
-				{Name: "auto3", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s"},
+				{Name: "auto1", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s"},
+				{Name: "custom", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s", SocksPort: 1081},
+				{Name: "auto2", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s"},
+				{Name: "auto3", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s"},
 			},
 		}
 
@@ -188,9 +193,9 @@ func TestInitializeTunnels_SocksPort(t *testing.T) {
 
 		cfg := &config.Config{
 			Tunnels: []config.Tunnel{
-				{Name: "auto1", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s"},
-				{Name: "custom", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s", SocksPort: 1081},
-				{Name: "auto2", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s"},
+				{Name: "auto1", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s"},
+				{Name: "custom", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s", SocksPort: 1081},
+				{Name: "auto2", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s"},
 			},
 		}
 
@@ -213,9 +218,9 @@ func TestInitializeTunnels_SocksPort(t *testing.T) {
 
 		cfg := &config.Config{
 			Tunnels: []config.Tunnel{
-				{Name: "auto1", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s"},
-				{Name: "custom", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s", SocksPort: 20000},
-				{Name: "auto2", XrayConfigFile: xrayConfigPath, CheckURL: "https://example.com", CheckInterval: "30s", CheckTimeout: "10s"},
+				{Name: "auto1", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s"},
+				{Name: "custom", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s", SocksPort: 20000},
+				{Name: "auto2", XrayConfigFile: xrayConfigPath, CheckSettings: config.CheckSettings{CheckURL: "https://example.com"}, CheckInterval: "30s", CheckTimeout: "10s"},
 			},
 		}
 
@@ -242,14 +247,14 @@ func TestInitializeTunnels_CleanupOnError(t *testing.T) {
 			{
 				Name:           "valid-xray",
 				XrayConfigFile: xrayConfig,
-				CheckURL:       "https://example.com",
+				CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 				CheckInterval:  "30s",
 				CheckTimeout:   "10s",
 			},
 			{
 				Name:          "invalid",
 				URL:           "not-vless://bad",
-				CheckURL:      "https://example.com",
+				CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
 				CheckInterval: "30s",
 				CheckTimeout:  "10s",
 			},
@@ -293,6 +298,59 @@ func TestStopTunnels(t *testing.T) {
 	}
 }
 
+// blockingChecker blocks every check until ctx is canceled.
+type blockingChecker struct {
+	started chan struct{}
+}
+
+func (c blockingChecker) Check(ctx context.Context, ti *TunnelInstance) CheckResult {
+	select {
+	case c.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return CheckResult{Up: false, Err: ctx.Err()}
+}
+
+// updateCounter counts the check results recorded through it.
+type updateCounter struct {
+	MetricsUpdater
+	updates atomic.Int32
+}
+
+func (u *updateCounter) Update(string, MetricLabels, CheckResult) { u.updates.Add(1) }
+
+func TestStopTunnels_CancelsInFlightChecks(t *testing.T) {
+	ti := &TunnelInstance{
+		Name:          "blocked",
+		CheckInterval: time.Millisecond,
+		CheckTimeout:  time.Minute,
+	}
+	checker := blockingChecker{started: make(chan struct{}, 1)}
+	mu := &updateCounter{}
+	startChecks(ti, checker, mu)
+
+	select {
+	case <-checker.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("check did not start")
+	}
+
+	start := time.Now()
+	StopTunnels([]*TunnelInstance{ti})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("StopTunnels took %v, want the in-flight check canceled promptly", elapsed)
+	}
+	select {
+	case <-ti.done:
+	default:
+		t.Fatal("StopTunnels returned before the checker goroutine")
+	}
+	if n := mu.updates.Load(); n != 0 {
+		t.Errorf("a canceled check recorded %d results, want none", n)
+	}
+}
+
 func TestStopTunnels_NilXrayInstance(t *testing.T) {
 	ti := &TunnelInstance{
 		Name:         "nil-xray",
@@ -471,19 +529,23 @@ func TestCleanupRemovedTunnelMetrics(t *testing.T) {
 			"security": ti.MetricLabels.Security,
 			"sni":      ti.MetricLabels.SNI,
 		}
+		checkVals := prometheus.Labels{
+			"name": labelVals["name"], "server": labelVals["server"],
+			"security": labelVals["security"], "sni": labelVals["sni"], "check": "http",
+		}
 		metrics.TunnelUp.With(labelVals).Set(1)
-		metrics.TunnelLatency.With(labelVals).Set(0.2)
-		metrics.TunnelLatencyHistogram.With(labelVals).Observe(0.2)
+		metrics.TunnelLatency.With(checkVals).Set(0.2)
+		metrics.TunnelLatencyHistogram.With(checkVals).Observe(0.2)
 		metrics.TunnelLastSuccess.With(labelVals).Set(float64(time.Now().Unix()))
-		metrics.TunnelHTTPStatus.With(labelVals).Set(200)
+		metrics.TunnelHTTPStatus.With(checkVals).Set(200)
 
 		successLabels := prometheus.Labels{
 			"name": labelVals["name"], "server": labelVals["server"],
-			"security": labelVals["security"], "sni": labelVals["sni"], "result": "success",
+			"security": labelVals["security"], "sni": labelVals["sni"], "check": "http", "result": "success",
 		}
 		failLabels := prometheus.Labels{
 			"name": labelVals["name"], "server": labelVals["server"],
-			"security": labelVals["security"], "sni": labelVals["sni"], "result": "failure",
+			"security": labelVals["security"], "sni": labelVals["sni"], "check": "http", "result": "failure",
 		}
 		metrics.TunnelCheckTotal.With(successLabels).Inc()
 		metrics.TunnelCheckTotal.With(failLabels).Inc()
@@ -509,14 +571,14 @@ func TestCleanupRemovedTunnelMetrics(t *testing.T) {
 
 	for _, result := range []string{"success", "failure"} {
 		if metricExistsWithLabels(t, "xray_tunnel_check_total", prometheus.Labels{
-			"name": "removed", "server": "removed.example.com:1443", "security": "reality", "sni": "google.com", "result": result,
+			"name": "removed", "server": "removed.example.com:1443", "security": "reality", "sni": "google.com", "check": "http", "result": result,
 		}) {
 			t.Errorf("expected counter metric (%s) for removed tunnel to be deleted", result)
 		}
 	}
 
 	if !metricExistsWithLabels(t, "xray_tunnel_check_total", prometheus.Labels{
-		"name": "kept", "server": "kept.example.com:2443", "security": "tls", "sni": "kept.example.com", "result": "success",
+		"name": "kept", "server": "kept.example.com:2443", "security": "tls", "sni": "kept.example.com", "check": "http", "result": "success",
 	}) {
 		t.Errorf("expected counter metric for kept tunnel to remain")
 	}
@@ -561,7 +623,7 @@ func TestCleanupRemovedTunnelMetrics_ErrorMetrics(t *testing.T) {
 		for _, reason := range metrics.ErrorReasons {
 			errorLabels := prometheus.Labels{
 				"name": labels["name"], "server": labels["server"],
-				"security": labels["security"], "sni": labels["sni"], "reason": reason,
+				"security": labels["security"], "sni": labels["sni"], "check": "http", "reason": reason, "stage": metrics.ErrorStageHTTP,
 			}
 			metrics.TunnelErrorTotal.With(errorLabels).Add(1)
 		}
@@ -571,7 +633,7 @@ func TestCleanupRemovedTunnelMetrics_ErrorMetrics(t *testing.T) {
 
 	for _, reason := range metrics.ErrorReasons {
 		if metricExistsWithLabels(t, "xray_tunnel_error_total", prometheus.Labels{
-			"name": "err-removed", "server": "err.example.com:1443", "security": "tls", "sni": "err.example.com", "reason": reason,
+			"name": "err-removed", "server": "err.example.com:1443", "security": "tls", "sni": "err.example.com", "check": "http", "reason": reason, "stage": metrics.ErrorStageHTTP,
 		}) {
 			t.Errorf("expected error metric (reason=%s) for removed tunnel to be deleted", reason)
 		}
@@ -579,13 +641,162 @@ func TestCleanupRemovedTunnelMetrics_ErrorMetrics(t *testing.T) {
 
 	for _, reason := range metrics.ErrorReasons {
 		if !metricExistsWithLabels(t, "xray_tunnel_error_total", prometheus.Labels{
-			"name": "err-kept", "server": "kept.example.com:2443", "security": "tls", "sni": "kept.example.com", "reason": reason,
+			"name": "err-kept", "server": "kept.example.com:2443", "security": "tls", "sni": "kept.example.com", "check": "http", "reason": reason, "stage": metrics.ErrorStageHTTP,
 		}) {
 			t.Errorf("expected error metric (reason=%s) for kept tunnel to remain", reason)
 		}
 	}
 }
 
+func TestCleanupRemovedTunnelMetrics_RemovedCheck(t *testing.T) {
+	metrics.TunnelCheckUp.Reset()
+	metrics.TunnelLatency.Reset()
+	defer metrics.TunnelCheckUp.Reset()
+	defer metrics.TunnelLatency.Reset()
+
+	labels := MetricLabels{Server: "checks.example.com:443", Security: "tls", SNI: "checks.example.com"}
+	old := &TunnelInstance{Name: "checks", MetricLabels: labels}
+	old.Checks = []TunnelCheck{{Name: "reach", Instance: &TunnelInstance{}}, {Name: "speed", Instance: &TunnelInstance{}}}
+	old.bindChecks()
+
+	kept := &TunnelInstance{Name: "checks", MetricLabels: labels}
+	kept.Checks = []TunnelCheck{{Name: "reach", Instance: &TunnelInstance{}}}
+	kept.bindChecks()
+
+	checkLabels := func(check string) prometheus.Labels {
+		return prometheus.Labels{
+			"name": "checks", "server": labels.Server, "security": labels.Security, "sni": labels.SNI, "check": check,
+		}
+	}
+	for _, c := range old.Checks {
+		metrics.TunnelCheckUp.With(checkLabels(c.Name)).Set(1)
+		metrics.TunnelLatency.With(checkLabels(c.Name)).Set(0.1)
+	}
+
+	CleanupRemovedTunnelMetrics([]*TunnelInstance{old}, []*TunnelInstance{kept})
+
+	if !metricExistsWithLabels(t, "xray_tunnel_check_up", checkLabels("reach")) {
+		t.Error("expected metrics for kept check to remain")
+	}
+	for _, name := range []string{"xray_tunnel_check_up", "xray_tunnel_latency_seconds"} {
+		if metricExistsWithLabels(t, name, checkLabels("speed")) {
+			t.Errorf("expected %s for removed check to be deleted", name)
+		}
+	}
+}
+
+func TestPrometheusMetrics_Transfer(t *testing.T) {
+	ml := MetricLabels{Server: "speed.example.com:443", Security: "tls", SNI: "speed.example.com", Check: "download"}
+	labels := prometheus.Labels{
+		"name": "speed", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "check": ml.Check,
+	}
+	defer deleteCheckMetrics(labels)
+
+	mu := NewPrometheusMetrics()
+	mu.Update("speed", ml, CheckResult{Up: true, Degraded: true, HTTPStatus: 200, BytesDownloaded: 1000, DownloadThroughput: 5000})
+	mu.Update("speed", ml, CheckResult{Up: false, BytesDownloaded: 500})
+	mu.Update("speed", ml, CheckResult{Up: true, BytesUploaded: 2000, UploadThroughput: 8000})
+	mu.Update("speed", ml, CheckResult{Up: false, Stages: map[string]time.Duration{metrics.StageConnect: 20 * time.Millisecond}})
+
+	var m dto.Metric
+	if err := metrics.TunnelDownloadBytesTotal.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1500 {
+		t.Errorf("xray_tunnel_download_bytes_total = %v, want 1500", got)
+	}
+	if err := metrics.TunnelDownloadThroughput.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 5000 {
+		t.Errorf("xray_tunnel_download_throughput_bytes_per_second = %v, want 5000", got)
+	}
+	if err := metrics.TunnelUploadBytesTotal.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 2000 {
+		t.Errorf("xray_tunnel_upload_bytes_total = %v, want 2000", got)
+	}
+	if err := metrics.TunnelUploadThroughput.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 8000 {
+		t.Errorf("xray_tunnel_upload_throughput_bytes_per_second = %v, want 8000", got)
+	}
+	if err := metrics.TunnelDegraded.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0 {
+		t.Errorf("xray_tunnel_degraded = %v after a normal check, want 0", got)
+	}
+
+	stageLabels := prometheus.Labels{"stage": metrics.StageConnect}
+	maps.Copy(stageLabels, labels)
+	if !metricExistsWithLabels(t, "xray_tunnel_stage_latency_seconds", stageLabels) {
+		t.Error("expected stage latency of a failed check to be recorded")
+	}
+
+	deleteCheckMetrics(labels)
+	for _, name := range []string{"xray_tunnel_download_throughput_bytes_per_second", "xray_tunnel_upload_bytes_total", "xray_tunnel_stage_latency_seconds"} {
+		if metricExistsWithLabels(t, name, labels) {
+			t.Errorf("expected %s to be deleted", name)
+		}
+	}
+}
+
+func TestPrometheusMetrics_LastError(t *testing.T) {
+	ml := MetricLabels{Server: "err.example.com:443", Security: "tls", SNI: "err.example.com", Check: "http"}
+	labels := prometheus.Labels{
+		"name": "last-error", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "check": ml.Check,
+	}
+	defer deleteCheckMetrics(labels)
+	infoLabels := func(reason, stage, message string) prometheus.Labels {
+		l := prometheus.Labels{"reason": reason, "stage": stage, "message": message}
+		maps.Copy(l, labels)
+		return l
+	}
+
+	mu := NewPrometheusMetrics()
+	mu.RecordError("last-error", ml, &metrics.CheckError{
+		Stage: metrics.ErrorStageValidation, Reason: "bad_status", Err: errors.New("bad status code: 503"),
+	})
+	mu.Update("last-error", ml, CheckResult{Up: false, HTTPStatus: 503})
+
+	first := infoLabels("bad_status", metrics.ErrorStageValidation, "bad status code: 503")
+	if !metricExistsWithLabels(t, "xray_tunnel_last_error_info", first) {
+		t.Errorf("expected xray_tunnel_last_error_info with %v", first)
+	}
+	var m dto.Metric
+	if err := metrics.TunnelLastErrorTimestamp.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("xray_tunnel_last_error_timestamp_seconds = %v, want about now", got)
+	}
+
+	mu.RecordError("last-error", ml, context.DeadlineExceeded)
+	if metricExistsWithLabels(t, "xray_tunnel_last_error_info", first) {
+		t.Error("expected the previous last error to be replaced")
+	}
+	if !metricExistsWithLabels(t, "xray_tunnel_last_error_info", infoLabels("timeout", metrics.ErrorStageUnknown, "context deadline exceeded")) {
+		t.Error("expected xray_tunnel_last_error_info for the new error")
+	}
+
+	mu.Update("last-error", ml, CheckResult{Up: true, Latency: 10 * time.Millisecond})
+	if metrics.TunnelLastErrorInfo.DeletePartialMatch(labels) != 0 {
+		t.Error("expected xray_tunnel_last_error_info to be cleared on recovery")
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_last_error_timestamp_seconds", labels) {
+		t.Error("expected xray_tunnel_last_error_timestamp_seconds to be cleared on recovery")
+	}
+
+	mu.RecordError("last-error", ml, context.DeadlineExceeded)
+	deleteCheckMetrics(labels)
+	if metricExistsWithLabels(t, "xray_tunnel_last_error_timestamp_seconds", labels) {
+		t.Error("expected xray_tunnel_last_error_timestamp_seconds to be deleted")
+	}
+}
+
 func TestCleanupRemovedTunnelMetrics_EmptyOld(t *testing.T) {
 	CleanupRemovedTunnelMetrics(nil, []*TunnelInstance{
 		{Name: "new", MetricLabels: MetricLabels{Server: "s:443", Security: "tls", SNI: "s"}},
@@ -735,7 +946,7 @@ func TestInitTunnel_XrayConfigFile(t *testing.T) {
 	tunnel := &config.Tunnel{
 		Name:           "json-tunnel",
 		XrayConfigFile: xrayConfigPath,
-		CheckURL:       "https://example.com",
+		CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 		CheckInterval:  "30s",
 		CheckTimeout:   "10s",
 	}
@@ -766,11 +977,597 @@ func TestInitTunnel_XrayConfigFile(t *testing.T) {
 	}
 }
 
+func TestInitTunnel_Checks(t *testing.T) {
+	tmpDir := t.TempDir()
+	xrayConfigPath := filepath.Join(tmpDir, "xray.json")
+	xrayJSON := `{"outbounds":[{"protocol":"vless","settings":{"vnext":[{"address":"example.com","port":443,"users":[{"id":"test-uuid","encryption":"none"}]}]},"streamSettings":{"network":"tcp","security":"tls","tlsSettings":{"serverName":"example.com"}}}]}`
+	os.WriteFile(xrayConfigPath, []byte(xrayJSON), 0644)
+
+	tunnel := &config.Tunnel{
+		Name:           "multi-check",
+		XrayConfigFile: xrayConfigPath,
+		CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
+		CheckInterval:  "30s",
+		CheckTimeout:   "10s",
+		UpPolicy:       "required",
+		Checks: []config.Check{
+			{Name: "reach", Required: true},
+			{Name: "speed", Method: "download", Interval: "5m", CheckSettings: config.CheckSettings{DownloadMinSize: 1024}},
+		},
+	}
+
+	ti, err := InitTunnel(tunnel, 11081)
+	if err != nil {
+		t.Fatalf("InitTunnel() error = %v", err)
+	}
+	defer ti.XrayInstance.Close()
+
+	if ti.UpPolicy != "required" {
+		t.Errorf("UpPolicy = %q, want required", ti.UpPolicy)
+	}
+	if len(ti.Checks) != 2 {
+		t.Fatalf("len(Checks) = %d, want 2", len(ti.Checks))
+	}
+
+	reach, speed := ti.Checks[0], ti.Checks[1]
+	if !reach.Required || speed.Required {
+		t.Errorf("Required = %v/%v, want true/false", reach.Required, speed.Required)
+	}
+	for _, c := range ti.Checks {
+		ci := c.Instance
+		if ci.Name != "multi-check" || ci.SocksPort != 11081 || ci.XrayInstance != ti.XrayInstance || ci.SocksAuth != ti.SocksAuth {
+			t.Errorf("check %q not bound to tunnel: name=%q port=%d", c.Name, ci.Name, ci.SocksPort)
+		}
+		if ci.MetricLabels.Check != c.Name || ci.MetricLabels.Server != "example.com:443" {
+			t.Errorf("check %q labels = %+v", c.Name, ci.MetricLabels)
+		}
+	}
+	if reach.Instance.CheckMethod != "http" || reach.Instance.CheckInterval != 30*time.Second {
+		t.Errorf("reach inherits method/interval: got %q/%v", reach.Instance.CheckMethod, reach.Instance.CheckInterval)
+	}
+	download, _ := speed.Instance.MethodConfig.(config.DownloadSettings)
+	if speed.Instance.CheckMethod != "download" || speed.Instance.CheckInterval != 5*time.Minute || download.MinSize != 1024 {
+		t.Errorf("speed overrides: got %q/%v/%d", speed.Instance.CheckMethod, speed.Instance.CheckInterval, download.MinSize)
+	}
+}
+
+func TestInitTunnel_SocksAuth(t *testing.T) {
+	off := false
+	tests := []struct {
+		name      string
+		socksAuth *bool
+		port      int
+	}{
+		{"default", nil, 11083},
+		{"opt-out", &off, 11084},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti, err := InitTunnel(&config.Tunnel{
+				Name:          "socks-auth",
+				URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=example.com",
+				CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
+				CheckInterval: "30s",
+				CheckTimeout:  "10s",
+				SocksAuth:     tt.socksAuth,
+			}, tt.port)
+			if err != nil {
+				t.Fatalf("InitTunnel() error = %v", err)
+			}
+			defer ti.XrayInstance.Close()
+			if err := WaitForSOCKSPort(tt.port, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			dial := func(d *socks.SOCKS5Dialer) error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				conn, err := d.DialContext(ctx, "tcp", "127.0.0.1:9")
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}
+			isAuthErr := func(err error) bool {
+				var authErr *socks.AuthError
+				return errors.As(err, &authErr) || errors.Is(err, socks.ErrNoAcceptableMethod)
+			}
+
+			anonymous := socks.NewSOCKS5Dialer(fmt.Sprintf("127.0.0.1:%d", tt.port), time.Second)
+			if tt.socksAuth != nil {
+				if ti.SocksAuth != nil {
+					t.Fatalf("SocksAuth = %+v, want none with socks_auth: false", ti.SocksAuth)
+				}
+				if err := dial(anonymous); isAuthErr(err) {
+					t.Errorf("anonymous dial rejected without socks_auth: %v", err)
+				}
+				return
+			}
+
+			if ti.SocksAuth == nil || ti.SocksAuth.Username == "" || len(ti.SocksAuth.Password) < 32 {
+				t.Fatalf("SocksAuth = %+v, want random credentials", ti.SocksAuth)
+			}
+			if err := dial(ti.SOCKSDialer(time.Second)); isAuthErr(err) {
+				t.Errorf("dial with the tunnel's credentials rejected: %v", err)
+			}
+			if err := dial(anonymous); !errors.Is(err, socks.ErrNoAcceptableMethod) {
+				t.Errorf("anonymous dial error = %v, want ErrNoAcceptableMethod", err)
+			}
+			wrong := ti.SOCKSDialer(time.Second)
+			wrong.Password = "wrong"
+			if err := dial(wrong); !isAuthErr(err) {
+				t.Errorf("dial with a wrong password error = %v, want an authentication error", err)
+			}
+		})
+	}
+}
+
+func TestInitTunnel_InvalidCheck(t *testing.T) {
+	tunnel := &config.Tunnel{
+		Name:          "bad-check",
+		URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=example.com",
+		CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
+		CheckInterval: "30s",
+		CheckTimeout:  "10s",
+		Checks:        []config.Check{{Name: "broken", Timeout: "soon"}},
+	}
+
+	_, err := InitTunnel(tunnel, 11082)
+	if err == nil || !strings.Contains(err.Error(), `check "broken"`) {
+		t.Errorf("expected check error, got: %v", err)
+	}
+}
+
+func TestNewCheckInstance_MethodConfig(t *testing.T) {
+	prev := config.SetMethodRegistry(config.MethodList{{
+		Name: "tunnel-test-options",
+		Decode: func(t *config.Tunnel) (any, error) {
+			var opts struct {
+				Port int `yaml:"port"`
+			}
+			err := config.DecodeOptions(t.Options, &opts)
+			return opts.Port, err
+		},
+	}})
+	defer config.SetMethodRegistry(prev)
+
+	tunnel := &config.Tunnel{
+		Name: "options",
+		CheckSettings: config.CheckSettings{
+			CheckURL: "https://example.com",
+			Options:  map[string]any{"port": 8443},
+		},
+		CheckInterval: "30s",
+		CheckTimeout:  "10s",
+		CheckMethod:   "tunnel-test-options",
+	}
+	ti, err := newCheckInstance(tunnel)
+	if err != nil {
+		t.Fatalf("newCheckInstance() error = %v", err)
+	}
+	if ti.MethodConfig != 8443 {
+		t.Errorf("MethodConfig = %v, want the decoded port 8443", ti.MethodConfig)
+	}
+
+	tunnel.Options = map[string]any{"port": "https"}
+	if _, err := newCheckInstance(tunnel); err == nil || !strings.Contains(err.Error(), "invalid options") {
+		t.Errorf("expected a decoding error, got: %v", err)
+	}
+}
+
+func TestCheckList_Implicit(t *testing.T) {
+	ti := &TunnelInstance{Name: "single", CheckMethod: "dns", MetricLabels: MetricLabels{Server: "s:443"}}
+
+	checks := ti.checkList()
+	if len(checks) != 1 {
+		t.Fatalf("len(checkList()) = %d, want 1", len(checks))
+	}
+	c := checks[0]
+	if c.Name != "dns" || !c.Required {
+		t.Errorf("implicit check = %q (required=%v), want dns (required)", c.Name, c.Required)
+	}
+	if c.Instance.MetricLabels.Check != "dns" || c.Instance.MetricLabels.Server != "s:443" {
+		t.Errorf("implicit check labels = %+v", c.Instance.MetricLabels)
+	}
+	if ti.MetricLabels.Check != "" {
+		t.Error("checkList must not modify the tunnel's own labels")
+	}
+}
+
+func TestEvaluateUpPolicy(t *testing.T) {
+	checks := []TunnelCheck{
+		{Name: "reach", Required: true},
+		{Name: "speed"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  string
+		results map[string]bool
+		want    bool
+	}{
+		{"all up", "all", map[string]bool{"reach": true, "speed": true}, true},
+		{"all with one down", "all", map[string]bool{"reach": true, "speed": false}, false},
+		{"empty policy means all", "", map[string]bool{"reach": true, "speed": false}, false},
+		{"any with one up", "any", map[string]bool{"reach": false, "speed": true}, true},
+		{"any all down", "any", map[string]bool{"reach": false, "speed": false}, false},
+		{"required optional down", "required", map[string]bool{"reach": true, "speed": false}, true},
+		{"required required down", "required", map[string]bool{"reach": false, "speed": true}, false},
+		{"pending checks ignored", "all", map[string]bool{"reach": true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := evaluateUpPolicy(tt.policy, checks, tt.results); got != tt.want {
+				t.Errorf("evaluateUpPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// scriptedChecker returns the scripted results in order, one per call.
+type scriptedChecker struct {
+	results []CheckResult
+	calls   int
+}
+
+func (c *scriptedChecker) Check(_ context.Context, ti *TunnelInstance) CheckResult {
+	r := c.results[c.calls%len(c.results)]
+	c.calls++
+	return r
+}
+
+func TestSampleCheck(t *testing.T) {
+	ok := func(ms int) CheckResult {
+		return CheckResult{Up: true, HTTPStatus: 200, Latency: time.Duration(ms) * time.Millisecond}
+	}
+	fail := CheckResult{Err: errors.New("i/o timeout")}
+
+	tests := []struct {
+		name       string
+		samples    int
+		maxLoss    float64
+		results    []CheckResult
+		wantUp     bool
+		wantErrs   int
+		wantCalls  int
+		wantLoss   float64
+		wantAvg    time.Duration
+		wantSample bool
+	}{
+		{"single sample passes through", 1, 0, []CheckResult{ok(10)}, true, 0, 1, 0, 10 * time.Millisecond, false},
+		{"single failed sample", 1, 0, []CheckResult{fail}, false, 1, 1, 0, 0, false},
+		{"all samples pass", 3, 0, []CheckResult{ok(10), ok(20), ok(30)}, true, 0, 3, 0, 20 * time.Millisecond, true},
+		{"loss above threshold", 4, 0.2, []CheckResult{ok(10), fail, ok(30), ok(50)}, false, 1, 4, 0.25, 30 * time.Millisecond, true},
+		{"loss within threshold", 4, 0.25, []CheckResult{ok(10), fail, ok(30), ok(50)}, true, 1, 4, 0.25, 30 * time.Millisecond, true},
+		{"all samples fail", 2, 1, []CheckResult{fail}, false, 2, 2, 1, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &scriptedChecker{results: tt.results}
+			ti := &TunnelInstance{Samples: tt.samples, MaxLoss: tt.maxLoss}
+
+			r, errs := sampleCheck(context.Background(), ti, checker)
+			if r.Up != tt.wantUp {
+				t.Errorf("Up = %v, want %v (err %v)", r.Up, tt.wantUp, r.Err)
+			}
+			if !r.Up && r.Err == nil {
+				t.Error("expected an error for a failed check")
+			}
+			if len(errs) != tt.wantErrs {
+				t.Errorf("got %d sample errors, want %d", len(errs), tt.wantErrs)
+			}
+			if checker.calls != tt.wantCalls {
+				t.Errorf("checker called %d times, want %d", checker.calls, tt.wantCalls)
+			}
+			if r.Latency != tt.wantAvg {
+				t.Errorf("Latency = %v, want %v", r.Latency, tt.wantAvg)
+			}
+			if (r.Samples != nil) != tt.wantSample {
+				t.Fatalf("Samples = %v, want set: %v", r.Samples, tt.wantSample)
+			}
+			if r.Samples != nil && r.Samples.Loss() != tt.wantLoss {
+				t.Errorf("Loss() = %v, want %v", r.Samples.Loss(), tt.wantLoss)
+			}
+		})
+	}
+}
+
+func TestSampleCheck_CanceledStopsSampling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	checker := &scriptedChecker{results: []CheckResult{{Up: true, Latency: time.Millisecond}}}
+	ti := &TunnelInstance{Samples: 5, SampleInterval: time.Hour}
+
+	r, _ := sampleCheck(ctx, ti, checker)
+	if checker.calls != 1 {
+		t.Errorf("checker called %d times after cancel, want 1", checker.calls)
+	}
+	if !r.Up || r.Samples.Count != 1 {
+		t.Errorf("got Up=%v Count=%d, want the first sample only", r.Up, r.Samples.Count)
+	}
+}
+
+func TestSampleStats_LatencyStats(t *testing.T) {
+	s := SampleStats{Count: 4, Latencies: []time.Duration{
+		10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 40 * time.Millisecond,
+	}}
+	minL, avg, maxL, stddev := s.LatencyStats()
+	if minL != 10*time.Millisecond || avg != 25*time.Millisecond || maxL != 40*time.Millisecond {
+		t.Errorf("LatencyStats() = %v/%v/%v, want 10ms/25ms/40ms", minL, avg, maxL)
+	}
+	// Population standard deviation of 10, 20, 30, 40 is sqrt(125) ms.
+	if want := time.Duration(math.Sqrt(125) * float64(time.Millisecond)); stddev != want {
+		t.Errorf("stddev = %v, want %v", stddev, want)
+	}
+
+	var empty SampleStats
+	if _, avg, _, _ := empty.LatencyStats(); avg != 0 || empty.Loss() != 0 {
+		t.Error("expected zero stats without samples")
+	}
+}
+
+func TestPrometheusMetrics_Samples(t *testing.T) {
+	ml := MetricLabels{Server: "sample.example.com:443", Security: "tls", SNI: "sample.example.com", Check: "http"}
+	labels := prometheus.Labels{
+		"name": "sampled", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "check": ml.Check,
+	}
+	defer deleteCheckMetrics(labels)
+
+	mu := NewPrometheusMetrics()
+	mu.Update("sampled", ml, CheckResult{
+		Up:      true,
+		Latency: 20 * time.Millisecond,
+		Samples: &SampleStats{Count: 4, Failed: 1, Latencies: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}},
+	})
+
+	var m dto.Metric
+	if err := metrics.TunnelSampleLoss.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0.25 {
+		t.Errorf("xray_tunnel_sample_loss_ratio = %v, want 0.25", got)
+	}
+
+	maxLabels := prometheus.Labels{"stat": "max"}
+	maps.Copy(maxLabels, labels)
+	if err := metrics.TunnelSampleLatency.With(maxLabels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0.03 {
+		t.Errorf("xray_tunnel_sample_latency_seconds{stat=max} = %v, want 0.03", got)
+	}
+
+	if err := metrics.TunnelLatencyHistogram.With(labels).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("latency histogram has %d observations, want one per successful sample (3)", got)
+	}
+
+	deleteCheckMetrics(labels)
+	for _, name := range []string{"xray_tunnel_sample_loss_ratio", "xray_tunnel_sample_latency_seconds"} {
+		if metricExistsWithLabels(t, name, labels) {
+			t.Errorf("expected %s to be deleted", name)
+		}
+	}
+}
+
+func TestConcurrencyStats(t *testing.T) {
+	s := ConcurrencyStats{Requests: 5, Failed: 1, Latencies: []time.Duration{
+		40 * time.Millisecond, 10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond,
+	}}
+	if got := s.SuccessRatio(); got != 0.8 {
+		t.Errorf("SuccessRatio() = %v, want 0.8", got)
+	}
+	for q, want := range map[float64]time.Duration{
+		0:    10 * time.Millisecond,
+		0.5:  20 * time.Millisecond,
+		0.9:  40 * time.Millisecond,
+		0.99: 40 * time.Millisecond,
+		1:    40 * time.Millisecond,
+	} {
+		if got := s.Quantile(q); got != want {
+			t.Errorf("Quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+	if s.Latencies[0] != 40*time.Millisecond {
+		t.Error("Quantile must not reorder the latencies")
+	}
+
+	var empty ConcurrencyStats
+	if empty.SuccessRatio() != 0 || empty.Quantile(0.5) != 0 {
+		t.Error("expected zero stats without requests")
+	}
+}
+
+func TestPrometheusMetrics_Concurrency(t *testing.T) {
+	ml := MetricLabels{Server: "mux.example.com:443", Security: "reality", SNI: "google.com", Check: "burst"}
+	labels := prometheus.Labels{
+		"name": "mux", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "check": ml.Check,
+	}
+	defer deleteCheckMetrics(labels)
+
+	mu := NewPrometheusMetrics()
+	mu.Update("mux", ml, CheckResult{
+		Up:      true,
+		Latency: 20 * time.Millisecond,
+		Concurrency: &ConcurrencyStats{Requests: 4, Failed: 1, MaxInFlight: 4, Latencies: []time.Duration{
+			10 * time.Millisecond, 20 * time.Millisecond, 90 * time.Millisecond,
+		}},
+	})
+
+	var m dto.Metric
+	if err := metrics.TunnelConcurrencySuccessRatio.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0.75 {
+		t.Errorf("xray_tunnel_concurrency_success_ratio = %v, want 0.75", got)
+	}
+	if err := metrics.TunnelConcurrencyMaxInFlight.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 4 {
+		t.Errorf("xray_tunnel_concurrency_max_in_flight = %v, want 4", got)
+	}
+	p99 := prometheus.Labels{"quantile": "0.99"}
+	maps.Copy(p99, labels)
+	if err := metrics.TunnelConcurrencyLatency.With(p99).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0.09 {
+		t.Errorf("xray_tunnel_concurrency_latency_seconds{quantile=0.99} = %v, want 0.09", got)
+	}
+	if err := metrics.TunnelLatencyHistogram.With(labels).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("latency histogram has %d observations, want one per successful request (3)", got)
+	}
+
+	// Without successful requests the quantiles of the previous check go.
+	mu.Update("mux", ml, CheckResult{Up: false, Concurrency: &ConcurrencyStats{Requests: 4, Failed: 4}})
+	if metricExistsWithLabels(t, "xray_tunnel_concurrency_latency_seconds", p99) {
+		t.Error("expected stale latency quantiles to be removed")
+	}
+
+	deleteCheckMetrics(labels)
+	for _, name := range []string{"xray_tunnel_concurrency_success_ratio", "xray_tunnel_concurrency_max_in_flight"} {
+		if metricExistsWithLabels(t, name, labels) {
+			t.Errorf("expected %s to be deleted", name)
+		}
+	}
+}
+
+func TestPrometheusMetrics_ExecValueAndRoundTrip(t *testing.T) {
+	ml := MetricLabels{Server: "exec.example.com:443", Security: "tls", SNI: "exec.example.com", Check: "speedtest"}
+	labels := prometheus.Labels{
+		"name": "exec", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "check": ml.Check,
+	}
+	defer deleteCheckMetrics(labels)
+
+	mu := NewPrometheusMetrics()
+	mu.Update("exec", ml, CheckResult{Up: false})
+	if metricExistsWithLabels(t, "xray_tunnel_exec_value", labels) {
+		t.Error("expected no exec value without a parsed value")
+	}
+
+	v := 93.21
+	mu.Update("exec", ml, CheckResult{Up: true, ExecValue: &v, RoundTrip: 40 * time.Millisecond})
+	var m dto.Metric
+	if err := metrics.TunnelExecValue.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != v {
+		t.Errorf("xray_tunnel_exec_value = %v, want %v", got, v)
+	}
+	if !metricExistsWithLabels(t, "xray_tunnel_websocket_rtt_seconds", labels) {
+		t.Error("expected the round trip to be recorded")
+	}
+
+	deleteCheckMetrics(labels)
+	if metricExistsWithLabels(t, "xray_tunnel_exec_value", labels) ||
+		metricExistsWithLabels(t, "xray_tunnel_websocket_rtt_seconds", labels) {
+		t.Error("expected the exec value and round trip to be deleted with the check")
+	}
+}
+
+func TestPrometheusMetrics_ProtocolInfo(t *testing.T) {
+	ml := MetricLabels{Server: "h3.example.com:443", Security: "reality", SNI: "google.com", Check: "h3"}
+	labels := prometheus.Labels{
+		"name": "h3", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "check": ml.Check,
+	}
+	defer deleteCheckMetrics(labels)
+	protocolLabels := func(protocol string) prometheus.Labels {
+		l := prometheus.Labels{"protocol": protocol}
+		maps.Copy(l, labels)
+		return l
+	}
+
+	mu := NewPrometheusMetrics()
+	mu.Update("h3", ml, CheckResult{Up: true, Protocol: "h3"})
+	if !metricExistsWithLabels(t, "xray_tunnel_protocol_info", protocolLabels("h3")) {
+		t.Error("expected protocol info for h3")
+	}
+
+	// A failed check without a response keeps the last protocol.
+	mu.Update("h3", ml, CheckResult{Up: false})
+	if !metricExistsWithLabels(t, "xray_tunnel_protocol_info", protocolLabels("h3")) {
+		t.Error("expected protocol info to survive a check without a response")
+	}
+
+	mu.Update("h3", ml, CheckResult{Up: true, Protocol: "HTTP/3.0"})
+	if metricExistsWithLabels(t, "xray_tunnel_protocol_info", protocolLabels("h3")) {
+		t.Error("expected the previous protocol series to be replaced")
+	}
+
+	deleteCheckMetrics(labels)
+	if metricExistsWithLabels(t, "xray_tunnel_protocol_info", protocolLabels("HTTP/3.0")) {
+		t.Error("expected protocol info to be deleted with the check")
+	}
+}
+
+func TestPrometheusMetrics_Exit(t *testing.T) {
+	ml := MetricLabels{Server: "exit.example.com:443", Security: "reality", SNI: "google.com", Check: "ip"}
+	labels := prometheus.Labels{
+		"name": "exit", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "check": ml.Check,
+	}
+	defer deleteCheckMetrics(labels)
+
+	exitLabels := func(ip, country, asn string) prometheus.Labels {
+		l := prometheus.Labels{"ip": ip, "country": country, "asn": asn}
+		maps.Copy(l, labels)
+		return l
+	}
+	changes := func() float64 {
+		var m dto.Metric
+		if err := metrics.TunnelExitIPChangesTotal.With(labels).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	mu := NewPrometheusMetrics()
+	mu.Update("exit", ml, CheckResult{Up: true, Exit: &ExitInfo{IP: "203.0.113.5", Country: "DE", ASN: "AS24940"}})
+	if !metricExistsWithLabels(t, "xray_tunnel_exit_info", exitLabels("203.0.113.5", "DE", "AS24940")) {
+		t.Error("expected exit info for the first exit")
+	}
+	if got := changes(); got != 0 {
+		t.Errorf("exit IP changes after the first check = %v, want 0", got)
+	}
+
+	mu.Update("exit", ml, CheckResult{Up: true, Exit: &ExitInfo{IP: "203.0.113.5", Country: "DE", ASN: "AS24940"}})
+	mu.Update("exit", ml, CheckResult{Up: true, Exit: &ExitInfo{IP: "198.51.100.7", Country: "NL", ASN: "AS14061"}})
+	mu.Update("exit", ml, CheckResult{Up: false})
+	if got := changes(); got != 1 {
+		t.Errorf("exit IP changes = %v, want 1", got)
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_exit_info", exitLabels("203.0.113.5", "DE", "AS24940")) {
+		t.Error("expected the previous exit info series to be replaced")
+	}
+	if !metricExistsWithLabels(t, "xray_tunnel_exit_info", exitLabels("198.51.100.7", "NL", "AS14061")) {
+		t.Error("expected exit info for the new exit")
+	}
+
+	deleteCheckMetrics(labels)
+	if metricExistsWithLabels(t, "xray_tunnel_exit_info", labels) {
+		t.Error("expected exit info to be deleted")
+	}
+	// A check recreated after deletion starts without a previous exit.
+	mu.Update("exit", ml, CheckResult{Up: true, Exit: &ExitInfo{IP: "192.0.2.9"}})
+	if got := changes(); got != 0 {
+		t.Errorf("exit IP changes after recreation = %v, want 0", got)
+	}
+}
+
 func TestInitTunnel_VLESSURLParseError(t *testing.T) {
 	tunnel := &config.Tunnel{
 		Name:          "bad-vless",
 		URL:           "vless://bad-url-no-port",
-		CheckURL:      "https://example.com",
+		CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
 		CheckInterval: "30s",
 		CheckTimeout:  "10s",
 	}
@@ -789,7 +1586,7 @@ func TestInitTunnel_InvalidDurations(t *testing.T) {
 		tunnel := &config.Tunnel{
 			Name:          "test",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "https://example.com",
+			CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "invalid-duration",
 			CheckTimeout:  "10s",
 		}
@@ -807,7 +1604,7 @@ func TestInitTunnel_InvalidDurations(t *testing.T) {
 		tunnel := &config.Tunnel{
 			Name:          "test",
 			URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-			CheckURL:      "https://example.com",
+			CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
 			CheckInterval: "30s",
 			CheckTimeout:  "not-a-duration",
 		}
@@ -827,7 +1624,7 @@ func TestInitTunnel_InvalidBackoffMultiplier(t *testing.T) {
 	tunnel := &config.Tunnel{
 		Name:              "bad-mult",
 		URL:               "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-		CheckURL:          "https://example.com",
+		CheckSettings:     config.CheckSettings{CheckURL: "https://example.com"},
 		CheckInterval:     "30s",
 		CheckTimeout:      "10s",
 		BackoffMultiplier: &mult,
@@ -846,7 +1643,7 @@ func TestInitTunnel_InvalidMaxBackoff(t *testing.T) {
 	tunnel := &config.Tunnel{
 		Name:          "bad-backoff",
 		URL:           "vless://uuid@example.com:443?type=tcp&security=tls&sni=test.com&fp=chrome",
-		CheckURL:      "https://example.com",
+		CheckSettings: config.CheckSettings{CheckURL: "https://example.com"},
 		CheckInterval: "30s",
 		CheckTimeout:  "10s",
 		MaxBackoff:    "not-a-duration",
@@ -876,7 +1673,7 @@ func TestInitTunnel_XrayConfigFile_AutoName(t *testing.T) {
 
 	tunnel := &config.Tunnel{
 		XrayConfigFile: xrayConfigPath,
-		CheckURL:       "https://example.com",
+		CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 		CheckInterval:  "30s",
 		CheckTimeout:   "10s",
 	}
@@ -901,7 +1698,7 @@ func TestInitTunnel_XrayConfigFile_FallbackName(t *testing.T) {
 
 	tunnel := &config.Tunnel{
 		XrayConfigFile: xrayConfigPath,
-		CheckURL:       "https://example.com",
+		CheckSettings:  config.CheckSettings{CheckURL: "https://example.com"},
 		CheckInterval:  "30s",
 		CheckTimeout:   "10s",
 	}
@@ -1156,13 +1953,17 @@ func BenchmarkMetricsUpdate(b *testing.B) {
 			"security": "tls",
 			"sni":      "example.com",
 		}
+		checkLabels := prometheus.Labels{
+			"name": labels["name"], "server": labels["server"],
+			"security": labels["security"], "sni": labels["sni"], "check": "http",
+		}
 		metrics.TunnelUp.With(labels).Set(1)
-		metrics.TunnelLatency.With(labels).Set(0.123)
+		metrics.TunnelLatency.With(checkLabels).Set(0.123)
 		metrics.TunnelLastSuccess.With(labels).Set(float64(time.Now().Unix()))
-		metrics.TunnelHTTPStatus.With(labels).Set(200)
+		metrics.TunnelHTTPStatus.With(checkLabels).Set(200)
 		resultLabels := prometheus.Labels{
 			"name": labels["name"], "server": labels["server"],
-			"security": labels["security"], "sni": labels["sni"], "result": "success",
+			"security": labels["security"], "sni": labels["sni"], "check": "http", "result": "success",
 		}
 		metrics.TunnelCheckTotal.With(resultLabels).Inc()
 	}
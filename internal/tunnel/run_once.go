@@ -1,12 +1,11 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log/slog"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/batonogov/xray-health-exporter/internal/config"
 	"github.com/batonogov/xray-health-exporter/internal/metrics"
@@ -18,19 +17,22 @@ import (
 // one health-check per tunnel (concurrently), updates Prometheus metrics, and
 // writes all metrics in Prometheus text-exposition format to w.
 //
-// It returns allUp=true only if every tunnel check returned Up==true.
+// It returns allUp=true only if every tunnel is up according to its
+// up_policy (by default: every check returned Up==true) and no check was
+// unknown because the baseline probe failed.
 //
-// Checks are individually bounded by each tunnel's CheckTimeout, so no
-// external context is required for cancellation.
+// Checks are individually bounded by each tunnel's CheckTimeout. Canceling
+// ctx aborts the outstanding checks, and RunOnce then returns ctx.Err()
+// without writing metrics.
 //
 // Unlike RunProbing, this function:
 //   - Does NOT start the HTTP server, config watcher, or subscription watcher.
 //   - Does NOT use RunTunnelChecker (which loops forever).
-//   - Performs a single PerformCheck per tunnel instead.
+//   - Performs a single run of each tunnel check instead.
 //   - Ignores leader election — run-once is a single-shot local action intended
 //     for CI, scripts, and debugging. It always runs regardless of leader
 //     election configuration.
-func RunOnce(configFile string, checker HealthChecker, mu MetricsUpdater, w io.Writer) (bool, error) {
+func RunOnce(ctx context.Context, configFile string, checker HealthChecker, mu MetricsUpdater, w io.Writer) (bool, error) {
 	cfg, err := config.LoadConfig(configFile)
 	if err != nil {
 		return false, fmt.Errorf("failed to load config: %w", err)
@@ -55,45 +57,61 @@ func RunOnce(configFile string, checker HealthChecker, mu MetricsUpdater, w io.W
 
 	metrics.SetTunnelsConfigured(len(instances))
 
-	// Perform exactly one check per tunnel, concurrently.
-	var allUp atomic.Bool
-	allUp.Store(true)
-
-	var wg sync.WaitGroup
-	for _, ti := range instances {
-		wg.Add(1)
-		go func(ti *TunnelInstance) {
-			defer wg.Done()
-
-			result := checker.Check(ti)
-
-			if !result.Up {
-				allUp.Store(false)
-			}
-
-			if !result.Up && result.Err != nil {
-				mu.RecordError(ti.Name, ti.MetricLabels, result.Err)
-			}
-
-			if result.Up {
-				slog.Info("tunnel UP", "tunnel", ti.Name, "latency", result.Latency.Round(time.Millisecond))
-			} else if result.Err != nil {
-				slog.Error("tunnel DOWN", "tunnel", ti.Name, "error", result.Err)
-			} else {
-				slog.Error("tunnel DOWN", "tunnel", ti.Name)
-			}
+	if cfg.Baseline.Enabled {
+		baseline, err := NewBaseline(cfg.Baseline, cfg.Tunnels)
+		if err != nil {
+			return false, err
+		}
+		baseline.Probe(ctx)
+		if cfg.Baseline.MarkUnknown {
+			checker = WithBaseline(checker, baseline)
+		}
+	}
 
-			mu.Update(ti.Name, ti.MetricLabels, result)
-		}(ti)
+	// Perform exactly one run of every check of every tunnel, concurrently.
+	statuses := make([]*tunnelStatus, len(instances))
+	var (
+		wg         sync.WaitGroup
+		anyUnknown atomic.Bool
+	)
+	for i, ti := range instances {
+		if ti.ServerProbe && ti.VLESSConfig != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				probeAndRecordServer(ctx, ti, mu)
+			}()
+		}
+		checks := ti.checkList()
+		statuses[i] = newTunnelStatus(ti.UpPolicy, checks)
+		for _, c := range checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if checkAndRecord(ctx, ti, c, statuses[i], checker, mu).Unknown {
+					anyUnknown.Store(true)
+				}
+			}()
+		}
 	}
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	allUp := !anyUnknown.Load()
+	for _, st := range statuses {
+		if !evaluateUpPolicy(st.policy, st.checks, st.results) {
+			allUp = false
+		}
+	}
 
 	// Encode all metrics from the default registry in Prometheus text format.
 	if err := encodeMetrics(w); err != nil {
-		return allUp.Load(), fmt.Errorf("failed to encode metrics: %w", err)
+		return allUp, fmt.Errorf("failed to encode metrics: %w", err)
 	}
 
-	return allUp.Load(), nil
+	return allUp, nil
 }
 
 // encodeMetrics gathers all registered metric families from the default
@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,7 +16,7 @@ type fakeChecker struct {
 	downTunnels map[string]bool
 }
 
-func (fc fakeChecker) Check(ti *TunnelInstance) CheckResult {
+func (fc fakeChecker) Check(_ context.Context, ti *TunnelInstance) CheckResult {
 	if fc.downTunnels[ti.Name] {
 		return CheckResult{Up: false, Err: errFakeDown}
 	}
@@ -67,6 +68,7 @@ func TestRunOnce_AllUp(t *testing.T) {
 
 	var buf bytes.Buffer
 	allUp, err := RunOnce(
+		context.Background(),
 		configFile,
 		fakeChecker{downTunnels: nil},
 		NewPrometheusMetrics(),
@@ -93,6 +95,7 @@ func TestRunOnce_OneDown(t *testing.T) {
 
 	var buf bytes.Buffer
 	allUp, err := RunOnce(
+		context.Background(),
 		configFile,
 		fakeChecker{downTunnels: map[string]bool{"tunnel-b": true}},
 		NewPrometheusMetrics(),
@@ -119,6 +122,7 @@ func TestRunOnce_InvalidConfig(t *testing.T) {
 	configPath := filepath.Join(tmpDir, "nonexistent.yaml")
 
 	_, err := RunOnce(
+		context.Background(),
 		configPath,
 		fakeChecker{},
 		NewPrometheusMetrics(),
@@ -137,6 +141,7 @@ func TestRunOnce_NoTunnels(t *testing.T) {
 	}
 
 	_, err := RunOnce(
+		context.Background(),
 		configPath,
 		fakeChecker{},
 		NewPrometheusMetrics(),
@@ -179,3 +184,57 @@ func assertGaugeValue(t *testing.T, output, name, want string) {
 	}
 	t.Errorf("expected xray_tunnel_up line for tunnel %q in output, got:\n%s", name, output)
 }
+
+// checkNameChecker fails the checks whose name is in downChecks.
+type checkNameChecker struct {
+	downChecks map[string]bool
+}
+
+func (cc checkNameChecker) Check(_ context.Context, ti *TunnelInstance) CheckResult {
+	if cc.downChecks[ti.MetricLabels.Check] {
+		return CheckResult{Up: false, Err: errFakeDown}
+	}
+	return CheckResult{Up: true, HTTPStatus: 200, Latency: 5 * time.Millisecond}
+}
+
+func TestRunOnce_UpPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   bool
+	}{
+		{"all", false},
+		{"any", true},
+		{"required", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			xrayConfigPath := filepath.Join(tmpDir, "xray.json")
+			xrayJSON := `{"outbounds":[{"protocol":"vless","settings":{"vnext":[{"address":"example.com","port":443,"users":[{"id":"test-uuid","encryption":"none"}]}]},"streamSettings":{"network":"tcp","security":"tls","tlsSettings":{"serverName":"example.com"}}}]}`
+			if err := os.WriteFile(xrayConfigPath, []byte(xrayJSON), 0644); err != nil {
+				t.Fatalf("failed to write xray config: %v", err)
+			}
+			cfg := "tunnels:\n  - name: policy-" + tt.policy +
+				"\n    xray_config_file: " + xrayConfigPath +
+				"\n    up_policy: " + tt.policy +
+				"\n    checks:\n      - name: reach\n        required: true\n      - name: speed\n        method: download\n"
+			configPath := filepath.Join(tmpDir, "config.yaml")
+			if err := os.WriteFile(configPath, []byte(cfg), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			var buf bytes.Buffer
+			allUp, err := RunOnce(context.Background(), configPath, checkNameChecker{downChecks: map[string]bool{"speed": true}}, NewPrometheusMetrics(), &buf)
+			if err != nil {
+				t.Fatalf("RunOnce() error = %v", err)
+			}
+			if allUp != tt.want {
+				t.Errorf("allUp = %v, want %v", allUp, tt.want)
+			}
+			if !strings.Contains(buf.String(), `check="speed"`) {
+				t.Error("expected per-check metrics with check label in output")
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeServer probes the tunnel's VLESS server directly, bypassing Xray (see
+// probeServerConn). For security=reality it also probes the camouflage
+// target named by the link's sni (see probeRealityTarget). A link without one
+// names no target: its SNI defaults to the server address, which is not worth
+// probing as a camouflage site, so that probe is skipped with an error.
+func probeServer(ctx context.Context, vc *VLESSConfig, timeout time.Duration) ServerProbeResult {
+	r := probeServerConn(ctx, vc, timeout)
+	if vc.Security != "reality" {
+		return r
+	}
+	if vc.SNIDefaulted {
+		r.Err = errors.Join(r.Err, errors.New("reality target not probed: the link has no sni"))
+		return r
+	}
+
+	r.Target = true
+	latency, err := probeRealityTarget(ctx, vc.SNI, timeout)
+	if err != nil {
+		r.Err = errors.Join(r.Err, fmt.Errorf("reality target %s: %w", vc.SNI, err))
+		return r
+	}
+	r.TargetUp = true
+	r.TargetLatency = latency
+	return r
+}
+
+// probeServerConn connects to the tunnel's VLESS server and for security=tls
+// also performs a TLS handshake with the configured SNI and ALPN. The
+// certificate is verified the way Xray verifies it (see verifyPeer), and the
+// leaf is reported even when verification fails. REALITY servers get the TCP
+// stage only: a plain TLS handshake would be answered by the camouflage
+// target.
+func probeServerConn(ctx context.Context, vc *VLESSConfig, timeout time.Duration) ServerProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var r ServerProbeResult
+	addr := net.JoinHostPort(vc.Address, strconv.Itoa(vc.Port))
+
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		r.TLS = vc.Security == "tls"
+		r.Err = fmt.Errorf("tcp connect to %s: %w", addr, err)
+		return r
+	}
+	defer conn.Close()
+	r.TCPUp = true
+	r.TCPLatency = time.Since(start)
+
+	if vc.Security != "tls" {
+		return r
+	}
+	r.TLS = true
+
+	names := verifyNames(vc)
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         vc.SNI,
+		NextProtos:         vc.ALPN,
+		InsecureSkipVerify: true, // verified below, like Xray does
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("tls: server sent no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			r.Cert = &CertInfo{
+				NotAfter: leaf.NotAfter,
+				Issuer:   cmp.Or(leaf.Issuer.CommonName, leaf.Issuer.String()),
+				SANMatch: slices.ContainsFunc(names, func(n string) bool { return leaf.VerifyHostname(n) == nil }),
+			}
+			return verifyPeer(cs.PeerCertificates, vc.PinnedPeerCertSHA256, names)
+		},
+	})
+
+	start = time.Now()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		r.Err = fmt.Errorf("tls handshake with %s: %w", addr, err)
+		return r
+	}
+	r.TLSUp = true
+	r.TLSLatency = time.Since(start)
+	return r
+}
+
+// realityTargetAddr returns the address a REALITY camouflage target is
+// probed at. Tests replace it.
+var realityTargetAddr = func(sni string) string {
+	return net.JoinHostPort(sni, "443")
+}
+
+// probeRealityTarget checks that the REALITY camouflage target sni completes
+// a TLS 1.3 handshake with a certificate valid for sni, which REALITY needs
+// to borrow the target's handshake. The target is probed from the exporter,
+// not from the server, so this catches bad sni choices rather than the
+// server's own route to the target.
+func probeRealityTarget(ctx context.Context, sni string, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d := tls.Dialer{Config: &tls.Config{
+		ServerName: sni,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{"h2", "http/1.1"},
+		RootCAs:    serverProbeRootCAs,
+	}}
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", realityTargetAddr(sni))
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// serverProbeRootCAs are the roots server certificates are verified against;
+// nil means the system roots. Tests replace it.
+var serverProbeRootCAs *x509.CertPool
+
+// verifyNames returns the names the server certificate is verified for: the
+// comma-separated vcn list if set, the SNI otherwise.
+func verifyNames(vc *VLESSConfig) []string {
+	if vc.VerifyPeerCertByName == "" {
+		return []string{vc.SNI}
+	}
+	var names []string
+	for n := range strings.SplitSeq(vc.VerifyPeerCertByName, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// verifyPeer verifies the certificate chain certs the way Xray does for a
+// link with the given pcs pins and verification names. A pinned leaf is
+// accepted as is; a pinned CA in the chain replaces the root CAs. Otherwise
+// the chain must be valid for one of names.
+func verifyPeer(certs []*x509.Certificate, pcs string, names []string) error {
+	roots := serverProbeRootCAs
+	if pcs != "" {
+		pins, err := parsePins(pcs)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(certs, func(c *x509.Certificate) bool {
+			sum := sha256.Sum256(c.Raw)
+			return slices.ContainsFunc(pins, func(p []byte) bool { return bytes.Equal(p, sum[:]) })
+		})
+		switch {
+		case i < 0:
+			return fmt.Errorf("tls: certificate does not match pcs")
+		case i == 0:
+			return nil
+		}
+		roots = x509.NewCertPool()
+		roots.AddCert(certs[i])
+	}
+
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	var err error
+	for _, opts.DNSName = range names {
+		if _, err = certs[0].Verify(opts); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// parsePins parses a pcs value: comma-separated hex SHA-256 fingerprints,
+// optionally colon-separated as printed by OpenSSL.
+func parsePins(pcs string) ([][]byte, error) {
+	var pins [][]byte
+	for v := range strings.SplitSeq(pcs, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		pin, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pcs fingerprint %q", v)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// runServerProbeLoop probes the tunnel's server every CheckInterval until ctx
+// is canceled. Each probe is bounded by CheckTimeout.
+func runServerProbeLoop(ctx context.Context, ti *TunnelInstance, mu MetricsUpdater) {
+	jitter := time.Duration(rand.Int64N(int64(ti.CheckInterval)))
+	timer := time.NewTimer(jitter)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(ti.CheckInterval)
+	defer ticker.Stop()
+	for {
+		probeAndRecordServer(ctx, ti, mu)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAndRecordServer runs one direct server probe and records the result.
+func probeAndRecordServer(ctx context.Context, ti *TunnelInstance, mu MetricsUpdater) ServerProbeResult {
+	r := probeServer(ctx, ti.VLESSConfig, ti.CheckTimeout)
+	if r.Err != nil {
+		slog.Warn("server probe failed", "tunnel", ti.Name, "server", ti.MetricLabels.Server, "error", r.Err)
+	} else {
+		slog.Debug("server probe ok", "tunnel", ti.Name, "server", ti.MetricLabels.Server,
+			"tcp", r.TCPLatency.Round(time.Millisecond), "tls", r.TLSLatency.Round(time.Millisecond),
+			"reality_target", r.TargetLatency.Round(time.Millisecond))
+	}
+	if r.Cert != nil {
+		slog.Debug("server certificate", "tunnel", ti.Name, "issuer", r.Cert.Issuer,
+			"not_after", r.Cert.NotAfter.Format(time.RFC3339), "san_match", r.Cert.SANMatch)
+	}
+	mu.UpdateServerProbe(ti.Name, ti.MetricLabels, r)
+	return r
+}
@@ -0,0 +1,273 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// vlessConfigFor returns a VLESSConfig pointing at the listener address addr.
+func vlessConfigFor(t *testing.T, addr, security, sni string) *VLESSConfig {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	return &VLESSConfig{Address: host, Port: port, Security: security, SNI: sni}
+}
+
+func TestProbeServer_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	r := probeServer(context.Background(), vlessConfigFor(t, addr, "none", ""), 2*time.Second)
+	if !r.TCPUp || r.Err != nil {
+		t.Errorf("expected tcp up, got %+v", r)
+	}
+	if r.TLS || r.Target {
+		t.Error("expected no TLS or REALITY target stage for security=none")
+	}
+
+	ln.Close()
+	r = probeServer(context.Background(), vlessConfigFor(t, addr, "none", ""), 2*time.Second)
+	if r.TCPUp || r.Err == nil {
+		t.Errorf("expected tcp down for a closed port, got %+v", r)
+	}
+}
+
+func TestProbeServer_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	serverProbeRootCAs = roots
+	defer func() { serverProbeRootCAs = nil }()
+
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	pin := hex.EncodeToString(sum[:])
+	otherPin := strings.Repeat("ab", sha256.Size)
+
+	addr := srv.Listener.Addr().String()
+	tests := []struct {
+		name         string
+		sni          string
+		pinned       string
+		verifyBy     string
+		wantTLSUp    bool
+		wantSANMatch bool
+	}{
+		{"valid certificate", "example.com", "", "", true, true},
+		{"name mismatch", "wrong.test", "", "", false, false},
+		{"verified by vcn", "wrong.test", "", "example.com", true, true},
+		{"verified by one of the vcn names", "wrong.test", "", "other.test, example.com", true, true},
+		{"pinned leaf skips chain verification", "wrong.test", otherPin + "," + pin, "", true, false},
+		{"pin mismatch", "example.com", otherPin, "", false, true},
+		{"malformed pin", "example.com", "deadbeef", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := vlessConfigFor(t, addr, "tls", tt.sni)
+			vc.PinnedPeerCertSHA256 = tt.pinned
+			vc.VerifyPeerCertByName = tt.verifyBy
+
+			r := probeServer(context.Background(), vc, 2*time.Second)
+			if !r.TCPUp || !r.TLS {
+				t.Fatalf("expected tcp up with a TLS stage, got %+v", r)
+			}
+			if r.TLSUp != tt.wantTLSUp {
+				t.Errorf("TLSUp = %v, want %v (err: %v)", r.TLSUp, tt.wantTLSUp, r.Err)
+			}
+			if r.Cert == nil {
+				t.Fatal("expected the certificate to be reported")
+			}
+			if !r.Cert.NotAfter.Equal(srv.Certificate().NotAfter) {
+				t.Errorf("NotAfter = %v, want %v", r.Cert.NotAfter, srv.Certificate().NotAfter)
+			}
+			if r.Cert.Issuer != "O=Acme Co" {
+				t.Errorf("Issuer = %q, want O=Acme Co", r.Cert.Issuer)
+			}
+			if r.Cert.SANMatch != tt.wantSANMatch {
+				t.Errorf("SANMatch = %v, want %v", r.Cert.SANMatch, tt.wantSANMatch)
+			}
+		})
+	}
+}
+
+func TestProbeServer_RealityTarget(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tls13 := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tls13.Close()
+	tls12 := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tls12.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	tls12.StartTLS()
+	defer tls12.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tls13.Certificate())
+	roots.AddCert(tls12.Certificate())
+	serverProbeRootCAs = roots
+	defer func() { serverProbeRootCAs = nil }()
+	defaultTargetAddr := realityTargetAddr
+	defer func() { realityTargetAddr = defaultTargetAddr }()
+
+	tests := []struct {
+		name   string
+		target string
+		sni    string
+		wantUp bool
+	}{
+		{"TLS 1.3 target", tls13.Listener.Addr().String(), "example.com", true},
+		{"TLS 1.2 only", tls12.Listener.Addr().String(), "example.com", false},
+		{"certificate not valid for sni", tls13.Listener.Addr().String(), "wrong.test", false},
+		{"unreachable", strings.TrimPrefix(closedURL(t), "http://"), "example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			realityTargetAddr = func(string) string { return tt.target }
+			r := probeServer(context.Background(), vlessConfigFor(t, server.Addr().String(), "reality", tt.sni), 2*time.Second)
+			if !r.TCPUp || r.TLS {
+				t.Errorf("expected tcp up without a TLS stage, got %+v", r)
+			}
+			if !r.Target || r.TargetUp != tt.wantUp {
+				t.Errorf("Target/TargetUp = %v/%v, want true/%v (err: %v)", r.Target, r.TargetUp, tt.wantUp, r.Err)
+			}
+			if tt.wantUp != (r.Err == nil) {
+				t.Errorf("Err = %v, want an error only for a failed target", r.Err)
+			}
+		})
+	}
+}
+
+func TestProbeServer_RealityWithoutSNI(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	defaultTargetAddr := realityTargetAddr
+	defer func() { realityTargetAddr = defaultTargetAddr }()
+	realityTargetAddr = func(sni string) string {
+		t.Errorf("target probed at %q without an sni", sni)
+		return defaultTargetAddr(sni)
+	}
+
+	vc, err := ParseVLESSURL("vless://uuid@" + server.Addr().String() + "?security=reality&pbk=key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vc.SNI != vc.Address {
+		t.Fatalf("SNI = %q, want the server address %q", vc.SNI, vc.Address)
+	}
+	r := probeServer(context.Background(), vc, 2*time.Second)
+	if !r.TCPUp || r.Target {
+		t.Errorf("expected tcp up and no target probe, got %+v", r)
+	}
+	if r.Err == nil || !strings.Contains(r.Err.Error(), "no sni") {
+		t.Errorf("Err = %v, want the skipped target reported", r.Err)
+	}
+}
+
+func TestPrometheusMetrics_ServerProbe(t *testing.T) {
+	ml := MetricLabels{Server: "probe.example.com:443", Security: "tls", SNI: "probe.example.com"}
+	labels := prometheus.Labels{"name": "probe", "server": ml.Server, "security": ml.Security, "sni": ml.SNI}
+	defer deleteServerProbeMetrics(labels)
+
+	stageLabels := func(stage string) prometheus.Labels {
+		return prometheus.Labels{"name": "probe", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "stage": stage}
+	}
+	value := func(stage string) float64 {
+		var m dto.Metric
+		if err := metrics.TunnelServerUp.With(stageLabels(stage)).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	mu := NewPrometheusMetrics()
+	mu.UpdateServerProbe("probe", ml, ServerProbeResult{TCPUp: true, TCPLatency: 20 * time.Millisecond, TLS: true})
+	if value(metrics.ServerStageTCP) != 1 || value(metrics.ServerStageTLS) != 0 {
+		t.Errorf("server_up tcp/tls = %v/%v, want 1/0", value(metrics.ServerStageTCP), value(metrics.ServerStageTLS))
+	}
+	if !metricExistsWithLabels(t, "xray_tunnel_server_latency_seconds", stageLabels(metrics.ServerStageTCP)) {
+		t.Error("expected tcp latency to be recorded")
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_server_latency_seconds", stageLabels(metrics.ServerStageTLS)) {
+		t.Error("expected no tls latency for a failed handshake")
+	}
+
+	notAfter := time.Date(2027, 1, 2, 3, 4, 5, 0, time.UTC)
+	mu.UpdateServerProbe("probe", ml, ServerProbeResult{TCPUp: true, Cert: &CertInfo{NotAfter: notAfter, Issuer: "Old CA"}})
+	mu.UpdateServerProbe("probe", ml, ServerProbeResult{TCPUp: true, Cert: &CertInfo{NotAfter: notAfter, Issuer: "R11", SANMatch: true}})
+	mu.UpdateServerProbe("probe", ml, ServerProbeResult{})
+	var m dto.Metric
+	if err := metrics.TunnelServerCertExpiry.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != float64(notAfter.Unix()) {
+		t.Errorf("cert expiry = %v, want %v", got, notAfter.Unix())
+	}
+	if err := metrics.TunnelServerCertSANMatch.With(labels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 1 {
+		t.Errorf("cert SAN match = %v, want 1", got)
+	}
+	issuerLabels := func(issuer string) prometheus.Labels {
+		return prometheus.Labels{"name": "probe", "server": ml.Server, "security": ml.Security, "sni": ml.SNI, "issuer": issuer}
+	}
+	if !metricExistsWithLabels(t, "xray_tunnel_server_cert_info", issuerLabels("R11")) {
+		t.Error("expected cert info for the current issuer")
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_server_cert_info", issuerLabels("Old CA")) {
+		t.Error("expected cert info for the previous issuer to be replaced")
+	}
+
+	realityML := MetricLabels{Server: "probe.example.com:443", Security: "reality", SNI: "www.microsoft.com"}
+	realityLabels := prometheus.Labels{"name": "probe", "server": realityML.Server, "security": realityML.Security, "sni": realityML.SNI}
+	defer deleteServerProbeMetrics(realityLabels)
+	mu.UpdateServerProbe("probe", realityML, ServerProbeResult{TCPUp: true, Target: true})
+	if err := metrics.TunnelRealityTargetUp.With(realityLabels).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0 {
+		t.Errorf("reality_target_up = %v, want 0", got)
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_reality_target_up", labels) {
+		t.Error("expected no reality target series for a tls tunnel")
+	}
+
+	// A tunnel that dropped server_probe on reload loses its series.
+	old := &TunnelInstance{Name: "probe", MetricLabels: ml, ServerProbe: true}
+	kept := &TunnelInstance{Name: "probe", MetricLabels: ml}
+	CleanupRemovedTunnelMetrics([]*TunnelInstance{old}, []*TunnelInstance{kept})
+	if metricExistsWithLabels(t, "xray_tunnel_server_up", labels) ||
+		metricExistsWithLabels(t, "xray_tunnel_server_cert_expiry_timestamp_seconds", labels) {
+		t.Error("expected server probe metrics to be deleted")
+	}
+}
@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// soakMessageBuffer bounds the messages from the soak endpoint that are
+// queued while no heartbeat is waiting; further ones are dropped.
+const soakMessageBuffer = 16
+
+// RunSoak keeps one long-lived WebSocket connection open through the tunnel
+// to SoakURL until ctx is canceled, independently of the periodic checks.
+// Every SoakHeartbeat a text message is sent and must be echoed back within
+// CheckTimeout. An unanswered heartbeat or a connection closed by the far
+// end or by anything on the path is a drop, and the connection is reopened
+// at once. Failed attempts to open it are retried with the tunnel's
+// backoff, starting at SoakHeartbeat.
+func RunSoak(ctx context.Context, ti *TunnelInstance, mu MetricsUpdater) {
+	jitter := time.Duration(rand.Int64N(int64(ti.SoakHeartbeat)))
+	timer := time.NewTimer(jitter)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+
+	attempted := false
+	failures := 0
+	for {
+		conn, err := dialSoak(ctx, ti)
+		reconnect := attempted
+		attempted = true
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			wait := BackoffDuration(ti.SoakHeartbeat, ti.BackoffMultiplier, ti.MaxBackoff, failures)
+			failures++
+			slog.Warn("soak connection failed", "tunnel", ti.Name, "url", ti.SoakURL, "retry_in", wait, "error", err)
+			mu.UpdateSoak(ti.Name, ti.MetricLabels, SoakEvent{Err: err})
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		failures = 0
+		slog.Debug("soak connection opened", "tunnel", ti.Name, "url", ti.SoakURL, "reconnect", reconnect)
+		mu.UpdateSoak(ti.Name, ti.MetricLabels, SoakEvent{Up: true, Reconnect: reconnect})
+
+		lifetime, err := soakSession(ctx, ti, conn, mu)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("soak connection dropped", "tunnel", ti.Name, "lifetime", lifetime.Round(time.Second), "error", err)
+		mu.UpdateSoak(ti.Name, ti.MetricLabels, SoakEvent{Dropped: true, Lifetime: lifetime, Err: err})
+	}
+}
+
+// dialSoak opens the soak connection through the tunnel's SOCKS5 proxy.
+func dialSoak(ctx context.Context, ti *TunnelInstance) (*websocket.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, ti.CheckTimeout)
+	defer cancel()
+
+	socksDialer := ti.SOCKSDialer(ti.CheckTimeout)
+	dialer := websocket.Dialer{NetDialContext: socksDialer.DialContext}
+	conn, resp, err := dialer.DialContext(ctx, ti.SoakURL, nil)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("websocket handshake returned bad status: %d", resp.StatusCode)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// soakSession exchanges heartbeats over conn until it drops or ctx is
+// canceled, and returns how long the connection was open and why it ended.
+// Messages are read continuously, so a close is noticed when it happens
+// rather than at the next heartbeat.
+func soakSession(ctx context.Context, ti *TunnelInstance, conn *websocket.Conn, mu MetricsUpdater) (time.Duration, error) {
+	start := time.Now()
+	defer conn.Close()
+
+	msgs := make(chan string, soakMessageBuffer)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- fmt.Errorf("soak connection closed: %w", err)
+				return
+			}
+			select {
+			case msgs <- string(msg):
+			default:
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(ti.SoakHeartbeat)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		select {
+		case <-ctx.Done():
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return time.Since(start), ctx.Err()
+		case err := <-readErr:
+			return time.Since(start), err
+		case <-ticker.C:
+		}
+
+		rtt, err := soakHeartbeat(ctx, ti, conn, seq, msgs, readErr)
+		if err != nil {
+			return time.Since(start), err
+		}
+		mu.UpdateSoak(ti.Name, ti.MetricLabels, SoakEvent{Up: true, Lifetime: time.Since(start), RTT: rtt})
+	}
+}
+
+// soakHeartbeat sends heartbeat seq and waits for its echo, skipping other
+// messages.
+func soakHeartbeat(ctx context.Context, ti *TunnelInstance, conn *websocket.Conn, seq int, msgs <-chan string, readErr <-chan error) (time.Duration, error) {
+	token := fmt.Sprintf("xray-health-exporter soak %d", seq)
+
+	start := time.Now()
+	_ = conn.SetWriteDeadline(start.Add(ti.CheckTimeout))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(token)); err != nil {
+		return 0, fmt.Errorf("soak heartbeat: %w", err)
+	}
+
+	timer := time.NewTimer(ti.CheckTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-msgs:
+			if msg == token {
+				return time.Since(start), nil
+			}
+		case err := <-readErr:
+			return 0, err
+		case <-timer.C:
+			return 0, fmt.Errorf("soak heartbeat not answered within %s: %w", ti.CheckTimeout, context.DeadlineExceeded)
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/batonogov/xray-health-exporter/internal/metrics"
+)
+
+// soakRecorder collects the soak events of RunSoak, dropping them when
+// nobody reads, so RunSoak never blocks on it. Its other MetricsUpdater
+// methods are not used by the soak loop.
+type soakRecorder struct {
+	MetricsUpdater
+	events chan SoakEvent
+}
+
+func (r *soakRecorder) UpdateSoak(_ string, _ MetricLabels, ev SoakEvent) {
+	select {
+	case r.events <- ev:
+	default:
+	}
+}
+
+// next returns the next event that satisfies match, skipping others.
+func (r *soakRecorder) next(t *testing.T, what string, match func(SoakEvent) bool) SoakEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-r.events:
+			if match(ev) {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// startSOCKSRelay is a minimal SOCKS5 proxy that connects every request to
+// target, whatever address was asked for.
+func startSOCKSRelay(t *testing.T, target string) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create SOCKS listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				c.Read(make([]byte, 3))
+				c.Write([]byte{5, 0})
+				req := make([]byte, 4) // VER CMD RSV ATYP
+				if _, err := io.ReadFull(c, req); err != nil {
+					return
+				}
+				switch req[3] {
+				case 1:
+					io.ReadFull(c, make([]byte, 4+2))
+				case 3:
+					lenBuf := make([]byte, 1)
+					io.ReadFull(c, lenBuf)
+					io.ReadFull(c, make([]byte, int(lenBuf[0])+2))
+				case 4:
+					io.ReadFull(c, make([]byte, 16+2))
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					c.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, c)
+				io.Copy(c, upstream)
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startSoakServer serves an echo endpoint that drops the first connection
+// after two echoed heartbeats, and a /silent endpoint that never answers.
+func startSoakServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var upgrader websocket.Upgrader
+	var conns atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		first := conns.Add(1) == 1
+		conn.WriteMessage(websocket.TextMessage, []byte("Request served by test"))
+		for echoed := 0; ; echoed++ {
+			if first && echoed == 2 {
+				conn.UnderlyingConn().Close() // abrupt drop, no close frame
+				return
+			}
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(typ, msg)
+		}
+	})
+	mux.HandleFunc("/silent", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func soakTestInstance(socksPort int, url string) *TunnelInstance {
+	return &TunnelInstance{
+		Name:              "soak-test",
+		SocksPort:         socksPort,
+		CheckTimeout:      time.Second,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 2,
+		Soak:              true,
+		SoakURL:           url,
+		SoakHeartbeat:     20 * time.Millisecond,
+	}
+}
+
+func TestRunSoak_DropAndReconnect(t *testing.T) {
+	srv := startSoakServer(t)
+	socksPort := startSOCKSRelay(t, srv.Listener.Addr().String())
+	ti := soakTestInstance(socksPort, "ws://"+srv.Listener.Addr().String()+"/echo")
+
+	rec := &soakRecorder{events: make(chan SoakEvent, 64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunSoak(ctx, ti, rec)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	opened := rec.next(t, "the first connection", func(ev SoakEvent) bool { return ev.Up })
+	if opened.Reconnect {
+		t.Error("the first connection must not count as a reconnect")
+	}
+	beat := rec.next(t, "a heartbeat", func(ev SoakEvent) bool { return ev.RTT > 0 })
+	if !beat.Up || beat.Lifetime <= 0 {
+		t.Errorf("heartbeat event = %+v, want Up with a lifetime", beat)
+	}
+
+	drop := rec.next(t, "the drop", func(ev SoakEvent) bool { return ev.Dropped })
+	if drop.Up || drop.Lifetime <= 0 || drop.Err == nil {
+		t.Errorf("drop event = %+v, want down with a lifetime and an error", drop)
+	}
+	if reason := metrics.ClassifyError(drop.Err); reason != "connection_closed" && reason != "connection_reset" {
+		t.Errorf("ClassifyError(%v) = %q, want connection_closed or connection_reset", drop.Err, reason)
+	}
+
+	rec.next(t, "the reconnect", func(ev SoakEvent) bool { return ev.Up && ev.Reconnect })
+}
+
+func TestRunSoak_HeartbeatTimeout(t *testing.T) {
+	srv := startSoakServer(t)
+	socksPort := startSOCKSRelay(t, srv.Listener.Addr().String())
+	ti := soakTestInstance(socksPort, "ws://"+srv.Listener.Addr().String()+"/silent")
+	ti.CheckTimeout = 100 * time.Millisecond
+
+	rec := &soakRecorder{events: make(chan SoakEvent, 64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunSoak(ctx, ti, rec)
+
+	drop := rec.next(t, "the drop", func(ev SoakEvent) bool { return ev.Dropped })
+	if reason := metrics.ClassifyError(drop.Err); reason != "timeout" {
+		t.Errorf("ClassifyError(%v) = %q, want timeout", drop.Err, reason)
+	}
+}
+
+func TestRunSoak_ProxyDown(t *testing.T) {
+	ti := soakTestInstance(59994, "ws://127.0.0.1:1/")
+
+	rec := &soakRecorder{events: make(chan SoakEvent, 64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunSoak(ctx, ti, rec)
+
+	ev := rec.next(t, "a failed attempt", func(SoakEvent) bool { return true })
+	if ev.Up || ev.Dropped || ev.Err == nil {
+		t.Errorf("event = %+v, want a failed attempt that is not a drop", ev)
+	}
+}
+
+func TestRunSoak_StopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		RunSoak(ctx, soakTestInstance(59994, "ws://127.0.0.1:1/"), &soakRecorder{events: make(chan SoakEvent, 1)})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunSoak did not return after cancel")
+	}
+}
+
+func TestPrometheusMetrics_Soak(t *testing.T) {
+	ml := MetricLabels{Server: "soak.example.com:443", Security: "reality", SNI: "google.com"}
+	labels := prometheus.Labels{"name": "soak", "server": ml.Server, "security": ml.Security, "sni": ml.SNI}
+	defer deleteSoakMetrics(labels)
+
+	mu := NewPrometheusMetrics()
+	mu.UpdateSoak("soak", ml, SoakEvent{Up: true})
+	mu.UpdateSoak("soak", ml, SoakEvent{Up: true, Lifetime: 90 * time.Second, RTT: 40 * time.Millisecond})
+	for _, name := range []string{"xray_tunnel_soak_up", "xray_tunnel_soak_connection_age_seconds", "xray_tunnel_soak_heartbeat_rtt_seconds"} {
+		if !metricExistsWithLabels(t, name, labels) {
+			t.Errorf("expected %s after a heartbeat", name)
+		}
+	}
+	if metricExistsWithLabels(t, "xray_tunnel_soak_reconnects_total", labels) {
+		t.Error("expected no reconnects for the first connection")
+	}
+
+	mu.UpdateSoak("soak", ml, SoakEvent{Dropped: true, Lifetime: 5 * time.Minute, Err: context.DeadlineExceeded})
+	dropLabels := prometheus.Labels{"reason": "timeout"}
+	maps.Copy(dropLabels, labels)
+	if !metricExistsWithLabels(t, "xray_tunnel_soak_drops_total", dropLabels) {
+		t.Error("expected a drop with reason timeout")
+	}
+	if !metricExistsWithLabels(t, "xray_tunnel_soak_connection_lifetime_seconds", labels) {
+		t.Error("expected the lifetime of the dropped connection to be observed")
+	}
+
+	mu.UpdateSoak("soak", ml, SoakEvent{Up: true, Reconnect: true})
+	if !metricExistsWithLabels(t, "xray_tunnel_soak_reconnects_total", labels) {
+		t.Error("expected the reconnect to be counted")
+	}
+
+	deleteSoakMetrics(labels)
+	if metricExistsWithLabels(t, "xray_tunnel_soak_up", labels) ||
+		metricExistsWithLabels(t, "xray_tunnel_soak_drops_total", dropLabels) {
+		t.Error("expected the soak series to be deleted")
+	}
+}
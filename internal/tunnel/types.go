@@ -5,15 +5,19 @@ package tunnel
 import (
 	"context"
 	"encoding/json"
+	"math"
+	"slices"
 	"time"
 
 	"github.com/xtls/xray-core/core"
 )
 
 // HealthChecker performs a single health-check on a tunnel instance and
-// records the result through the returned CheckResult.
+// records the result through the returned CheckResult. Implementations must
+// return promptly once ctx is canceled; the result of a canceled check is
+// discarded.
 type HealthChecker interface {
-	Check(ti *TunnelInstance) CheckResult
+	Check(ctx context.Context, ti *TunnelInstance) CheckResult
 }
 
 // CheckResult holds the outcome of a single health-check.
@@ -24,17 +28,150 @@ type HealthChecker interface {
 //     fully read (partial success). Callers should check Up first
 //     and use Err for supplementary diagnostics only.
 //   - Up==false => tunnel is down; Err describes the reason.
+//
+// Download and upload checks also report the bytes moved and the transfer
+// speed; Degraded marks a passing check that was slower than min_throughput.
+// Stages holds the timings of the check stages that completed, even when a
+// later stage failed.
 type CheckResult struct {
-	Up         bool
-	Latency    time.Duration
-	HTTPStatus int
-	Err        error
+	Up                 bool
+	Degraded           bool
+	Unknown            bool // failed while the baseline probe was failing; not counted as down
+	Latency            time.Duration
+	HTTPStatus         int
+	BytesDownloaded    int64
+	DownloadThroughput float64 // bytes per second after the first byte; 0 if not measured
+	BytesUploaded      int64
+	UploadThroughput   float64                  // bytes per second until the sink answered; 0 if not measured
+	Stages             map[string]time.Duration // per-stage timings keyed by metrics.Stage*
+	Samples            *SampleStats             // set when the check ran more than one sample
+	Concurrency        *ConcurrencyStats        // parallel requests of the concurrency method
+	Exit               *ExitInfo                // exit reported by the ip method's IP-echo service
+	RoundTrip          time.Duration            // websocket message (or ping) round trip
+	Protocol           string                   // application protocol negotiated by the http3 method
+	ExecValue          *float64                 // value parsed from the exec method's output
+	Err                error
+}
+
+// ServerProbeResult holds the outcome of a direct probe of a tunnel's server,
+// bypassing Xray: a TCP connect and, for security=tls, a TLS handshake. For
+// security=reality the camouflage target is probed as well.
+type ServerProbeResult struct {
+	TCPUp         bool
+	TCPLatency    time.Duration
+	TLS           bool // a TLS handshake was attempted
+	TLSUp         bool
+	TLSLatency    time.Duration
+	Cert          *CertInfo // server certificate; set whenever the server sent one
+	Target        bool      // the REALITY camouflage target was probed
+	TargetUp      bool
+	TargetLatency time.Duration
+	Err           error
+}
+
+// CertInfo describes the leaf certificate presented by a tls-security server.
+type CertInfo struct {
+	NotAfter time.Time
+	Issuer   string
+	SANMatch bool // the certificate is valid for the SNI (or one of the vcn names)
+}
+
+// SoakEvent reports a change of a tunnel's soak connection: opened, a
+// heartbeat answered, dropped, or an attempt to open it failed.
+type SoakEvent struct {
+	Up        bool          // the connection is open
+	Reconnect bool          // the connection was just opened, and it is not the first one
+	Dropped   bool          // an open connection was lost; Err says why
+	Lifetime  time.Duration // time the connection has been open, or was open when it dropped
+	RTT       time.Duration // round trip of the heartbeat just answered
+	Err       error
+}
+
+// ExitInfo describes where a tunnel's traffic leaves the proxy, as reported
+// by an IP-echo service. Country and ASN are empty when the service does not
+// report them.
+type ExitInfo struct {
+	IP      string
+	Country string // ISO 3166-1 alpha-2, upper case
+	ASN     string // e.g. AS13335
+}
+
+// SampleStats summarizes the samples of a multi-sample check cycle.
+type SampleStats struct {
+	Count     int             // samples run
+	Failed    int             // samples that were not up
+	Latencies []time.Duration // latencies of the successful samples
+}
+
+// Loss returns the fraction of failed samples, or 0 when none ran.
+func (s *SampleStats) Loss() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Count)
+}
+
+// LatencyStats returns the minimum, mean, maximum and population standard
+// deviation of the successful samples' latencies. All are zero when no
+// sample succeeded.
+func (s *SampleStats) LatencyStats() (minL, avg, maxL, stddev time.Duration) {
+	if len(s.Latencies) == 0 {
+		return 0, 0, 0, 0
+	}
+	minL, maxL = s.Latencies[0], s.Latencies[0]
+	var sum float64
+	for _, l := range s.Latencies {
+		minL = min(minL, l)
+		maxL = max(maxL, l)
+		sum += float64(l)
+	}
+	mean := sum / float64(len(s.Latencies))
+	var variance float64
+	for _, l := range s.Latencies {
+		d := float64(l) - mean
+		variance += d * d
+	}
+	variance /= float64(len(s.Latencies))
+	return minL, time.Duration(mean), maxL, time.Duration(math.Sqrt(variance))
+}
+
+// ConcurrencyStats summarizes the parallel requests of one concurrency check.
+type ConcurrencyStats struct {
+	Requests    int             // requests started
+	Failed      int             // requests that did not get an accepted response
+	MaxInFlight int             // most requests connected through the tunnel at once
+	Latencies   []time.Duration // latencies of the successful requests
+}
+
+// SuccessRatio returns the fraction of requests that succeeded, or 0 when
+// none ran.
+func (s *ConcurrencyStats) SuccessRatio() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Requests-s.Failed) / float64(s.Requests)
+}
+
+// Quantile returns the q-quantile (0-1, nearest rank) of the successful
+// requests' latencies, or 0 when none succeeded.
+func (s *ConcurrencyStats) Quantile(q float64) time.Duration {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Sorted(slices.Values(s.Latencies))
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
 }
 
 // MetricsUpdater records health-check results as Prometheus metrics.
+// Update and RecordError are per-check (labels.Check names the check);
+// SetTunnelUp records the tunnel-level status derived from the up policy.
 type MetricsUpdater interface {
 	Update(name string, labels MetricLabels, result CheckResult)
 	RecordError(name string, ml MetricLabels, err error)
+	SetTunnelUp(name string, labels MetricLabels, up bool)
+	UpdateServerProbe(name string, labels MetricLabels, result ServerProbeResult)
+	UpdateSoak(name string, labels MetricLabels, event SoakEvent)
 }
 
 // VLESSConfig holds the parsed fields of a VLESS URL.
@@ -47,6 +184,7 @@ type VLESSConfig struct {
 	Security             string
 	PBK                  string
 	SNI                  string
+	SNIDefaulted         bool // the link has no sni; SNI is the server address
 	FP                   string
 	SID                  string
 	PQV                  string
@@ -75,6 +213,23 @@ type MetricLabels struct {
 	Server   string
 	Security string
 	SNI      string
+	Check    string // set on check instances only
+}
+
+// SOCKSCredentials are the username and password of a tunnel's SOCKS5
+// inbound.
+type SOCKSCredentials struct {
+	Username string
+	Password string
+}
+
+// TunnelCheck is one named health-check of a tunnel. Instance is a copy of
+// the tunnel carrying the check's own method and parameters; it shares the
+// tunnel's Xray instance and SOCKS port.
+type TunnelCheck struct {
+	Name     string
+	Required bool
+	Instance *TunnelInstance
 }
 
 // TunnelInstance represents a running tunnel with its Xray instance and
@@ -85,15 +240,23 @@ type TunnelInstance struct {
 	MetricLabels      MetricLabels
 	XrayInstance      *core.Instance
 	SocksPort         int
+	SocksAuth         *SOCKSCredentials // nil when the inbound takes no authentication
 	CheckURL          string
 	CheckInterval     time.Duration
 	CheckTimeout      time.Duration
 	MaxBackoff        time.Duration
 	BackoffMultiplier float64
 	CheckMethod       string
-	IPCheckURL        string
-	DownloadURL       string
-	DownloadTimeout   time.Duration
-	DownloadMinSize   int64
+	Samples           int           // probes per check cycle; 1 runs a single probe
+	SampleInterval    time.Duration // pause between samples
+	MaxLoss           float64       // fraction of failed samples still counted as up
+	MethodConfig      any           // settings decoded by the method's config.Method.Decode
+	Checks            []TunnelCheck // empty => one check from the fields above
+	UpPolicy          string        // all (default), any or required
+	ServerProbe       bool          // probe the VLESS server directly, bypassing Xray
+	Soak              bool          // keep a long-lived connection open through the tunnel
+	SoakURL           string        // ws:// or wss:// echo endpoint of the soak connection
+	SoakHeartbeat     time.Duration // interval between soak heartbeats
 	cancelFunc        context.CancelFunc
+	done              chan struct{} // closed once the checker and soak goroutines returned
 }
@@ -16,7 +16,7 @@ import (
 
 type watchMockChecker struct{}
 
-func (watchMockChecker) Check(ti *TunnelInstance) CheckResult {
+func (watchMockChecker) Check(_ context.Context, ti *TunnelInstance) CheckResult {
 	return CheckResult{Up: true, Latency: 10 * time.Millisecond, HTTPStatus: 200}
 }
 
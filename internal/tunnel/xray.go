@@ -1,13 +1,17 @@
 package tunnel
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/batonogov/xray-health-exporter/internal/socks"
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/infra/conf"
 )
@@ -107,6 +111,7 @@ func ParseVLESSURL(vlessURL string) (*VLESSConfig, error) {
 	if config.Security == "tls" || config.Security == "reality" {
 		if config.SNI == "" {
 			config.SNI = config.Address
+			config.SNIDefaulted = true
 		}
 		if config.FP == "" {
 			config.FP = "chrome"
@@ -208,9 +213,55 @@ func parseUint32Parameter(query url.Values, key string) (*uint32, error) {
 	return &result, nil
 }
 
+// NewSOCKSCredentials generates a random username and password for a
+// tunnel's SOCKS5 inbound.
+func NewSOCKSCredentials() (*SOCKSCredentials, error) {
+	buf := make([]byte, 8+16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate SOCKS credentials: %v", err)
+	}
+	return &SOCKSCredentials{
+		Username: hex.EncodeToString(buf[:8]),
+		Password: hex.EncodeToString(buf[8:]),
+	}, nil
+}
+
+// socksInbound returns the SOCKS5 inbound on 127.0.0.1:port, protected by
+// creds unless they are nil.
+func socksInbound(port int, creds *SOCKSCredentials) map[string]interface{} {
+	settings := map[string]interface{}{
+		"auth": "noauth",
+		"udp":  true,
+	}
+	if creds != nil {
+		settings["auth"] = "password"
+		settings["accounts"] = []map[string]interface{}{
+			{"user": creds.Username, "pass": creds.Password},
+		}
+	}
+	return map[string]interface{}{
+		"port":     port,
+		"listen":   "127.0.0.1",
+		"protocol": "socks",
+		"settings": settings,
+	}
+}
+
+// SOCKSDialer returns a dialer through the tunnel's SOCKS5 inbound, using
+// its credentials if it has any.
+func (ti *TunnelInstance) SOCKSDialer(timeout time.Duration) *socks.SOCKS5Dialer {
+	d := socks.NewSOCKS5Dialer(fmt.Sprintf("127.0.0.1:%d", ti.SocksPort), timeout)
+	if ti.SocksAuth != nil {
+		d.Username = ti.SocksAuth.Username
+		d.Password = ti.SocksAuth.Password
+	}
+	return d
+}
+
 // CreateXrayConfig generates a complete Xray JSON config for a VLESS tunnel
-// with a SOCKS5 inbound on the given port.
-func CreateXrayConfig(vlessConfig *VLESSConfig, socksPort int) ([]byte, error) {
+// with a SOCKS5 inbound on the given port, protected by socksAuth unless it
+// is nil.
+func CreateXrayConfig(vlessConfig *VLESSConfig, socksPort int, socksAuth *SOCKSCredentials) ([]byte, error) {
 	logLevel := os.Getenv("XRAY_LOG_LEVEL")
 	if logLevel == "" {
 		logLevel = "warning"
@@ -233,15 +284,7 @@ func CreateXrayConfig(vlessConfig *VLESSConfig, socksPort int) ([]byte, error) {
 			"loglevel": logLevel,
 		},
 		"inbounds": []map[string]interface{}{
-			{
-				"port":     socksPort,
-				"listen":   "127.0.0.1",
-				"protocol": "socks",
-				"settings": map[string]interface{}{
-					"auth": "noauth",
-					"udp":  true,
-				},
-			},
+			socksInbound(socksPort, socksAuth),
 		},
 		"outbounds": []map[string]interface{}{
 			{
@@ -420,9 +463,9 @@ func StartXray(configJSON []byte) (*core.Instance, error) {
 }
 
 // LoadXrayConfigFile reads a native Xray JSON config file, injects a SOCKS5
-// inbound on the given port, and returns the modified JSON along with the
-// extracted metric labels.
-func LoadXrayConfigFile(path string, socksPort int) ([]byte, MetricLabels, error) {
+// inbound on the given port, protected by socksAuth unless it is nil, and
+// returns the modified JSON along with the extracted metric labels.
+func LoadXrayConfigFile(path string, socksPort int, socksAuth *SOCKSCredentials) ([]byte, MetricLabels, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, MetricLabels{}, fmt.Errorf("failed to read xray config file: %v", err)
@@ -445,15 +488,7 @@ func LoadXrayConfigFile(path string, socksPort int) ([]byte, MetricLabels, error
 		"loglevel": logLevel,
 	}
 	raw["inbounds"] = []map[string]interface{}{
-		{
-			"port":     socksPort,
-			"listen":   "127.0.0.1",
-			"protocol": "socks",
-			"settings": map[string]interface{}{
-				"auth": "noauth",
-				"udp":  true,
-			},
-		},
+		socksInbound(socksPort, socksAuth),
 	}
 
 	result, err := json.MarshalIndent(raw, "", "  ")
@@ -133,6 +133,7 @@ func TestParseVLESSURL(t *testing.T) {
 				Type:                 "httpupgrade",
 				Security:             "tls",
 				SNI:                  "tls.example.com",
+				SNIDefaulted:         true,
 				FP:                   "chrome",
 				ALPN:                 []string{"h2", "http/1.1"},
 				ECHConfigList:        "ech-config",
@@ -567,7 +568,7 @@ func TestCreateXrayConfig(t *testing.T) {
 		FP:         "chrome",
 	}
 
-	jsonData, err := CreateXrayConfig(config, 1080)
+	jsonData, err := CreateXrayConfig(config, 1080, nil)
 	if err != nil {
 		t.Fatalf("CreateXrayConfig() error = %v", err)
 	}
@@ -635,7 +636,7 @@ func TestCreateXrayConfig_gRPC(t *testing.T) {
 		SID:         "ab12cd34",
 	}
 
-	jsonData, err := CreateXrayConfig(config, 1081)
+	jsonData, err := CreateXrayConfig(config, 1081, nil)
 	if err != nil {
 		t.Fatalf("CreateXrayConfig() error = %v", err)
 	}
@@ -697,7 +698,7 @@ func TestCreateXrayConfig_XHTTPBuildsWithCurrentXray(t *testing.T) {
 		Extra:      json.RawMessage(`{"xPaddingBytes":"100-1000"}`),
 	}
 
-	jsonData, err := CreateXrayConfig(config, 1082)
+	jsonData, err := CreateXrayConfig(config, 1082, nil)
 	if err != nil {
 		t.Fatalf("CreateXrayConfig() error = %v", err)
 	}
@@ -726,7 +727,7 @@ func TestCreateXrayConfig_WithXRAYLogLevel(t *testing.T) {
 	os.Setenv("XRAY_LOG_LEVEL", "debug")
 	defer os.Setenv("XRAY_LOG_LEVEL", origVal)
 
-	jsonData, err := CreateXrayConfig(config, 1080)
+	jsonData, err := CreateXrayConfig(config, 1080, nil)
 	if err != nil {
 		t.Fatalf("CreateXrayConfig() error = %v", err)
 	}
@@ -746,7 +747,7 @@ func TestLoadXrayConfigFile(t *testing.T) {
 		path := filepath.Join(tmpDir, "xray.json")
 		os.WriteFile(path, []byte(`{"outbounds":[{"protocol":"vless","settings":{"vnext":[{"address":"srv.com","port":443}]},"streamSettings":{"security":"tls","tlsSettings":{"serverName":"srv.com"}}}]}`), 0644)
 
-		data, labels, err := LoadXrayConfigFile(path, 2080)
+		data, labels, err := LoadXrayConfigFile(path, 2080, nil)
 		if err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -774,7 +775,7 @@ func TestLoadXrayConfigFile(t *testing.T) {
 	})
 
 	t.Run("nonexistent file", func(t *testing.T) {
-		_, _, err := LoadXrayConfigFile("/nonexistent/xray.json", 2080)
+		_, _, err := LoadXrayConfigFile("/nonexistent/xray.json", 2080, nil)
 		if err == nil {
 			t.Error("expected error")
 		}
@@ -785,7 +786,7 @@ func TestLoadXrayConfigFile(t *testing.T) {
 		path := filepath.Join(tmpDir, "bad.json")
 		os.WriteFile(path, []byte(`not json`), 0644)
 
-		_, _, err := LoadXrayConfigFile(path, 2080)
+		_, _, err := LoadXrayConfigFile(path, 2080, nil)
 		if err == nil {
 			t.Error("expected error for invalid JSON")
 		}
@@ -798,7 +799,7 @@ func TestLoadXrayConfigFile_OverwritesUserInbounds(t *testing.T) {
 	config := `{"inbounds":[{"port":12345,"protocol":"http"}],"outbounds":[{"protocol":"freedom"}]}`
 	os.WriteFile(path, []byte(config), 0644)
 
-	data, _, err := LoadXrayConfigFile(path, 3080)
+	data, _, err := LoadXrayConfigFile(path, 3080, nil)
 	if err != nil {
 		t.Fatalf("error: %v", err)
 	}
@@ -819,6 +820,62 @@ func TestLoadXrayConfigFile_OverwritesUserInbounds(t *testing.T) {
 	}
 }
 
+func TestSOCKSInbound_Auth(t *testing.T) {
+	creds, err := NewSOCKSCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewSOCKSCredentials()
+	if *creds == *other {
+		t.Error("NewSOCKSCredentials() returned the same credentials twice")
+	}
+
+	path := filepath.Join(t.TempDir(), "xray.json")
+	os.WriteFile(path, []byte(`{"outbounds":[{"protocol":"freedom"}]}`), 0644)
+	vless := &VLESSConfig{UUID: "test-uuid", Address: "example.com", Port: 443, Type: "tcp", Security: "none"}
+
+	generate := map[string]func(*SOCKSCredentials) ([]byte, error){
+		"url": func(c *SOCKSCredentials) ([]byte, error) { return CreateXrayConfig(vless, 1080, c) },
+		"xray_config_file": func(c *SOCKSCredentials) ([]byte, error) {
+			data, _, err := LoadXrayConfigFile(path, 1080, c)
+			return data, err
+		},
+	}
+	for mode, gen := range generate {
+		for _, c := range []*SOCKSCredentials{creds, nil} {
+			data, err := gen(c)
+			if err != nil {
+				t.Fatalf("%s: error = %v", mode, err)
+			}
+			var result struct {
+				Inbounds []struct {
+					Settings struct {
+						Auth     string `json:"auth"`
+						Accounts []struct {
+							User string `json:"user"`
+							Pass string `json:"pass"`
+						} `json:"accounts"`
+					} `json:"settings"`
+				} `json:"inbounds"`
+			}
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatalf("%s: failed to parse JSON: %v", mode, err)
+			}
+			settings := result.Inbounds[0].Settings
+			if c == nil {
+				if settings.Auth != "noauth" || len(settings.Accounts) != 0 {
+					t.Errorf("%s without credentials: auth = %q, accounts = %v, want noauth", mode, settings.Auth, settings.Accounts)
+				}
+				continue
+			}
+			if settings.Auth != "password" || len(settings.Accounts) != 1 ||
+				settings.Accounts[0].User != c.Username || settings.Accounts[0].Pass != c.Password {
+				t.Errorf("%s: auth = %q, accounts = %v, want password with the tunnel's credentials", mode, settings.Auth, settings.Accounts)
+			}
+		}
+	}
+}
+
 func TestLoadXrayConfigFile_WithXRAYLogLevel(t *testing.T) {
 	tmpDir := t.TempDir()
 	path := filepath.Join(tmpDir, "xray.json")
@@ -828,7 +885,7 @@ func TestLoadXrayConfigFile_WithXRAYLogLevel(t *testing.T) {
 	os.Setenv("XRAY_LOG_LEVEL", "debug")
 	defer os.Setenv("XRAY_LOG_LEVEL", origVal)
 
-	data, _, err := LoadXrayConfigFile(path, 2080)
+	data, _, err := LoadXrayConfigFile(path, 2080, nil)
 	if err != nil {
 		t.Fatalf("error: %v", err)
 	}
@@ -1025,7 +1082,7 @@ func BenchmarkCreateXrayConfig(b *testing.B) {
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := CreateXrayConfig(configs[i%len(configs)], 1080+i%10)
+		_, err := CreateXrayConfig(configs[i%len(configs)], 1080+i%10, nil)
 		if err != nil {
 			b.Fatal(err)
 		}